@@ -1,12 +1,68 @@
+/* Creates the schema from scratch. To upgrade an existing database see migrations/README.md */
+
 DROP SCHEMA public CASCADE;
 
 CREATE SCHEMA public;
 
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
+CREATE TABLE users (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    username VARCHAR(24) NOT NULL,
+    /* bcrypt. NULL for accounts migrated from before user accounts existed,
+     until they are claimed with an invite, and for single sign-on users */
+    password_hash VARCHAR(72) DEFAULT NULL,
+    /* admin, streamer or viewer. The first user to register is made an admin. */
+    role VARCHAR(16) NOT NULL DEFAULT 'streamer',
+    /* base32 TOTP secret, two factor authentication is enabled when this is set */
+    totp_secret VARCHAR(64) DEFAULT NULL,
+    /* secret generated by setup, which becomes the secret once a code from it is confirmed */
+    totp_pending_secret VARCHAR(64) DEFAULT NULL,
+    /* time step of the last accepted code, so that a code can't be used twice */
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
+    /* subject from the OpenID Connect identity provider, for users who log in with single sign-on */
+    oidc_subject VARCHAR(255) UNIQUE DEFAULT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX users_username_idx ON users (LOWER(username));
+
+/* Every user has a streamer, which is their public identity. The streamer id is the uid
+ used by sessions, the socket server and WebRTC. */
 CREATE TABLE streamers (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
-    name VARCHAR(24) NOT NULL
+    name VARCHAR(24) NOT NULL,
+    user_id UUID UNIQUE NOT NULL REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE invites (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    /* sha256 of the invite code, the code itself is only shown once */
+    code_hash VARCHAR(64) UNIQUE NOT NULL,
+    role VARCHAR(16) NOT NULL DEFAULT 'streamer',
+    /* set when the invite is for claiming an existing account */
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ DEFAULT NULL,
+    used_by UUID REFERENCES users(id) ON DELETE SET NULL
+);
+
+/* Long lived API tokens for headless cameras, issued by admins */
+CREATE TABLE device_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    label VARCHAR(48) NOT NULL,
+    /* sha256 of the token, the token itself is only shown once */
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    /* the device publishes as this streamer */
+    streamer UUID NOT NULL REFERENCES streamers(id) ON DELETE CASCADE,
+    /* names of the streams the device is allowed to publish to */
+    streams VARCHAR(24)[] NOT NULL DEFAULT '{}',
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ DEFAULT NULL,
+    revoked_at TIMESTAMPTZ DEFAULT NULL
 );
 
 CREATE TABLE vid_meta (
@@ -18,6 +74,15 @@ CREATE TABLE vid_meta (
      has sent a piece of data, and the client sends data as second long blobs*/
     seconds INT NOT NULL DEFAULT 1,
     active BOOLEAN DEFAULT FALSE,
+    /* JPEG from the first snapshot, replaced by the latest snapshot at each motion start */
+    thumbnail BYTEA DEFAULT NULL,
+    /* size of the first piece of data received, which has the WebM header. Used for
+     making clips, 0 for recordings made before it was recorded. */
+    header_size INT NOT NULL DEFAULT 0,
+    /* data key for the chunks, encrypted by the master key. NULL when the recording
+     was made without a master key configured, in which case the chunks are plaintext. */
+    data_key BYTEA DEFAULT NULL,
+    master_key_id VARCHAR(16) DEFAULT NULL,
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
 
@@ -26,4 +91,121 @@ CREATE TABLE vid_chunks (
     vid_id UUID REFERENCES vid_meta(id) ON DELETE CASCADE,
     index INT NOT NULL DEFAULT 0,
     bytes BYTEA NOT NULL
+);
+
+CREATE TABLE arm_schedules (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    streamer UUID REFERENCES streamers(id) ON DELETE CASCADE,
+    stream_name VARCHAR(24) NOT NULL,
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    /* Array of {"day":0-6,"start":"HH:MM","end":"HH:MM"} windows during which
+     the stream is armed. An empty array means armed all week. */
+    windows JSONB NOT NULL DEFAULT '[]',
+    /* NULL when following the schedule, otherwise a manual arm/disarm override */
+    override BOOLEAN DEFAULT NULL,
+    UNIQUE (streamer, stream_name)
+);
+
+CREATE TABLE notification_subscriptions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    owner UUID REFERENCES streamers(id) ON DELETE CASCADE,
+    /* EMAIL, NTFY or WEBHOOK */
+    channel VARCHAR(16) NOT NULL,
+    /* Email address for EMAIL, topic or webhook URL for NTFY and WEBHOOK */
+    target VARCHAR(512) NOT NULL,
+    /* NULL to subscribe to every stream */
+    stream_name VARCHAR(24) DEFAULT NULL,
+    /* streamer the stream belongs to, NULL for streams of that name from any streamer */
+    streamer UUID REFERENCES streamers(id) ON DELETE CASCADE DEFAULT NULL,
+    events VARCHAR(32)[] NOT NULL DEFAULT '{MOTION_START,CAMERA_OFFLINE}',
+    quiet_start VARCHAR(5) DEFAULT NULL,
+    quiet_end VARCHAR(5) DEFAULT NULL,
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    /* Minimum number of seconds between notifications for the same stream and event */
+    min_interval INT NOT NULL DEFAULT 300,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE stream_outages (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    streamer UUID REFERENCES streamers(id) ON DELETE CASCADE,
+    stream_name VARCHAR(24) NOT NULL,
+    /* STALLED or OFFLINE */
+    kind VARCHAR(16) NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    /* NULL while the outage is ongoing */
+    ended_at TIMESTAMPTZ DEFAULT NULL
+);
+
+/* Append only. There is no foreign key on the actor, the log has to outlive the
+ streamers in it, so the actors name at the time is kept alongside the uid. */
+CREATE TABLE audit_log (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    /* streamer uid of whoever performed the action, NULL for anonymous actions */
+    actor UUID DEFAULT NULL,
+    actor_name VARCHAR(24) NOT NULL DEFAULT '',
+    action VARCHAR(48) NOT NULL,
+    target VARCHAR(128) NOT NULL DEFAULT '',
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_log_created_at_idx ON audit_log(created_at);
+CREATE INDEX audit_log_actor_idx ON audit_log(actor, created_at);
+CREATE INDEX audit_log_action_idx ON audit_log(action, created_at);
+
+CREATE FUNCTION audit_log_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TABLE recovery_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    /* sha256 of the code without the dash */
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMPTZ DEFAULT NULL
+);
+
+/* Server wide settings changed by admins */
+CREATE TABLE settings (
+    key VARCHAR(48) PRIMARY KEY,
+    value JSONB NOT NULL,
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+/* Keys for signing JWTs. Retired keys are kept until their grace period is over. */
+CREATE TABLE signing_keys (
+    id VARCHAR(16) PRIMARY KEY,
+    secret BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    retired_at TIMESTAMPTZ DEFAULT NULL
+);
+
+/* Signed links for downloading a recording without an account */
+CREATE TABLE share_links (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    vid_id UUID NOT NULL REFERENCES vid_meta(id) ON DELETE CASCADE,
+    /* optional clip range in seconds from the start of the recording */
+    start_seconds INT DEFAULT NULL,
+    end_seconds INT DEFAULT NULL,
+    /* NULL for unlimited downloads */
+    max_downloads INT DEFAULT NULL,
+    downloads INT NOT NULL DEFAULT 0,
+    created_by UUID REFERENCES streamers(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ DEFAULT NULL
+);
+
+/* The key share links are signed with, there is only ever one row */
+CREATE TABLE share_link_key (
+    id INT PRIMARY KEY CHECK (id = 1),
+    secret BYTEA NOT NULL
 );
\ No newline at end of file
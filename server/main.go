@@ -4,14 +4,25 @@ import (
 	"fmt"
 	"log"
 	"os"
+	_ "time/tzdata"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/joho/godotenv"
+	armServer "github.com/web-stuff-98/go-react-vid-streams/pkg/armServer"
 	"github.com/web-stuff-98/go-react-vid-streams/pkg/db"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/encryption"
 	"github.com/web-stuff-98/go-react-vid-streams/pkg/handlers"
-	rdb "github.com/web-stuff-98/go-react-vid-streams/pkg/redis"
+	healthMonitor "github.com/web-stuff-98/go-react-vid-streams/pkg/healthMonitor"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
+	keyRing "github.com/web-stuff-98/go-react-vid-streams/pkg/keyRing"
+	loginGuard "github.com/web-stuff-98/go-react-vid-streams/pkg/loginGuard"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/notifier"
+	pairingServer "github.com/web-stuff-98/go-react-vid-streams/pkg/pairingServer"
+	sessionStore "github.com/web-stuff-98/go-react-vid-streams/pkg/sessionStore"
+	shareLinks "github.com/web-stuff-98/go-react-vid-streams/pkg/shareLinks"
 	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/sso"
 	videoServer "github.com/web-stuff-98/go-react-vid-streams/pkg/videoServer"
 	webRTCserver "github.com/web-stuff-98/go-react-vid-streams/pkg/webRTCserver"
 )
@@ -23,12 +34,29 @@ func main() {
 
 	app := fiber.New()
 	db := db.Init()
-	rd := rdb.Init()
-	vs := videoServer.Init(db)
-	rtcDC := make(chan string) // WebRTC server socket disconnect UID channel
+	vault := encryption.Init()
+
+	// rewraps the recording data keys after the master key has been changed, then exits
+	if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		if err := vault.Rekey(db); err != nil {
+			log.Fatalln("Rekey failed:", err)
+		}
+		return
+	}
+
+	store := sessionStore.Init()
+	rtcDC := make(chan string) // WebRTC server socket disconnect connection ID channel
 	ss := socketServer.Init(rtcDC)
-	rtc := webRTCserver.Init(ss, rtcDC)
-	h := handlers.New(vs, db, rd, ss, rtc)
+	vs := videoServer.Init(db, ss, vault)
+	as := armServer.Init(ss, db)
+	n := notifier.Init(db, vs)
+	rtc := webRTCserver.Init(ss, vs, as, n, rtcDC)
+	hm := healthMonitor.Init(ss, as, n, db)
+	ps := pairingServer.Init()
+	lg := loginGuard.Init()
+	kr := keyRing.Init(db)
+	sl := shareLinks.Init(db)
+	h := handlers.New(vs, db, store, ss, rtc, as, n, hm, ps, lg, kr, sl, vault, sso.Init())
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://localhost:5173",
@@ -36,23 +64,82 @@ func main() {
 		AllowCredentials: true,
 	}))
 
-	app.Post("/api/video/chunk", h.HandleChunk)
-	app.Get("/api/video/:name", h.DownloadStreamVideo)
-	app.Get("/api/video/meta/:name", h.GetVideoMeta)
+	admin := h.RequireRole(authHelpers.RoleAdmin)
+	streamer := h.RequireRole(authHelpers.RoleStreamer)
+	viewer := h.RequireRole(authHelpers.RoleViewer)
+	streamerOrDevice := h.RequireRoleOrDevice(authHelpers.RoleStreamer)
+	viewerOrDevice := h.RequireRoleOrDevice(authHelpers.RoleViewer)
 
-	app.Get("/api/streams/old", h.GetOldStreams)
-	app.Delete("/api/streams/:name", h.DeleteStream)
+	app.Post("/api/video/chunk", streamerOrDevice, h.HandleChunk)
+	app.Get("/api/video/:name", viewer, h.DownloadStreamVideo)
+	app.Get("/api/video/meta/:name", viewer, h.GetVideoMeta)
+	app.Get("/api/video/:name/thumbnail", viewer, h.GetVideoThumbnail)
+	app.Post("/api/video/:name/share", streamer, h.ShareRecording)
+
+	app.Get("/api/shares", streamer, h.GetShareLinks)
+	app.Delete("/api/shares/:id", streamer, h.RevokeShareLink)
+	app.Get("/api/share/:id", h.DownloadShareLink)
+
+	app.Get("/api/streams/old", viewer, h.GetOldStreams)
+	app.Get("/api/streams/health", viewer, h.GetStreamsHealth)
+	app.Get("/api/streams/outages", viewer, h.GetStreamOutages)
+	app.Delete("/api/streams/:name", streamer, h.DeleteStream)
+	app.Get("/api/streams/:name/stats", viewer, h.GetStreamStats)
+	app.Post("/api/streams/:name/snapshot", streamerOrDevice, h.UploadSnapshot)
+	app.Get("/api/streams/:name/snapshot.jpg", viewer, h.GetStreamSnapshot)
+	app.Get("/api/streams/:name/schedule", streamer, h.GetStreamSchedule)
+	app.Put("/api/streams/:name/schedule", streamer, h.SetStreamSchedule)
+	app.Put("/api/streams/:name/arm", streamer, h.SetStreamArmOverride)
 
 	app.Post("/api/auth/login", h.InitialLogin)
+	app.Post("/api/auth/login/2fa", h.LoginTwoFactor)
+	app.Get("/api/auth/oidc", h.GetSSO)
+	app.Get("/api/auth/oidc/login", h.SSOLogin)
+	app.Get("/api/auth/oidc/callback", h.SSOCallback)
+	app.Post("/api/auth/register", h.Register)
 	app.Post("/api/auth/refresh", h.Refresh)
-	app.Post("/api/auth/streamer/login", h.StreamerLogin)
-	app.Post("/api/auth/streamer/logout", h.StreamerLogout)
-	app.Post("/api/auth/streamer/register", h.StreamerRegister)
+	app.Post("/api/auth/password", viewer, h.ChangePassword)
+	app.Post("/api/auth/logout", viewer, h.Logout)
+	app.Post("/api/auth/logout/all", viewer, h.LogoutEverywhere)
+	app.Get("/api/auth/2fa", viewer, h.GetTwoFactor)
+	app.Post("/api/auth/2fa/setup", viewer, h.SetupTwoFactor)
+	app.Post("/api/auth/2fa/enable", viewer, h.EnableTwoFactor)
+	app.Post("/api/auth/2fa/disable", viewer, h.DisableTwoFactor)
+	app.Post("/api/auth/2fa/recovery-codes", viewer, h.RegenerateRecoveryCodes)
+	app.Get("/api/auth/lockouts", admin, h.GetLockouts)
+	app.Delete("/api/auth/lockouts", admin, h.ClearLockout)
+	app.Get("/api/auth/sessions", viewer, h.GetSessions)
+	app.Delete("/api/auth/sessions", viewer, h.RevokeOtherSessions)
+	app.Delete("/api/auth/sessions/:id", viewer, h.RevokeSession)
+
+	app.Get("/api/settings", admin, h.GetSettings)
+	app.Put("/api/settings", admin, h.UpdateSettings)
+
+	app.Get("/api/audit", admin, h.GetAuditLog)
+
+	app.Get("/api/users", admin, h.GetUsers)
+	app.Get("/api/users/invites", admin, h.GetInvites)
+	app.Post("/api/users/invites", admin, h.CreateInvite)
+	app.Delete("/api/users/invites/:id", admin, h.DeleteInvite)
+
+	app.Get("/api/devices", admin, h.GetDevices)
+	app.Post("/api/devices", admin, h.CreateDevice)
+	app.Delete("/api/devices/:id", admin, h.RevokeDevice)
+
+	app.Post("/api/pairing", h.RequestPairing)
+	app.Get("/api/pairing", admin, h.GetPairings)
+	app.Post("/api/pairing/approve", admin, h.ApprovePairing)
+	app.Get("/api/pairing/:id", h.PollPairing)
+
+	app.Get("/api/notifications/subscriptions", viewer, h.GetNotificationSubscriptions)
+	app.Post("/api/notifications/subscriptions", viewer, h.CreateNotificationSubscription)
+	app.Delete("/api/notifications/subscriptions/:id", viewer, h.DeleteNotificationSubscription)
 
-	app.Get("/api/streamers", h.GetStreamers)
-	app.Get("/api/streamers/:uid", h.GetStreamer)
+	app.Get("/api/streamers", viewer, h.GetStreamers)
+	app.Get("/api/streamers/:uid", viewer, h.GetStreamer)
+	app.Patch("/api/streamers/:uid/role", admin, h.SetStreamerRole)
 
-	app.Use("/api/ws", h.WebSocketAuth)
+	app.Use("/api/ws", viewerOrDevice, h.WebSocketAuth)
 	app.Get("/api/ws", h.WebSocketHandler())
 
 	log.Fatal(app.Listen(fmt.Sprintf(":%v", os.Getenv("PORT"))))
@@ -0,0 +1,11 @@
+/* Per stream arm schedules and manual overrides. Streams without a row are always armed. */
+
+CREATE TABLE arm_schedules (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    streamer UUID REFERENCES streamers(id) ON DELETE CASCADE,
+    stream_name VARCHAR(24) NOT NULL,
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    windows JSONB NOT NULL DEFAULT '[]',
+    override BOOLEAN DEFAULT NULL,
+    UNIQUE (streamer, stream_name)
+);
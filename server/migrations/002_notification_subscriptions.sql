@@ -0,0 +1,16 @@
+/* Subscriptions to motion and camera alerts */
+
+CREATE TABLE notification_subscriptions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    owner UUID REFERENCES streamers(id) ON DELETE CASCADE,
+    channel VARCHAR(16) NOT NULL,
+    target VARCHAR(512) NOT NULL,
+    stream_name VARCHAR(24) DEFAULT NULL,
+    streamer UUID REFERENCES streamers(id) ON DELETE CASCADE DEFAULT NULL,
+    events VARCHAR(32)[] NOT NULL DEFAULT '{MOTION_START,CAMERA_OFFLINE}',
+    quiet_start VARCHAR(5) DEFAULT NULL,
+    quiet_end VARCHAR(5) DEFAULT NULL,
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    min_interval INT NOT NULL DEFAULT 300,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,10 @@
+/* Outages recorded by the stream health monitor */
+
+CREATE TABLE stream_outages (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    streamer UUID REFERENCES streamers(id) ON DELETE CASCADE,
+    stream_name VARCHAR(24) NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ended_at TIMESTAMPTZ DEFAULT NULL
+);
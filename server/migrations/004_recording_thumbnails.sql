@@ -0,0 +1,3 @@
+/* Thumbnails for recordings, taken from the stream snapshots */
+
+ALTER TABLE vid_meta ADD COLUMN thumbnail BYTEA DEFAULT NULL;
@@ -0,0 +1,41 @@
+/* Links the streamers of an existing database to user accounts. Each streamer
+ gets a user with the same name and no password. An admin has to create an invite
+ with the user_id of the account before anyone can log in as that streamer again.
+ Since nobody has a password after running this, the next account to register
+ without an invite becomes the admin. Everyone had the same access with the shared
+ password, so every migrated account is a streamer. */
+
+CREATE TABLE users (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    username VARCHAR(24) NOT NULL,
+    password_hash VARCHAR(72) DEFAULT NULL,
+    role VARCHAR(16) NOT NULL DEFAULT 'streamer',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX users_username_idx ON users (LOWER(username));
+
+CREATE TABLE invites (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    code_hash VARCHAR(64) UNIQUE NOT NULL,
+    role VARCHAR(16) NOT NULL DEFAULT 'streamer',
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ DEFAULT NULL,
+    used_by UUID REFERENCES users(id) ON DELETE SET NULL
+);
+
+ALTER TABLE streamers ADD COLUMN user_id UUID UNIQUE REFERENCES users(id) ON DELETE CASCADE;
+
+/* streamer names were only unique case insensitively by convention, so suffix any duplicates */
+INSERT INTO users (id, username, role)
+SELECT id, CASE WHEN n = 1 THEN name ELSE LEFT(name, 20) || '-' || n END, 'streamer'
+FROM (
+    SELECT id, name, ROW_NUMBER() OVER (PARTITION BY LOWER(name) ORDER BY id) AS n FROM streamers
+) AS s;
+
+UPDATE streamers SET user_id = id;
+
+ALTER TABLE streamers ALTER COLUMN user_id SET NOT NULL;
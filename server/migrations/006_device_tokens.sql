@@ -0,0 +1,13 @@
+/* Long lived API tokens for headless cameras */
+
+CREATE TABLE device_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    label VARCHAR(48) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    streamer UUID NOT NULL REFERENCES streamers(id) ON DELETE CASCADE,
+    streams VARCHAR(24)[] NOT NULL DEFAULT '{}',
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ DEFAULT NULL,
+    revoked_at TIMESTAMPTZ DEFAULT NULL
+);
@@ -0,0 +1,14 @@
+/* Log of security relevant actions. There is no foreign key on the actor, so that the
+ log outlives the streamers in it. */
+
+CREATE TABLE audit_log (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    actor UUID DEFAULT NULL,
+    action VARCHAR(48) NOT NULL,
+    target VARCHAR(128) NOT NULL DEFAULT '',
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_log_created_at_idx ON audit_log(created_at);
@@ -0,0 +1,19 @@
+/* TOTP two factor authentication, recovery codes and server wide settings */
+
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) DEFAULT NULL;
+ALTER TABLE users ADD COLUMN totp_pending_secret VARCHAR(64) DEFAULT NULL;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMPTZ DEFAULT NULL
+);
+
+CREATE TABLE settings (
+    key VARCHAR(48) PRIMARY KEY,
+    value JSONB NOT NULL,
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,8 @@
+/* Keys for signing JWTs. The server creates the first key when it starts. */
+
+CREATE TABLE signing_keys (
+    id VARCHAR(16) PRIMARY KEY,
+    secret BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    retired_at TIMESTAMPTZ DEFAULT NULL
+);
@@ -0,0 +1,3 @@
+/* Links users to the subject from the OpenID Connect identity provider */
+
+ALTER TABLE users ADD COLUMN oidc_subject VARCHAR(255) UNIQUE DEFAULT NULL;
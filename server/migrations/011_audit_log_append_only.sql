@@ -0,0 +1,18 @@
+/* Makes the audit log append only. The actors current name is copied into the new
+ actor_name column before the trigger stops rows from being updated. */
+
+ALTER TABLE audit_log ADD COLUMN actor_name VARCHAR(24) NOT NULL DEFAULT '';
+
+UPDATE audit_log SET actor_name = streamers.name FROM streamers WHERE streamers.id = audit_log.actor;
+
+CREATE INDEX audit_log_actor_idx ON audit_log(actor, created_at);
+CREATE INDEX audit_log_action_idx ON audit_log(action, created_at);
+
+CREATE FUNCTION audit_log_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
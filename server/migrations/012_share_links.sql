@@ -0,0 +1,22 @@
+/* Share links for recordings. header_size is 0 for recordings made before this,
+ which can be shared whole but not clipped. */
+
+ALTER TABLE vid_meta ADD COLUMN header_size INT NOT NULL DEFAULT 0;
+
+CREATE TABLE share_links (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    vid_id UUID NOT NULL REFERENCES vid_meta(id) ON DELETE CASCADE,
+    start_seconds INT DEFAULT NULL,
+    end_seconds INT DEFAULT NULL,
+    max_downloads INT DEFAULT NULL,
+    downloads INT NOT NULL DEFAULT 0,
+    created_by UUID REFERENCES streamers(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ DEFAULT NULL
+);
+
+CREATE TABLE share_link_key (
+    id INT PRIMARY KEY CHECK (id = 1),
+    secret BYTEA NOT NULL
+);
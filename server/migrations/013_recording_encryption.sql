@@ -0,0 +1,5 @@
+/* Per recording data keys, encrypted by the master key. Existing recordings keep
+ NULL and are read as plaintext. */
+
+ALTER TABLE vid_meta ADD COLUMN data_key BYTEA DEFAULT NULL;
+ALTER TABLE vid_meta ADD COLUMN master_key_id VARCHAR(16) DEFAULT NULL;
@@ -0,0 +1,453 @@
+package armserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
+	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
+)
+
+/*
+Keeps track of the weekly arm schedules and manual overrides for each stream.
+A stream without a schedule is always armed. When a stream has a manual override
+the override takes precedence over the schedule, otherwise the stream is armed
+while the current time (in the schedules timezone) falls inside one of the windows.
+An empty list of windows means armed all week.
+*/
+
+type ArmServer struct {
+	Schedules Schedules
+
+	GetArmed    chan GetArmed
+	GetAllArmed chan GetAllArmed
+	GetSchedule chan GetSchedule
+	SetSchedule chan SetSchedule
+	SetOverride chan SetOverride
+}
+
+// ------ Mutex protected ------ //
+
+type Schedules struct {
+	// outer map key is streamer uid, inner map key is stream name
+	data map[string]map[string]Schedule
+	// the armed state last sent in ARM_STATE, keyed the same way
+	broadcast map[string]map[string]bool
+	mutex     sync.RWMutex
+}
+
+// ------ Channel structs ------ //
+
+type GetArmed struct {
+	Uid      string
+	Name     string
+	RecvChan chan bool
+}
+
+type GetAllArmed struct {
+	// outer map key is streamer uid, inner map key is stream name
+	RecvChan chan map[string]map[string]bool
+}
+
+type GetSchedule struct {
+	Uid      string
+	Name     string
+	RecvChan chan Schedule
+}
+
+type SetSchedule struct {
+	Uid       string
+	Name      string
+	Timezone  string
+	Windows   []Window
+	ErrorChan chan error
+}
+
+type SetOverride struct {
+	Uid  string
+	Name string
+	// nil clears the override so that the schedule is followed again
+	Armed     *bool
+	ErrorChan chan error
+}
+
+// ------ General structs ------ //
+
+// Returned by SetSchedule when the schedule is invalid. Any other error means it couldn't be saved.
+type InvalidScheduleError struct {
+	Msg string
+}
+
+func (e *InvalidScheduleError) Error() string {
+	return e.Msg
+}
+
+type Window struct {
+	Day   int    `json:"day"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type Schedule struct {
+	Timezone string   `json:"timezone"`
+	Windows  []Window `json:"windows"`
+	Override *bool    `json:"override"`
+	Armed    bool     `json:"armed"`
+}
+
+// ------ Initialization ------ //
+
+func Init(ss *socketServer.SocketServer, db *pgxpool.Pool) *ArmServer {
+	as := &ArmServer{
+		Schedules: Schedules{
+			data:      make(map[string]map[string]Schedule),
+			broadcast: make(map[string]map[string]bool),
+		},
+
+		GetArmed:    make(chan GetArmed),
+		GetAllArmed: make(chan GetAllArmed),
+		GetSchedule: make(chan GetSchedule),
+		SetSchedule: make(chan SetSchedule),
+		SetOverride: make(chan SetOverride),
+	}
+	loadSchedules(as, db)
+	runServer(as, ss, db)
+	return as
+}
+
+func runServer(as *ArmServer, ss *socketServer.SocketServer, db *pgxpool.Pool) {
+	go getArmed(as)
+	go getAllArmed(as)
+	go getSchedule(as)
+	go setSchedule(as, ss, db)
+	go setOverride(as, ss, db)
+	go watchForScheduleTransitions(as, ss)
+}
+
+func loadSchedules(as *ArmServer, db *pgxpool.Pool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	rows, err := db.Query(ctx, `
+		SELECT streamer,stream_name,timezone,windows,override FROM arm_schedules;
+	`)
+	if err != nil {
+		log.Fatalln("Failed to load arm schedules:", err)
+	}
+	defer rows.Close()
+
+	as.Schedules.mutex.Lock()
+	defer as.Schedules.mutex.Unlock()
+
+	for rows.Next() {
+		var uid, name, timezone string
+		var windowsBytes []byte
+		var override *bool
+		if err = rows.Scan(&uid, &name, &timezone, &windowsBytes, &override); err != nil {
+			log.Fatalln("Failed to scan arm schedule:", err)
+		}
+		windows := []Window{}
+		if err = json.Unmarshal(windowsBytes, &windows); err != nil {
+			log.Fatalln("Failed to decode arm schedule windows:", err)
+		}
+		if _, ok := as.Schedules.data[uid]; !ok {
+			as.Schedules.data[uid] = make(map[string]Schedule)
+		}
+		as.Schedules.data[uid][name] = Schedule{
+			Timezone: timezone,
+			Windows:  windows,
+			Override: override,
+		}
+	}
+}
+
+// ------ Loops ------ //
+
+func getArmed(as *ArmServer) {
+	for {
+		data := <-as.GetArmed
+
+		as.Schedules.mutex.RLock()
+
+		armed := true
+		if schedules, ok := as.Schedules.data[data.Uid]; ok {
+			if schedule, ok := schedules[data.Name]; ok {
+				armed = schedule.IsArmed(time.Now())
+			}
+		}
+
+		as.Schedules.mutex.RUnlock()
+
+		data.RecvChan <- armed
+	}
+}
+
+func getAllArmed(as *ArmServer) {
+	for {
+		data := <-as.GetAllArmed
+
+		as.Schedules.mutex.RLock()
+
+		now := time.Now()
+		out := make(map[string]map[string]bool)
+		for uid, schedules := range as.Schedules.data {
+			out[uid] = make(map[string]bool)
+			for name, schedule := range schedules {
+				out[uid][name] = schedule.IsArmed(now)
+			}
+		}
+
+		as.Schedules.mutex.RUnlock()
+
+		data.RecvChan <- out
+	}
+}
+
+func getSchedule(as *ArmServer) {
+	for {
+		data := <-as.GetSchedule
+
+		as.Schedules.mutex.RLock()
+
+		schedule := Schedule{
+			Timezone: "UTC",
+			Windows:  []Window{},
+		}
+		if schedules, ok := as.Schedules.data[data.Uid]; ok {
+			if s, ok := schedules[data.Name]; ok {
+				schedule = s
+			}
+		}
+		schedule.Armed = schedule.IsArmed(time.Now())
+
+		as.Schedules.mutex.RUnlock()
+
+		data.RecvChan <- schedule
+	}
+}
+
+func setSchedule(as *ArmServer, ss *socketServer.SocketServer, db *pgxpool.Pool) {
+	for {
+		data := <-as.SetSchedule
+
+		if err := validateSchedule(data.Timezone, data.Windows); err != nil {
+			data.ErrorChan <- err
+			continue
+		}
+
+		windowsBytes, err := json.Marshal(data.Windows)
+		if err != nil {
+			data.ErrorChan <- fmt.Errorf("Failed to encode windows")
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		if _, err = db.Exec(ctx, `
+			INSERT INTO arm_schedules (streamer,stream_name,timezone,windows) VALUES($1,$2,$3,$4)
+			ON CONFLICT (streamer,stream_name) DO UPDATE SET timezone = $3, windows = $4;
+		`, data.Uid, data.Name, data.Timezone, windowsBytes); err != nil {
+			cancel()
+			data.ErrorChan <- fmt.Errorf("Failed to save arm schedule")
+			continue
+		}
+		cancel()
+
+		as.Schedules.mutex.Lock()
+
+		if _, ok := as.Schedules.data[data.Uid]; !ok {
+			as.Schedules.data[data.Uid] = make(map[string]Schedule)
+		}
+		schedule := as.Schedules.data[data.Uid][data.Name]
+		wasArmed := schedule.IsArmed(time.Now())
+		schedule.Timezone = data.Timezone
+		schedule.Windows = data.Windows
+		as.Schedules.data[data.Uid][data.Name] = schedule
+		isArmed := schedule.IsArmed(time.Now())
+		changed := recordArmed(as, data.Uid, data.Name, wasArmed, isArmed)
+
+		as.Schedules.mutex.Unlock()
+
+		if changed {
+			sendArmState(ss, data.Uid, data.Name, isArmed)
+		}
+
+		data.ErrorChan <- nil
+	}
+}
+
+func setOverride(as *ArmServer, ss *socketServer.SocketServer, db *pgxpool.Pool) {
+	for {
+		data := <-as.SetOverride
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		if _, err := db.Exec(ctx, `
+			INSERT INTO arm_schedules (streamer,stream_name,override) VALUES($1,$2,$3)
+			ON CONFLICT (streamer,stream_name) DO UPDATE SET override = $3;
+		`, data.Uid, data.Name, data.Armed); err != nil {
+			cancel()
+			data.ErrorChan <- fmt.Errorf("Failed to save arm override")
+			continue
+		}
+		cancel()
+
+		as.Schedules.mutex.Lock()
+
+		if _, ok := as.Schedules.data[data.Uid]; !ok {
+			as.Schedules.data[data.Uid] = make(map[string]Schedule)
+		}
+		schedule, ok := as.Schedules.data[data.Uid][data.Name]
+		if !ok {
+			schedule = Schedule{
+				Timezone: "UTC",
+				Windows:  []Window{},
+			}
+		}
+		wasArmed := schedule.IsArmed(time.Now())
+		schedule.Override = data.Armed
+		as.Schedules.data[data.Uid][data.Name] = schedule
+		isArmed := schedule.IsArmed(time.Now())
+		changed := recordArmed(as, data.Uid, data.Name, wasArmed, isArmed)
+
+		as.Schedules.mutex.Unlock()
+
+		if changed {
+			sendArmState(ss, data.Uid, data.Name, isArmed)
+		}
+
+		data.ErrorChan <- nil
+	}
+}
+
+// schedules change state on their own as time passes, so check every
+// 30 seconds and let everyone know when a stream was armed or disarmed
+func watchForScheduleTransitions(as *ArmServer, ss *socketServer.SocketServer) {
+	for {
+		time.Sleep(time.Second * 30)
+
+		as.Schedules.mutex.Lock()
+
+		now := time.Now()
+		changed := []socketMessages.ArmState{}
+		for uid, schedules := range as.Schedules.data {
+			for name, schedule := range schedules {
+				armed := schedule.IsArmed(now)
+				// the first time a stream is seen there is nothing to compare against
+				if recordArmed(as, uid, name, armed, armed) {
+					changed = append(changed, socketMessages.ArmState{
+						StreamerID: uid,
+						Name:       name,
+						Armed:      armed,
+					})
+				}
+			}
+		}
+
+		as.Schedules.mutex.Unlock()
+
+		for _, state := range changed {
+			sendArmState(ss, state.StreamerID, state.Name, state.Armed)
+		}
+	}
+}
+
+// ------ Helper functions ------ //
+
+// Records the armed state that is about to be broadcast, and returns whether it is different
+// from the last one broadcast. wasArmed is used when nothing has been broadcast for the stream
+// yet. Must be called with the schedules mutex locked.
+func recordArmed(as *ArmServer, uid string, name string, wasArmed bool, isArmed bool) bool {
+	if _, ok := as.Schedules.broadcast[uid]; !ok {
+		as.Schedules.broadcast[uid] = make(map[string]bool)
+	}
+	if last, ok := as.Schedules.broadcast[uid][name]; ok {
+		wasArmed = last
+	}
+	as.Schedules.broadcast[uid][name] = isArmed
+	return wasArmed != isArmed
+}
+
+func sendArmState(ss *socketServer.SocketServer, uid string, name string, armed bool) {
+	ss.SendDataToAll <- socketServer.SendDataToAll{
+		Data: socketMessages.ArmState{
+			StreamerID: uid,
+			Name:       name,
+			Armed:      armed,
+		},
+		EventName: "ARM_STATE",
+	}
+}
+
+func validateSchedule(timezone string, windows []Window) error {
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return &InvalidScheduleError{Msg: "Unrecognized timezone"}
+	}
+	for _, w := range windows {
+		if w.Day < 0 || w.Day > 6 {
+			return &InvalidScheduleError{Msg: "Invalid window day"}
+		}
+		if _, err := parseClock(w.Start); err != nil {
+			return &InvalidScheduleError{Msg: "Invalid window start time"}
+		}
+		if _, err := parseClock(w.End); err != nil {
+			return &InvalidScheduleError{Msg: "Invalid window end time"}
+		}
+	}
+	return nil
+}
+
+// parses a "HH:MM" string into the number of minutes since midnight
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Windows where the end is before the start wrap around past midnight into the next day
+func (s Schedule) IsArmed(now time.Time) bool {
+	if s.Override != nil {
+		return *s.Override
+	}
+	if len(s.Windows) == 0 {
+		return true
+	}
+
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	day := int(local.Weekday())
+	minute := local.Hour()*60 + local.Minute()
+
+	for _, w := range s.Windows {
+		start, err := parseClock(w.Start)
+		if err != nil {
+			continue
+		}
+		end, err := parseClock(w.End)
+		if err != nil {
+			continue
+		}
+		if start < end {
+			if day == w.Day && minute >= start && minute < end {
+				return true
+			}
+		} else {
+			if day == w.Day && minute >= start {
+				return true
+			}
+			if day == (w.Day+1)%7 && minute < end {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Append only log of security relevant actions. Recording an entry never fails
+the action being recorded, errors are only logged.
+*/
+
+type Entry struct {
+	// streamer uid of whoever performed the action, empty for anonymous actions
+	ActorID string
+	Action  string
+	Target  string
+	IP      string
+	Details map[string]interface{}
+}
+
+const (
+	ActionPairingApproved = "PAIRING_APPROVED"
+	ActionLoginSucceeded  = "LOGIN_SUCCEEDED"
+	ActionLoginFailed     = "LOGIN_FAILED"
+	ActionLoginLockedOut  = "LOGIN_LOCKED_OUT"
+	ActionLockoutCleared  = "LOCKOUT_CLEARED"
+	ActionTwoFactorOn     = "TWO_FACTOR_ENABLED"
+	ActionTwoFactorOff    = "TWO_FACTOR_DISABLED"
+	ActionRecoveryCodes   = "RECOVERY_CODES_REGENERATED"
+	ActionSettingChanged  = "SETTING_CHANGED"
+	ActionRegistered      = "REGISTERED"
+	ActionLogout          = "LOGOUT"
+	ActionLogoutAll       = "LOGOUT_EVERYWHERE"
+	ActionSessionRevoked  = "SESSION_REVOKED"
+	ActionTokenReused     = "REFRESH_TOKEN_REUSED"
+	ActionPasswordChanged = "PASSWORD_CHANGED"
+	ActionRoleChanged     = "ROLE_CHANGED"
+	ActionInviteCreated   = "INVITE_CREATED"
+	ActionInviteDeleted   = "INVITE_DELETED"
+	ActionDeviceCreated   = "DEVICE_CREATED"
+	ActionDeviceRevoked   = "DEVICE_REVOKED"
+	ActionStreamDeleted   = "STREAM_DELETED"
+	ActionRecordingDown   = "RECORDING_DOWNLOADED"
+	ActionShareCreated    = "SHARE_LINK_CREATED"
+	ActionShareRevoked    = "SHARE_LINK_REVOKED"
+	ActionShareDownload   = "SHARE_LINK_DOWNLOADED"
+	ActionShareRefused    = "SHARE_LINK_REFUSED"
+)
+
+func Record(db *pgxpool.Pool, e Entry) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	var actor *string
+	if e.ActorID != "" {
+		actor = &e.ActorID
+	}
+	details, err := json.Marshal(e.Details)
+	if err != nil {
+		details = []byte("{}")
+	}
+
+	// the name is copied so that the entry still says who it was after the streamer is deleted
+	if _, err := db.Exec(ctx, `
+		INSERT INTO audit_log (actor,actor_name,action,target,ip,details)
+		VALUES($1,COALESCE((SELECT name FROM streamers WHERE id = $1),''),$2,$3,$4,$5);
+	`, actor, e.Action, e.Target, e.IP, details); err != nil {
+		log.Printf("Failed to record %v audit log entry: %v", e.Action, err)
+	}
+}
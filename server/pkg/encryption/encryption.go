@@ -0,0 +1,275 @@
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Envelope encryption for recordings. Every recording gets its own random data key,
+which is stored in vid_meta wrapped (encrypted) by the master key. Each chunk in
+vid_chunks is encrypted with AES-GCM under the data key, stored as the nonce followed
+by the ciphertext. The recording ID and chunk index are authenticated along with the
+chunk, so chunks can't be swapped around, and the recording ID and master key ID are
+authenticated along with the wrapped data key, so a data key can't be copied over to
+another recording.
+
+The master key is 32 bytes, base64 encoded, given in MASTER_KEY or in the file at
+MASTER_KEY_FILE. Encryption is disabled when neither is set. To rotate the master
+key, move the old key to MASTER_KEY_PREVIOUS (or MASTER_KEY_PREVIOUS_FILE), set the
+new one, and run the server with the rekey argument. Data keys wrapped by the previous
+key are still unwrapped until the rekey is done.
+
+Recordings made while encryption was disabled have no data key and stay in plaintext.
+*/
+
+type Vault struct {
+	// nil when encryption is disabled
+	current *masterKey
+	// key is the master key ID
+	masters map[string]*masterKey
+}
+
+type masterKey struct {
+	// first 8 bytes of the keys SHA256 hash, in hex
+	ID   string
+	aead cipher.AEAD
+}
+
+// Encrypts and decrypts the chunks of a single recording
+type Recording struct {
+	vidID string
+	// nil for plaintext recordings
+	aead cipher.AEAD
+}
+
+var ErrUnknownMasterKey = errors.New("Recording data key was wrapped by an unknown master key")
+
+const keySize = 32
+
+func Init() *Vault {
+	v := &Vault{masters: make(map[string]*masterKey)}
+
+	if key := loadKey("MASTER_KEY", "MASTER_KEY_FILE"); key != nil {
+		v.current = key
+		v.masters[key.ID] = key
+		log.Println("Encryption at rest enabled, master key", key.ID)
+	} else {
+		log.Println("No master key configured, recordings will not be encrypted")
+	}
+	if key := loadKey("MASTER_KEY_PREVIOUS", "MASTER_KEY_PREVIOUS_FILE"); key != nil {
+		v.masters[key.ID] = key
+	}
+
+	return v
+}
+
+// Creates a data key for a new recording, so the recording ID has to be known before the
+// row is inserted. Returns nils when encryption is disabled.
+func (v *Vault) NewRecordingKey(vidID string) (wrapped []byte, masterKeyID *string, err error) {
+	if v.current == nil {
+		return nil, nil, nil
+	}
+	key := make([]byte, keySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	if wrapped, err = seal(v.current.aead, key, keyAdditionalData(vidID, v.current.ID)); err != nil {
+		return nil, nil, err
+	}
+	return wrapped, &v.current.ID, nil
+}
+
+// Unwraps the data key of a recording. Recordings without a data key are passed through as plaintext.
+func (v *Vault) Recording(vidID string, wrapped []byte, masterKeyID *string) (*Recording, error) {
+	if wrapped == nil || masterKeyID == nil {
+		return &Recording{vidID: vidID}, nil
+	}
+	master, ok := v.masters[*masterKeyID]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+	key, err := open(master.aead, wrapped, keyAdditionalData(vidID, master.ID))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Recording{vidID: vidID, aead: aead}, nil
+}
+
+func (r *Recording) Seal(index int, chunk []byte) ([]byte, error) {
+	if r.aead == nil {
+		return chunk, nil
+	}
+	return seal(r.aead, chunk, r.additionalData(index))
+}
+
+func (r *Recording) Open(index int, stored []byte) ([]byte, error) {
+	if r.aead == nil {
+		return stored, nil
+	}
+	return open(r.aead, stored, r.additionalData(index))
+}
+
+func (r *Recording) additionalData(index int) []byte {
+	return []byte(r.vidID + ":" + strconv.Itoa(index))
+}
+
+func keyAdditionalData(vidID string, masterKeyID string) []byte {
+	return []byte("key:" + vidID + ":" + masterKeyID)
+}
+
+// Rewraps every data key that wasn't wrapped by the current master key. Only the data
+// keys are changed, the chunks are left as they are.
+func (v *Vault) Rekey(db *pgxpool.Pool) error {
+	if v.current == nil {
+		return fmt.Errorf("No master key configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+	defer cancel()
+
+	type wrappedKey struct {
+		vidID       string
+		wrapped     []byte
+		masterKeyID string
+	}
+	keys := []wrappedKey{}
+
+	rows, err := db.Query(ctx, `
+		SELECT id,data_key,master_key_id FROM vid_meta WHERE data_key IS NOT NULL AND master_key_id != $1;
+	`, v.current.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		k := wrappedKey{}
+		if err = rows.Scan(&k.vidID, &k.wrapped, &k.masterKeyID); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, k := range keys {
+		rewrapped, err := v.rewrap(k.vidID, k.wrapped, k.masterKeyID)
+		if err != nil {
+			log.Printf("Recording %v: failed to rewrap data key: %v", k.vidID, err)
+			failed++
+			continue
+		}
+		// the old master key ID is checked in case another rekey got there first
+		if _, err = db.Exec(ctx, `
+			UPDATE vid_meta SET data_key = $1, master_key_id = $2 WHERE id = $3 AND master_key_id = $4;
+		`, rewrapped, v.current.ID, k.vidID, k.masterKeyID); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Rekeyed %v recordings, %v failed", len(keys)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%v recordings could not be rekeyed", failed)
+	}
+	return nil
+}
+
+// ------ Helper functions ------ //
+
+// Unwraps the data key with the master key it was wrapped by, and wraps it with the current one
+func (v *Vault) rewrap(vidID string, wrapped []byte, masterKeyID string) ([]byte, error) {
+	master, ok := v.masters[masterKeyID]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+	key, err := open(master.aead, wrapped, keyAdditionalData(vidID, master.ID))
+	if err != nil {
+		return nil, err
+	}
+	return seal(v.current.aead, key, keyAdditionalData(vidID, v.current.ID))
+}
+
+// Reads the base64 encoded key from the environment variable, or from the file
+// named by the file variable. Exits if the key is invalid.
+func loadKey(envName string, fileEnvName string) *masterKey {
+	encoded := os.Getenv(envName)
+	if path := os.Getenv(fileEnvName); encoded == "" && path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read %v: %v", fileEnvName, err)
+		}
+		encoded = string(b)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != keySize {
+		log.Fatalf("%v must be %v bytes encoded as base64", envName, keySize)
+	}
+	master, err := newMasterKey(key)
+	if err != nil {
+		log.Fatalf("Failed to create cipher for %v: %v", envName, err)
+	}
+	return master
+}
+
+func newMasterKey(key []byte) (*masterKey, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(key)
+
+	return &masterKey{
+		ID:   hex.EncodeToString(hash[:8]),
+		aead: aead,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// the nonce is put in front of the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
@@ -0,0 +1,196 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testMasterKey(t *testing.T, fill byte) *masterKey {
+	t.Helper()
+	master, err := newMasterKey(bytes.Repeat([]byte{fill}, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master
+}
+
+func testVault(current *masterKey, others ...*masterKey) *Vault {
+	v := &Vault{current: current, masters: make(map[string]*masterKey)}
+	for _, m := range append(others, current) {
+		if m != nil {
+			v.masters[m.ID] = m
+		}
+	}
+	return v
+}
+
+func testRecording(t *testing.T, v *Vault, vidID string) *Recording {
+	t.Helper()
+	wrapped, masterKeyID, err := v.NewRecordingKey(vidID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := v.Recording(vidID, wrapped, masterKeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestSealOpen(t *testing.T) {
+	v := testVault(testMasterKey(t, 1))
+	rec := testRecording(t, v, "vid")
+
+	tests := []struct {
+		name  string
+		index int
+		chunk []byte
+	}{
+		{"first chunk", 0, []byte("webm header and a cluster")},
+		{"later chunk", 41, bytes.Repeat([]byte{0xab}, 4096)},
+		{"empty chunk", 2, []byte{}},
+	}
+
+	for _, tt := range tests {
+		sealed, err := rec.Seal(tt.index, tt.chunk)
+		if err != nil {
+			t.Fatalf("%v: Seal: %v", tt.name, err)
+		}
+		if len(tt.chunk) > 0 && bytes.Contains(sealed, tt.chunk) {
+			t.Errorf("%v: sealed chunk contains the plaintext", tt.name)
+		}
+		opened, err := rec.Open(tt.index, sealed)
+		if err != nil {
+			t.Fatalf("%v: Open: %v", tt.name, err)
+		}
+		if !bytes.Equal(opened, tt.chunk) {
+			t.Errorf("%v: opened %q, want %q", tt.name, opened, tt.chunk)
+		}
+	}
+}
+
+func TestOpenFails(t *testing.T) {
+	master := testMasterKey(t, 1)
+	v := testVault(master)
+	wrapped, masterKeyID, err := v.NewRecordingKey("vid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := v.Recording("vid", wrapped, masterKeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same data key, but opening chunks as if they belonged to another recording
+	otherVid := &Recording{vidID: "other vid", aead: rec.aead}
+
+	sealed, err := rec.Seal(3, []byte("chunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name   string
+		rec    *Recording
+		index  int
+		sealed []byte
+	}{
+		{"wrong index", rec, 4, sealed},
+		{"wrong recording", otherVid, 3, sealed},
+		{"tampered", rec, 3, tampered},
+		{"truncated tag", rec, 3, sealed[:len(sealed)-1]},
+		{"shorter than the nonce", rec, 3, sealed[:5]},
+		{"empty", rec, 3, nil},
+	}
+
+	for _, tt := range tests {
+		if _, err := tt.rec.Open(tt.index, tt.sealed); err == nil {
+			t.Errorf("%v: Open succeeded", tt.name)
+		}
+	}
+}
+
+func TestDataKeyBoundToRecording(t *testing.T) {
+	v := testVault(testMasterKey(t, 1))
+	wrapped, masterKeyID, err := v.NewRecordingKey("vid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := v.Recording("another vid", wrapped, masterKeyID); err == nil {
+		t.Error("data key copied to another recording was unwrapped")
+	}
+	unknown := "0000000000000000"
+	if _, err := v.Recording("vid", wrapped, &unknown); err != ErrUnknownMasterKey {
+		t.Errorf("unknown master key: got %v, want ErrUnknownMasterKey", err)
+	}
+}
+
+func TestPlaintextPassThrough(t *testing.T) {
+	disabled := testVault(nil)
+	wrapped, masterKeyID, err := disabled.NewRecordingKey("vid")
+	if err != nil || wrapped != nil || masterKeyID != nil {
+		t.Fatalf("NewRecordingKey with encryption disabled = %v, %v, %v", wrapped, masterKeyID, err)
+	}
+
+	// recordings made without a master key stay readable once one is configured
+	for name, v := range map[string]*Vault{"disabled": disabled, "enabled": testVault(testMasterKey(t, 1))} {
+		rec, err := v.Recording("vid", nil, nil)
+		if err != nil {
+			t.Fatalf("%v: Recording: %v", name, err)
+		}
+		chunk := []byte("plaintext chunk")
+		if sealed, err := rec.Seal(0, chunk); err != nil || !bytes.Equal(sealed, chunk) {
+			t.Errorf("%v: Seal = %q, %v", name, sealed, err)
+		}
+		if opened, err := rec.Open(0, chunk); err != nil || !bytes.Equal(opened, chunk) {
+			t.Errorf("%v: Open = %q, %v", name, opened, err)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	oldMaster := testMasterKey(t, 1)
+	newMaster := testMasterKey(t, 2)
+
+	before := testVault(oldMaster)
+	wrapped, masterKeyID, err := before.NewRecordingKey("vid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := before.Recording("vid", wrapped, masterKeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := rec.Seal(0, []byte("recorded before the rotation"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the old key is the previous key until the rekey is done
+	during := testVault(newMaster, oldMaster)
+	if _, err := during.Recording("vid", wrapped, masterKeyID); err != nil {
+		t.Fatalf("unwrapping with the previous master key: %v", err)
+	}
+	rewrapped, err := during.rewrap("vid", wrapped, *masterKeyID)
+	if err != nil {
+		t.Fatalf("rewrap: %v", err)
+	}
+	if _, err := during.rewrap("another vid", wrapped, *masterKeyID); err == nil {
+		t.Error("rewrapped a data key under another recordings ID")
+	}
+
+	// after the rekey the old key can be removed
+	after := testVault(newMaster)
+	rec, err = after.Recording("vid", rewrapped, &newMaster.ID)
+	if err != nil {
+		t.Fatalf("unwrapping the rewrapped key: %v", err)
+	}
+	if opened, err := rec.Open(0, sealed); err != nil || string(opened) != "recorded before the rotation" {
+		t.Errorf("opening a chunk after the rekey = %q, %v", opened, err)
+	}
+	if _, err := after.Recording("vid", wrapped, masterKeyID); err != ErrUnknownMasterKey {
+		t.Errorf("data key wrapped by the removed key: got %v, want ErrUnknownMasterKey", err)
+	}
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+type OutAuditEntry struct {
+	ID        string                 `json:"id"`
+	CreatedAt time.Time              `json:"created_at"`
+	Action    string                 `json:"action"`
+	ActorID   *string                `json:"actor"`
+	ActorName string                 `json:"actor_name"`
+	Target    string                 `json:"target"`
+	IP        string                 `json:"ip"`
+	Details   map[string]interface{} `json:"details"`
+}
+
+// Most recent entries first. Every query param is optional:
+//
+//	action - comma separated list of actions
+//	actor  - streamer uid of whoever performed the action
+//	target - exact target
+//	ip     - exact IP
+//	from   - RFC3339, inclusive
+//	to     - RFC3339, exclusive. To get the next page pass the created_at of the last entry.
+//	limit  - defaults to 100, at most 1000, or 100000 when exporting
+//	format - json or csv
+func (h handler) GetAuditLog(ctx *fiber.Ctx) error {
+	format := ctx.Query("format", "json")
+	if format != "json" && format != "csv" {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	maxLimit := 1000
+	if format == "csv" {
+		maxLimit = 100000
+	}
+	limit, err := strconv.Atoi(ctx.Query("limit", "100"))
+	if err != nil || limit < 1 {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid limit query param")
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	actions := []string{}
+	if raw := ctx.Query("action"); raw != "" {
+		for _, a := range strings.Split(raw, ",") {
+			if a = strings.ToUpper(strings.TrimSpace(a)); a != "" {
+				actions = append(actions, a)
+			}
+		}
+	}
+
+	var from, to *time.Time
+	if raw := ctx.Query("from"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid from query param")
+		}
+		from = &t
+	}
+	if raw := ctx.Query("to"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid to query param")
+		}
+		to = &t
+	}
+
+	// exports can take a while
+	timeout := time.Second * 8
+	if format == "csv" {
+		timeout = time.Second * 60
+	}
+	rctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rows, err := h.Pool.Query(rctx, `
+		SELECT id,created_at,action,actor,actor_name,target,ip,details FROM audit_log
+		WHERE (cardinality($1::text[]) = 0 OR action = ANY($1))
+		AND ($2 = '' OR actor::text = $2)
+		AND ($3 = '' OR target = $3)
+		AND ($4 = '' OR ip = $4)
+		AND ($5::timestamptz IS NULL OR created_at >= $5)
+		AND ($6::timestamptz IS NULL OR created_at < $6)
+		ORDER BY created_at DESC LIMIT $7;
+	`, actions, ctx.Query("actor"), ctx.Query("target"), ctx.Query("ip"), from, to, limit)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	defer rows.Close()
+
+	if format == "csv" {
+		return writeAuditCSV(ctx, rows)
+	}
+
+	entries := []OutAuditEntry{}
+	for rows.Next() {
+		e := OutAuditEntry{}
+		if err = rows.Scan(&e.ID, &e.CreatedAt, &e.Action, &e.ActorID, &e.ActorName, &e.Target, &e.IP, &e.Details); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		entries = append(entries, e)
+	}
+	if rows.Err() != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	if b, err := json.Marshal(entries); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// details are written as JSON in the last column
+func writeAuditCSV(ctx *fiber.Ctx, rows pgx.Rows) error {
+	ctx.Response().Header.SetContentType("text/csv")
+	ctx.Response().Header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-log-%v.csv"`, time.Now().UTC().Format("20060102-150405")))
+
+	w := csv.NewWriter(ctx)
+	w.Write([]string{"id", "created_at", "action", "actor", "actor_name", "target", "ip", "details"})
+
+	for rows.Next() {
+		var id, action, actorName, target, ip string
+		var actor *string
+		var createdAt time.Time
+		var details []byte
+		if err := rows.Scan(&id, &createdAt, &action, &actor, &actorName, &target, &ip, &details); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		actorID := ""
+		if actor != nil {
+			actorID = *actor
+		}
+		w.Write([]string{id, createdAt.UTC().Format(time.RFC3339), action, actorID, csvSafe(actorName), csvSafe(target), ip, string(details)})
+	}
+	if rows.Err() != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// usernames and stream names are chosen by users, stop spreadsheets from treating them as formulas
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -3,121 +3,155 @@ package handlers
 import (
 	"context"
 	"encoding/json"
-	"os"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
 	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
+	loginGuard "github.com/web-stuff-98/go-react-vid-streams/pkg/loginGuard"
 	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
 	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
 	"github.com/web-stuff-98/go-react-vid-streams/pkg/validation"
+	webRTCserver "github.com/web-stuff-98/go-react-vid-streams/pkg/webRTCserver"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func (h handler) StreamerLogin(ctx *fiber.Ctx) error {
+// Creates a user account along with the streamer that represents it. An invite
+// code from an admin is required, except for the very first account which becomes
+// the admin. If the invite was made for an existing account (a streamer from before
+// user accounts existed) then registering sets the password on that account instead.
+func (h handler) Register(ctx *fiber.Ctx) error {
 	v := validator.New()
-	body := &validation.StreamerLoginRegister{}
+	body := &validation.Register{}
 	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
 	}
 	if err := v.Struct(body); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
 	}
+	if !authHelpers.PasswordValidates(body.Password) {
+		return fiber.NewError(fiber.StatusBadRequest, "Password must be between 8 and 72 characters and contain at least 3 of lowercase, uppercase, numbers and symbols")
+	}
 
 	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
 	defer cancel()
 
-	conn, err := h.Pool.Acquire(rctx)
+	hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 	}
-	defer conn.Release()
 
-	stmt, err := conn.Conn().Prepare(rctx, "streamer_login_stmt", `
-	SELECT id FROM streamers WHERE LOWER(name) = LOWER($1);
-	`)
+	tx, err := h.Pool.Begin(rctx)
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 	}
+	defer tx.Rollback(rctx)
 
-	var id string
-	if err = conn.QueryRow(rctx, stmt.Name, strings.TrimSpace(body.Name)).Scan(&id); err != nil {
-		if err == pgx.ErrNoRows {
-			return fiber.NewError(fiber.StatusNotFound, "Not found")
-		} else {
-			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
-		}
+	// serialize registrations so that two people can't both become the first admin
+	if _, err = tx.Exec(rctx, `LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE;`); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 	}
 
-	if cookie, err := authHelpers.AuthorizeLogin(h.RedisClient, rctx, id); err != nil {
+	// accounts migrated from before user accounts existed don't count until they have been claimed
+	var usersExist bool
+	if err = tx.QueryRow(rctx, `
+		SELECT EXISTS(SELECT 1 FROM users WHERE password_hash IS NOT NULL OR oidc_subject IS NOT NULL);
+	`).Scan(&usersExist); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
-	} else {
-		ctx.Locals("uid", id)
-		ctx.Cookie(cookie)
-		ctx.Response().Header.Add("Content-Type", "application/json")
-		ctx.WriteString(id)
 	}
 
-	return nil
-}
-
-func (h handler) StreamerRegister(ctx *fiber.Ctx) error {
-	v := validator.New()
-	body := &validation.StreamerLoginRegister{}
-	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
-	}
-	if err := v.Struct(body); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	role := authHelpers.RoleAdmin
+	var inviteID string
+	var inviteUserID *string
+	if usersExist {
+		if body.InviteCode == "" {
+			return fiber.NewError(fiber.StatusForbidden, "An invite code is required")
+		}
+		if err = tx.QueryRow(rctx, `
+			SELECT id,role,user_id FROM invites WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW();
+		`, authHelpers.HashToken(body.InviteCode)).Scan(&inviteID, &role, &inviteUserID); err != nil {
+			if err != pgx.ErrNoRows {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			return fiber.NewError(fiber.StatusForbidden, "Invalid or expired invite code")
+		}
 	}
 
-	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
-	defer cancel()
-
-	conn, err := h.Pool.Acquire(rctx)
-	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
-	}
-	defer conn.Release()
+	var id, userID, name string
+	if inviteUserID != nil {
+		// claiming an existing account
+		if err = tx.QueryRow(rctx, `
+			UPDATE users SET password_hash = $1, role = $2 WHERE id = $3 RETURNING username;
+		`, string(hash), role, *inviteUserID).Scan(&name); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		userID = *inviteUserID
+		if err = tx.QueryRow(rctx, `
+			SELECT id FROM streamers WHERE user_id = $1;
+		`, userID).Scan(&id); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+	} else {
+		name = strings.TrimSpace(body.Username)
+		if len(name) < 2 {
+			return fiber.NewError(fiber.StatusBadRequest, "A username is required")
+		}
 
-	existsStmt, err := conn.Conn().Prepare(rctx, "register_exists_stmt", `
-	SELECT EXISTS(SELECT 1 FROM streamers WHERE LOWER(name) = LOWER($1));
-	`)
-	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
-	}
+		exists := false
+		if err = tx.QueryRow(rctx, `
+			SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(username) = LOWER($1));
+		`, name).Scan(&exists); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		if exists {
+			return fiber.NewError(fiber.StatusBadRequest, "There is already another user with that name")
+		}
 
-	exists := false
-	if err := conn.QueryRow(rctx, existsStmt.Name, strings.TrimSpace(body.Name)).Scan(&exists); err != nil {
-		if err != pgx.ErrNoRows {
+		if err = tx.QueryRow(rctx, `
+			INSERT INTO users (username,password_hash,role) VALUES($1,$2,$3) RETURNING id;
+		`, name, string(hash), role).Scan(&userID); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		if err = tx.QueryRow(rctx, `
+			INSERT INTO streamers (name,user_id) VALUES($1,$2) RETURNING id;
+		`, name, userID).Scan(&id); err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 		}
 	}
-	if exists {
-		return fiber.NewError(fiber.StatusBadRequest, "There is already another streamer with that name")
-	}
-
-	var id string
 
-	insertStmt, err := conn.Conn().Prepare(rctx, "register_streamer_insert_stmt", `
-		INSERT INTO streamers (name) VALUES ($1) RETURNING id;
-	`)
-	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	if inviteID != "" {
+		if _, err = tx.Exec(rctx, `
+			UPDATE invites SET used_at = NOW(), used_by = $1 WHERE id = $2;
+		`, userID, inviteID); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
 	}
 
-	if err := conn.QueryRow(rctx, insertStmt.Name, body.Name).Scan(&id); err != nil {
+	if err = tx.Commit(rctx); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 	}
 
-	if cookie, err := authHelpers.AuthorizeLogin(h.RedisClient, rctx, id); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
-	} else {
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: id,
+		Action:  audit.ActionRegistered,
+		Target:  name,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{
+			"role":    role,
+			"claimed": inviteUserID != nil,
+		},
+	})
+
+	if inviteUserID == nil {
 		outData := make(map[string]interface{})
-		outData["name"] = body.Name
+		outData["name"] = name
 		outData["id"] = id
 
 		h.SocketServer.SendDataToAll <- socketServer.SendDataToAll{
@@ -128,34 +162,92 @@ func (h handler) StreamerRegister(ctx *fiber.Ctx) error {
 			},
 			EventName: "CHANGE",
 		}
+	}
 
-		ctx.Locals("uid", id)
+	if cookies, err := authHelpers.AuthorizeLogin(h.SessionStore, h.KeyRing, rctx, id, authHelpers.GetClient(ctx, body.DeviceLabel)); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
 		ctx.Response().Header.Add("Content-Type", "text/plain")
-		ctx.Cookie(cookie)
+		for _, cookie := range cookies {
+			ctx.Cookie(cookie)
+		}
 		ctx.WriteString(id)
 	}
 
 	return nil
 }
 
-func (h handler) StreamerLogout(ctx *fiber.Ctx) error {
-	ctx.Locals("uid", nil)
+// Ends the current session. If the session has a websocket connection it is closed,
+// which takes the streamer out of WebRTC, and everyone is told their streams went offline.
+func (h handler) Logout(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+	sid := ctx.Locals("sid").(string)
+
+	for _, cookie := range authHelpers.GetClearedCookies() {
+		ctx.Cookie(cookie)
+	}
+
+	// only the connections of this session leave, the user could still be streaming from another device
+	for _, c := range h.sessionConns(sid) {
+		h.WebRTCServer.LeaveWebRTC <- webRTCserver.LeaveWebRTC{
+			ConnID:    c.ID,
+			Uid:       uid,
+			LoggedOut: true,
+		}
+	}
+
+	if err := h.revokeSession(rctx, sid); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionLogout,
+		Target:  sid,
+		IP:      ctx.IP(),
+	})
+
 	return nil
 }
 
-func (h handler) ServerLogout(ctx *fiber.Ctx) error {
+// Ends every session belonging to the user, including the current one
+func (h handler) LogoutEverywhere(ctx *fiber.Ctx) error {
 	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
 	defer cancel()
 
-	if _, sid, err := authHelpers.GetUidAndSid(h.RedisClient, ctx, rctx, h.Pool); err != nil {
-		ctx.Cookie(authHelpers.GetClearedCookie())
-		return fiber.NewError(fiber.StatusForbidden, "You are not logged in")
-	} else {
-		authHelpers.DeleteSession(h.RedisClient, rctx, sid)
-		ctx.Cookie(authHelpers.GetClearedCookie())
+	uid := ctx.Locals("uid").(string)
+
+	for _, cookie := range authHelpers.GetClearedCookies() {
+		ctx.Cookie(cookie)
+	}
+
+	sessions, err := h.SessionStore.List(rctx, uid)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 	}
 
-	ctx.Locals("uid", nil)
+	h.WebRTCServer.LeaveWebRTC <- webRTCserver.LeaveWebRTC{
+		Uid:       uid,
+		LoggedOut: true,
+	}
+
+	if err = h.SessionStore.DeleteAll(rctx, uid); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	for _, s := range sessions {
+		h.closeSessionConns(s.Sid)
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionLogoutAll,
+		Target:  uid,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{"sessions": len(sessions)},
+	})
 
 	return nil
 }
@@ -164,17 +256,29 @@ func (h handler) Refresh(ctx *fiber.Ctx) error {
 	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
 	defer cancel()
 
-	if cookie, err := authHelpers.RefreshToken(h.RedisClient, ctx, rctx, h.Pool); err != nil {
-		return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized. Your session most likely expired.")
-	} else {
+	cookies, sid, err := authHelpers.RefreshToken(h.SessionStore, h.KeyRing, ctx, rctx)
+	for _, cookie := range cookies {
 		ctx.Cookie(cookie)
 	}
+	if err != nil {
+		if err == authHelpers.ErrRefreshTokenReused {
+			// also closes the sockets opened with the session, which might be the attackers
+			if err = h.revokeSession(rctx, sid); err != nil {
+				log.Println("Failed to revoke session after refresh token reuse:", err)
+			}
+			log.Printf("Refresh token reused from %v, session revoked", ctx.IP())
+			audit.Record(h.Pool, audit.Entry{
+				Action: audit.ActionTokenReused,
+				IP:     ctx.IP(),
+			})
+		}
+		return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized. Your session most likely expired.")
+	}
 
 	return nil
 }
 
-// if the streamer name provided for the initial login doesn't exist,
-// then the streamer will be created.
+// Logs in with a username and password. The response is the uid of the users streamer.
 func (h handler) InitialLogin(ctx *fiber.Ctx) error {
 	v := validator.New()
 	body := &validation.InitialLogin{}
@@ -188,70 +292,165 @@ func (h handler) InitialLogin(ctx *fiber.Ctx) error {
 	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
 	defer cancel()
 
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		if err := bcrypt.CompareHashAndPassword([]byte(os.Getenv("SERVER_PASSWORD_HASH")), []byte(body.ServerPassword)); err != nil {
-			if err == bcrypt.ErrMismatchedHashAndPassword {
-				return fiber.NewError(fiber.StatusUnauthorized, "Invalid credentials")
-			} else {
-				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
-			}
-		}
-	} else {
-		if body.ServerPassword != os.Getenv("SERVER_PASSWORD_HASH") {
-			return fiber.NewError(fiber.StatusUnauthorized, "Invalid credentials")
-		}
-	}
+	username := strings.TrimSpace(body.Username)
+	ip := ctx.IP()
 
-	conn, err := h.Pool.Acquire(rctx)
-	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	if wait := h.checkLoginAttempt(username, ip); wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+		return fiber.NewError(fiber.StatusTooManyRequests, fmt.Sprintf("Too many failed login attempts, try again in %v seconds", seconds))
 	}
-	defer conn.Release()
 
 	var id string
-	if selectStreamerStmt, err := conn.Conn().Prepare(rctx, "initial_login_select_streamer_stmt", `
-		SELECT id FROM streamers WHERE LOWER(name) = LOWER($1);
-	`); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
-	} else {
-		if err = conn.Conn().QueryRow(rctx, selectStreamerStmt.Name, body.StreamerName).Scan(&id); err != nil {
-			if err != pgx.ErrNoRows {
-				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
-			}
+	var hash *string
+	var twoFactor bool
+	if err := h.Pool.QueryRow(rctx, `
+		SELECT streamers.id,users.password_hash,users.totp_secret IS NOT NULL FROM users
+		INNER JOIN streamers ON streamers.user_id = users.id
+		WHERE LOWER(users.username) = LOWER($1);
+	`, username).Scan(&id, &hash, &twoFactor); err != nil {
+		if err != pgx.ErrNoRows {
+			h.loginAttemptResult(username, ip, loginGuard.OutcomeAborted)
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+	}
+
+	// compare against a dummy hash when the user doesn't exist or hasn't set a password yet,
+	// so that the response time doesn't reveal which usernames exist
+	compareHash := authHelpers.DummyPasswordHash
+	if hash != nil {
+		compareHash = *hash
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(compareHash), []byte(body.Password)); err != nil || hash == nil {
+		if err != nil && err != bcrypt.ErrMismatchedHashAndPassword {
+			h.loginAttemptResult(username, ip, loginGuard.OutcomeAborted)
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 		}
+		h.loginFailed(username, ip, "")
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid credentials")
 	}
 
-	// if id is empty that means a streamer by the name provided was not found, so it must be created
-	if id == "" {
-		if createStreamerStmt, err := conn.Conn().Prepare(rctx, "initial_login_create_streamer_stmt", `
-			INSERT INTO streamers (name) VALUES($1) RETURNING id;
-		`); err != nil {
+	// Accounts with two factor authentication get a challenge to complete with LoginTwoFactor.
+	// The failed attempts on the account aren't reset until then, otherwise someone with the
+	// password could keep resetting them while guessing codes.
+	if twoFactor {
+		h.loginAttemptResult(username, ip, loginGuard.OutcomeAborted)
+		challenge, err := authHelpers.CreateLoginChallenge(h.KeyRing, id)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		if b, err := json.Marshal(map[string]string{
+			"challenge": challenge,
+		}); err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 		} else {
-			if err = conn.Conn().QueryRow(rctx, createStreamerStmt.Name, body.StreamerName).Scan(&id); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
-			}
+			ctx.Status(fiber.StatusAccepted)
+			ctx.Response().Header.Add("Content-Type", "application/json")
+			ctx.Write(b)
 		}
+		return nil
+	}
 
-		outData := make(map[string]interface{})
-		outData["name"] = body.StreamerName
-		outData["id"] = id
+	return h.completeLogin(ctx, rctx, id, username, body.DeviceLabel)
+}
 
-		h.SocketServer.SendDataToAll <- socketServer.SendDataToAll{
-			Data: socketMessages.ChangeData{
-				Entity: "STREAMER",
-				Method: "INSERT",
-				Data:   outData,
-			},
-			EventName: "CHANGE",
+// The second step of logging in to an account with two factor authentication. Accepts a
+// code from the authenticator app, or one of the recovery codes.
+func (h handler) LoginTwoFactor(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.LoginTwoFactor{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	id, err := authHelpers.ParseLoginChallenge(h.KeyRing, body.Challenge)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "Your login expired, log in again")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	var username string
+	var secret *string
+	var lastStep int64
+	if err := h.Pool.QueryRow(rctx, `
+		SELECT users.username,users.totp_secret,users.totp_last_step FROM users
+		INNER JOIN streamers ON streamers.user_id = users.id
+		WHERE streamers.id = $1;
+	`, id).Scan(&username, &secret, &lastStep); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 		}
+		return fiber.NewError(fiber.StatusUnauthorized, "Your login expired, log in again")
+	}
+	if secret == nil {
+		// two factor authentication was disabled in between the steps
+		return fiber.NewError(fiber.StatusUnauthorized, "Your login expired, log in again")
+	}
+
+	ip := ctx.IP()
+
+	if wait := h.checkLoginAttempt(username, ip); wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+		return fiber.NewError(fiber.StatusTooManyRequests, fmt.Sprintf("Too many failed login attempts, try again in %v seconds", seconds))
+	}
+
+	ok, err := h.checkTwoFactorCode(rctx, id, *secret, lastStep, body.Code)
+	if err != nil {
+		h.loginAttemptResult(username, ip, loginGuard.OutcomeAborted)
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 	}
+	if !ok {
+		h.loginFailed(username, ip, id)
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid code")
+	}
+
+	return h.completeLogin(ctx, rctx, id, username, body.DeviceLabel)
+}
+
+// Records the failure, and the lockout if the failure caused one. The uid is empty
+// when the failure was a wrong password, since the account might not exist.
+func (h handler) loginFailed(username string, ip string, uid string) {
+	lockedOut := h.loginAttemptResult(username, ip, loginGuard.OutcomeFailure)
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionLoginFailed,
+		Target:  username,
+		IP:      ip,
+	})
+	if lockedOut {
+		audit.Record(h.Pool, audit.Entry{
+			Action: audit.ActionLoginLockedOut,
+			Target: username,
+			IP:     ip,
+		})
+	}
+}
+
+// Creates the session once every step of logging in has passed. The response is the uid.
+func (h handler) completeLogin(ctx *fiber.Ctx, rctx context.Context, id string, username string, deviceLabel string) error {
+	ip := ctx.IP()
+
+	h.loginAttemptResult(username, ip, loginGuard.OutcomeSuccess)
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: id,
+		Action:  audit.ActionLoginSucceeded,
+		Target:  username,
+		IP:      ip,
+	})
 
-	if cookie, err := authHelpers.AuthorizeLogin(h.RedisClient, rctx, id); err != nil {
+	if cookies, err := authHelpers.AuthorizeLogin(h.SessionStore, h.KeyRing, rctx, id, authHelpers.GetClient(ctx, deviceLabel)); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 	} else {
 		ctx.Response().Header.Add("Content-Type", "text/plain")
-		ctx.Cookie(cookie)
+		for _, cookie := range cookies {
+			ctx.Cookie(cookie)
+		}
 		ctx.WriteString(id)
 	}
 
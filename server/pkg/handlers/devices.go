@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
+	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/validation"
+)
+
+type OutDevice struct {
+	ID         string     `json:"id"`
+	Label      string     `json:"label"`
+	StreamerID string     `json:"streamer_id"`
+	Streams    []string   `json:"streams"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type OutCreatedDevice struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+func (h handler) GetDevices(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	devices := []OutDevice{}
+
+	if rows, err := h.Pool.Query(rctx, `
+		SELECT id,label,streamer,streams,created_at,last_used_at,revoked_at FROM device_tokens ORDER BY created_at DESC;
+	`); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			d := OutDevice{}
+			if err = rows.Scan(&d.ID, &d.Label, &d.StreamerID, &d.Streams, &d.CreatedAt, &d.LastUsedAt, &d.RevokedAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			devices = append(devices, d)
+		}
+	}
+
+	if b, err := json.Marshal(devices); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// The token is only returned once, only its hash is stored
+func (h handler) CreateDevice(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.CreateDevice{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	out, err := h.issueDevice(rctx, body.Label, body.StreamerID, body.Streams, ctx.Locals("uid").(string))
+	if err != nil {
+		return err
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: ctx.Locals("uid").(string),
+		Action:  audit.ActionDeviceCreated,
+		Target:  out.ID,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{"label": body.Label, "streamer": body.StreamerID, "streams": body.Streams},
+	})
+
+	if b, err := json.Marshal(out); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+func (h handler) RevokeDevice(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	var id string
+	if err := h.Pool.QueryRow(rctx, `
+		UPDATE device_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL RETURNING id;
+	`, ctx.Params("id")).Scan(&id); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return fiber.NewError(fiber.StatusNotFound, "Not found")
+	}
+
+	// the device stops publishing straight away rather than when it next reconnects
+	h.closeDeviceConns(id)
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: ctx.Locals("uid").(string),
+		Action:  audit.ActionDeviceRevoked,
+		Target:  id,
+		IP:      ctx.IP(),
+	})
+
+	return nil
+}
+
+// Creates a device token for the streamer, used by CreateDevice and ApprovePairing.
+// The error returned is a fiber error.
+func (h handler) issueDevice(rctx context.Context, label, streamerID string, streams []string, createdBy string) (OutCreatedDevice, error) {
+	out := OutCreatedDevice{}
+
+	role, err := authHelpers.GetRole(rctx, h.Pool, streamerID)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			return out, fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return out, fiber.NewError(fiber.StatusNotFound, "Streamer not found")
+	}
+	if !authHelpers.HasRole(role, authHelpers.RoleStreamer) {
+		return out, fiber.NewError(fiber.StatusBadRequest, "Devices can only be issued for streamers")
+	}
+
+	out.Token = "dev_" + authHelpers.GenerateToken()
+
+	if err := h.Pool.QueryRow(rctx, `
+		INSERT INTO device_tokens (label,token_hash,streamer,streams,created_by)
+		VALUES($1,$2,$3,$4,(SELECT user_id FROM streamers WHERE id = $5)) RETURNING id;
+	`, label, authHelpers.HashToken(out.Token), streamerID, streams, createdBy).Scan(&out.ID); err != nil {
+		return out, fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	return out, nil
+}
+
+// Unregistering the connections also removes the device from WebRTC
+func (h handler) closeDeviceConns(deviceID string) {
+	recvChan := make(chan []socketServer.ConnectionData, 1)
+	h.SocketServer.GetDeviceConns <- socketServer.GetDeviceConns{
+		DeviceID: deviceID,
+		RecvChan: recvChan,
+	}
+	conns := <-recvChan
+
+	close(recvChan)
+
+	for _, c := range conns {
+		h.SocketServer.UnregisterConn <- c.Conn
+		c.Conn.Close()
+	}
+}
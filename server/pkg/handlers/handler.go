@@ -2,32 +2,69 @@ package handlers
 
 import (
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/redis/go-redis/v9"
+	armserver "github.com/web-stuff-98/go-react-vid-streams/pkg/armServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/encryption"
+	healthmonitor "github.com/web-stuff-98/go-react-vid-streams/pkg/healthMonitor"
+	keyring "github.com/web-stuff-98/go-react-vid-streams/pkg/keyRing"
+	loginguard "github.com/web-stuff-98/go-react-vid-streams/pkg/loginGuard"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/notifier"
+	pairingserver "github.com/web-stuff-98/go-react-vid-streams/pkg/pairingServer"
+	sessionstore "github.com/web-stuff-98/go-react-vid-streams/pkg/sessionStore"
+	sharelinks "github.com/web-stuff-98/go-react-vid-streams/pkg/shareLinks"
 	socketserver "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/sso"
 	videoserver "github.com/web-stuff-98/go-react-vid-streams/pkg/videoServer"
 	webRTCserver "github.com/web-stuff-98/go-react-vid-streams/pkg/webRTCserver"
 )
 
 type handler struct {
-	VideoServer  *videoserver.VideoServer
-	Pool         *pgxpool.Pool
-	RedisClient  *redis.Client
-	SocketServer *socketserver.SocketServer
-	WebRTCServer *webRTCserver.WebRTCServer
+	VideoServer   *videoserver.VideoServer
+	Pool          *pgxpool.Pool
+	SessionStore  sessionstore.SessionStore
+	SocketServer  *socketserver.SocketServer
+	WebRTCServer  *webRTCserver.WebRTCServer
+	ArmServer     *armserver.ArmServer
+	Notifier      *notifier.Notifier
+	HealthMonitor *healthmonitor.HealthMonitor
+	PairingServer *pairingserver.PairingServer
+	LoginGuard    *loginguard.LoginGuard
+	KeyRing       *keyring.KeyRing
+	ShareLinks    *sharelinks.Signer
+	Vault         *encryption.Vault
+	// nil when single sign-on isn't configured
+	SSO *sso.SSO
 }
 
 func New(
 	vs *videoserver.VideoServer,
 	db *pgxpool.Pool,
-	rd *redis.Client,
+	store sessionstore.SessionStore,
 	ss *socketserver.SocketServer,
 	rtc *webRTCserver.WebRTCServer,
+	as *armserver.ArmServer,
+	n *notifier.Notifier,
+	hm *healthmonitor.HealthMonitor,
+	ps *pairingserver.PairingServer,
+	lg *loginguard.LoginGuard,
+	kr *keyring.KeyRing,
+	sl *sharelinks.Signer,
+	vault *encryption.Vault,
+	s *sso.SSO,
 ) handler {
 	return handler{
-		VideoServer:  vs,
-		Pool:         db,
-		RedisClient:  rd,
-		SocketServer: ss,
-		WebRTCServer: rtc,
+		VideoServer:   vs,
+		Pool:          db,
+		SessionStore:  store,
+		SocketServer:  ss,
+		WebRTCServer:  rtc,
+		ArmServer:     as,
+		Notifier:      n,
+		HealthMonitor: hm,
+		PairingServer: ps,
+		LoginGuard:    lg,
+		KeyRing:       kr,
+		ShareLinks:    sl,
+		Vault:         vault,
+		SSO:           s,
 	}
 }
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	healthMonitor "github.com/web-stuff-98/go-react-vid-streams/pkg/healthMonitor"
+	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
+)
+
+type OutStreamOutage struct {
+	ID         string     `json:"id"`
+	StreamerID string     `json:"streamer_id"`
+	StreamName string     `json:"stream_name"`
+	Kind       string     `json:"kind"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at"`
+}
+
+func (h handler) GetStreamsHealth(ctx *fiber.Ctx) error {
+	recvChan := make(chan []socketMessages.StreamHealth, 1)
+	h.HealthMonitor.GetHealth <- healthMonitor.GetHealth{
+		RecvChan: recvChan,
+	}
+	health := <-recvChan
+
+	close(recvChan)
+
+	if b, err := json.Marshal(health); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// most recent outages first. The optional name query param limits the outages to a single stream
+func (h handler) GetStreamOutages(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	name := ctx.Query("name", "")
+
+	outages := []OutStreamOutage{}
+
+	if rows, err := h.Pool.Query(rctx, `
+		SELECT id,streamer,stream_name,kind,started_at,ended_at FROM stream_outages
+		WHERE ($1 = '' OR LOWER(stream_name) = LOWER($1))
+		ORDER BY started_at DESC LIMIT 500;
+	`, name); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			o := OutStreamOutage{}
+			if err = rows.Scan(&o.ID, &o.StreamerID, &o.StreamName, &o.Kind, &o.StartedAt, &o.EndedAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			outages = append(outages, o)
+		}
+	}
+
+	if b, err := json.Marshal(outages); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	loginGuard "github.com/web-stuff-98/go-react-vid-streams/pkg/loginGuard"
+)
+
+func (h handler) GetLockouts(ctx *fiber.Ctx) error {
+	recvChan := make(chan []loginGuard.Lockout, 1)
+	h.LoginGuard.GetLockouts <- loginGuard.GetLockouts{
+		RecvChan: recvChan,
+	}
+	lockouts := <-recvChan
+
+	close(recvChan)
+
+	if b, err := json.Marshal(lockouts); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// Takes the kind (IP or ACCOUNT) and value from the query params, since IPv6
+// addresses don't fit nicely in a path
+func (h handler) ClearLockout(ctx *fiber.Ctx) error {
+	kind := ctx.Query("kind")
+	value := ctx.Query("value")
+	if (kind != loginGuard.KindIP && kind != loginGuard.KindAccount) || value == "" || len(value) > 64 {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	recvChan := make(chan bool, 1)
+	h.LoginGuard.ClearLockout <- loginGuard.ClearLockout{
+		Kind:     kind,
+		Value:    value,
+		RecvChan: recvChan,
+	}
+	found := <-recvChan
+
+	close(recvChan)
+
+	if !found {
+		return fiber.NewError(fiber.StatusNotFound, "Not found")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: ctx.Locals("uid").(string),
+		Action:  audit.ActionLockoutCleared,
+		Target:  kind + ":" + value,
+		IP:      ctx.IP(),
+	})
+
+	return nil
+}
+
+func (h handler) checkLoginAttempt(username string, ip string) time.Duration {
+	recvChan := make(chan time.Duration, 1)
+	h.LoginGuard.Check <- loginGuard.Check{
+		Username: username,
+		IP:       ip,
+		RecvChan: recvChan,
+	}
+	wait := <-recvChan
+
+	close(recvChan)
+
+	return wait
+}
+
+// Returns true if the IP or account got locked out
+func (h handler) loginAttemptResult(username string, ip string, outcome string) bool {
+	recvChan := make(chan bool, 1)
+	h.LoginGuard.Result <- loginGuard.Result{
+		Username: username,
+		IP:       ip,
+		Outcome:  outcome,
+		RecvChan: recvChan,
+	}
+	lockedOut := <-recvChan
+
+	close(recvChan)
+
+	return lockedOut
+}
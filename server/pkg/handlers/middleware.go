@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
+)
+
+// Authenticates the session and checks that the user has at least the required role.
+// The uid, sid and role are stored in fiber locals for the handlers that follow.
+func (h handler) RequireRole(required string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+		defer cancel()
+
+		uid, sid, err := authHelpers.GetUidAndSid(h.SessionStore, h.KeyRing, ctx, rctx)
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+		}
+
+		role, err := authHelpers.GetRole(rctx, h.Pool, uid)
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+		}
+
+		if !authHelpers.HasRole(role, required) {
+			return fiber.NewError(fiber.StatusForbidden, "You do not have permission to do that")
+		}
+
+		ctx.Locals("uid", uid)
+		ctx.Locals("sid", sid)
+		ctx.Locals("role", role)
+
+		return ctx.Next()
+	}
+}
+
+// Same as RequireRole, but also accepts a device token in place of a session. Devices
+// act as the streamer they were issued for, and can only publish to the streams in
+// their scope. The device is stored in the device local.
+func (h handler) RequireRoleOrDevice(required string) fiber.Handler {
+	requireRole := h.RequireRole(required)
+
+	return func(ctx *fiber.Ctx) error {
+		token := authHelpers.GetDeviceToken(ctx)
+		if token == "" {
+			return requireRole(ctx)
+		}
+
+		rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+		defer cancel()
+
+		device, err := authHelpers.GetDevice(rctx, h.Pool, token)
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+		}
+
+		// devices can never have more permissions than the streamer they publish as
+		role, err := authHelpers.GetRole(rctx, h.Pool, device.Uid)
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+		}
+		if authHelpers.HasRole(role, authHelpers.RoleStreamer) {
+			role = authHelpers.RoleStreamer
+		}
+
+		if !authHelpers.HasRole(role, required) {
+			return fiber.NewError(fiber.StatusForbidden, "You do not have permission to do that")
+		}
+
+		ctx.Locals("uid", device.Uid)
+		ctx.Locals("sid", "")
+		ctx.Locals("role", role)
+		ctx.Locals("device", device)
+
+		return ctx.Next()
+	}
+}
+
+// Sessions can publish to any of the streamers streams, devices only to the streams in their
+// scope. Takes the value of the device local, from either a fiber context or a websocket connection.
+func canPublish(device interface{}, name string) bool {
+	if d, ok := device.(*authHelpers.Device); ok {
+		return d.CanPublish(name)
+	}
+	return true
+}
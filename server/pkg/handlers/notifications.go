@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/notifier"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/validation"
+)
+
+func (h handler) GetNotificationSubscriptions(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	subscriptions := []notifier.Subscription{}
+
+	if rows, err := h.Pool.Query(rctx, `
+		SELECT id,channel,target,stream_name,streamer,events,quiet_start,quiet_end,timezone,min_interval
+		FROM notification_subscriptions WHERE owner = $1 ORDER BY created_at;
+	`, uid); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			s := notifier.Subscription{}
+			if err = rows.Scan(&s.ID, &s.Channel, &s.Target, &s.StreamName, &s.Streamer, &s.Events, &s.QuietStart, &s.QuietEnd, &s.Timezone, &s.MinInterval); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			subscriptions = append(subscriptions, s)
+		}
+	}
+
+	if b, err := json.Marshal(subscriptions); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+func (h handler) CreateNotificationSubscription(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	v := validator.New()
+	body := &validation.NotificationSubscription{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	if body.Channel == notifier.ChannelEmail {
+		if _, err := mail.ParseAddress(body.Target); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid email address")
+		}
+	} else {
+		// the server makes the request, so only admins can point it at a URL. Otherwise anyone
+		// could use it to reach addresses on the servers network.
+		if !authHelpers.HasRole(ctx.Locals("role").(string), authHelpers.RoleAdmin) {
+			return fiber.NewError(fiber.StatusForbidden, "Only admins can create ntfy and webhook subscriptions")
+		}
+		if u, err := url.Parse(body.Target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid URL")
+		}
+	}
+	if _, err := time.LoadLocation(body.Timezone); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Unrecognized timezone")
+	}
+	for _, clock := range []*string{body.QuietStart, body.QuietEnd} {
+		if clock != nil {
+			if _, err := time.Parse("15:04", *clock); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "Invalid quiet hours")
+			}
+		}
+	}
+
+	var id string
+	if err := h.Pool.QueryRow(rctx, `
+		INSERT INTO notification_subscriptions (owner,channel,target,stream_name,streamer,events,quiet_start,quiet_end,timezone,min_interval)
+		VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) RETURNING id;
+	`, uid, body.Channel, body.Target, body.StreamName, body.Streamer, body.Events, body.QuietStart, body.QuietEnd, body.Timezone, body.MinInterval).Scan(&id); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	ctx.Response().Header.Add("Content-Type", "text/plain")
+	ctx.WriteString(id)
+
+	return nil
+}
+
+func (h handler) DeleteNotificationSubscription(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	var id string
+	if err := h.Pool.QueryRow(rctx, `
+		DELETE FROM notification_subscriptions WHERE id = $1 AND owner = $2 RETURNING id;
+	`, ctx.Params("id"), uid).Scan(&id); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return fiber.NewError(fiber.StatusNotFound, "Not found")
+	}
+
+	return nil
+}
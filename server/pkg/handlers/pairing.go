@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	pairingServer "github.com/web-stuff-98/go-react-vid-streams/pkg/pairingServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/validation"
+)
+
+type OutPairingRequest struct {
+	// secret used by the device to collect its token, never shown to the admin
+	ID        string    `json:"id"`
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Called by a new device. The device displays the code and polls the pairing with the id.
+func (h handler) RequestPairing(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.RequestPairing{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	recvChan := make(chan *pairingServer.Pairing, 1)
+	h.PairingServer.CreatePairing <- pairingServer.CreatePairing{
+		Label:    body.Label,
+		IP:       ctx.IP(),
+		RecvChan: recvChan,
+	}
+	p := <-recvChan
+
+	close(recvChan)
+
+	if p == nil {
+		return fiber.NewError(fiber.StatusTooManyRequests, "Too many pending pairings, try again later")
+	}
+
+	if b, err := json.Marshal(OutPairingRequest{
+		ID:        p.ID,
+		Code:      p.Code,
+		ExpiresAt: p.ExpiresAt,
+	}); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// Polled by the device. Responds with 202 until the pairing is approved, then with the
+// device token. The token can only be collected once.
+func (h handler) PollPairing(ctx *fiber.Ctx) error {
+	recvChan := make(chan pairingServer.PollResult, 1)
+	h.PairingServer.PollPairing <- pairingServer.PollPairing{
+		ID:       ctx.Params("id"),
+		RecvChan: recvChan,
+	}
+	result := <-recvChan
+
+	close(recvChan)
+
+	if !result.Found {
+		return fiber.NewError(fiber.StatusNotFound, "Pairing not found or expired")
+	}
+	if result.Token == "" {
+		ctx.Status(fiber.StatusAccepted)
+		return nil
+	}
+
+	if b, err := json.Marshal(map[string]string{"token": result.Token}); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// Lists pending pairings so that admins can check the label and IP of the device
+func (h handler) GetPairings(ctx *fiber.Ctx) error {
+	recvChan := make(chan []pairingServer.Pairing, 1)
+	h.PairingServer.GetPairings <- pairingServer.GetPairings{
+		RecvChan: recvChan,
+	}
+	pairings := <-recvChan
+
+	close(recvChan)
+
+	if b, err := json.Marshal(pairings); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+func (h handler) ApprovePairing(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.ApprovePairing{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	recvChan := make(chan *pairingServer.Pairing, 1)
+	h.PairingServer.ClaimPairing <- pairingServer.ClaimPairing{
+		Code:     body.Code,
+		RecvChan: recvChan,
+	}
+	p := <-recvChan
+
+	close(recvChan)
+
+	if p == nil {
+		return fiber.NewError(fiber.StatusNotFound, "Pairing not found or expired")
+	}
+
+	device, err := h.issueDevice(rctx, p.Label, body.StreamerID, body.Streams, uid)
+	if err != nil {
+		h.PairingServer.CompletePairing <- pairingServer.CompletePairing{ID: p.ID}
+		return err
+	}
+
+	h.PairingServer.CompletePairing <- pairingServer.CompletePairing{
+		ID:    p.ID,
+		Token: device.Token,
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionPairingApproved,
+		Target:  device.ID,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{
+			"label":       p.Label,
+			"device_ip":   p.IP,
+			"streamer_id": body.StreamerID,
+			"streams":     body.Streams,
+		},
+	})
+
+	ctx.Response().Header.Add("Content-Type", "text/plain")
+	ctx.WriteString(device.ID)
+
+	return nil
+}
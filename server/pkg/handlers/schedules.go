@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	armServer "github.com/web-stuff-98/go-react-vid-streams/pkg/armServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/validation"
+)
+
+func (h handler) GetStreamSchedule(ctx *fiber.Ctx) error {
+	uid := ctx.Locals("uid").(string)
+
+	name := ctx.Params("name")
+	if name == "" || len(name) > 24 {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	recvChan := make(chan armServer.Schedule, 1)
+	h.ArmServer.GetSchedule <- armServer.GetSchedule{
+		Uid:      uid,
+		Name:     name,
+		RecvChan: recvChan,
+	}
+	schedule := <-recvChan
+
+	close(recvChan)
+
+	if b, err := json.Marshal(schedule); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+func (h handler) SetStreamSchedule(ctx *fiber.Ctx) error {
+	uid := ctx.Locals("uid").(string)
+
+	name := ctx.Params("name")
+	if name == "" || len(name) > 24 {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	v := validator.New()
+	body := &validation.ArmSchedule{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	windows := []armServer.Window{}
+	for _, w := range body.Windows {
+		windows = append(windows, armServer.Window{
+			Day:   w.Day,
+			Start: w.Start,
+			End:   w.End,
+		})
+	}
+
+	errorChan := make(chan error, 1)
+	h.ArmServer.SetSchedule <- armServer.SetSchedule{
+		Uid:       uid,
+		Name:      name,
+		Timezone:  body.Timezone,
+		Windows:   windows,
+		ErrorChan: errorChan,
+	}
+	err := <-errorChan
+
+	close(errorChan)
+
+	if err != nil {
+		var invalid *armServer.InvalidScheduleError
+		if errors.As(err, &invalid) {
+			return fiber.NewError(fiber.StatusBadRequest, invalid.Msg)
+		}
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	return nil
+}
+
+func (h handler) SetStreamArmOverride(ctx *fiber.Ctx) error {
+	uid := ctx.Locals("uid").(string)
+
+	name := ctx.Params("name")
+	if name == "" || len(name) > 24 {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	body := &validation.ArmOverride{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	errorChan := make(chan error, 1)
+	h.ArmServer.SetOverride <- armServer.SetOverride{
+		Uid:       uid,
+		Name:      name,
+		Armed:     body.Armed,
+		ErrorChan: errorChan,
+	}
+	err := <-errorChan
+
+	close(errorChan)
+
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	return nil
+}
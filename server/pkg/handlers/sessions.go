@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	sessionStore "github.com/web-stuff-98/go-react-vid-streams/pkg/sessionStore"
+	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
+)
+
+type OutSession struct {
+	ID         string    `json:"id"`
+	Label      string    `json:"label"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+func (h handler) GetSessions(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+	sid := ctx.Locals("sid").(string)
+
+	sessions, err := h.SessionStore.List(rctx, uid)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+
+	out := []OutSession{}
+	for _, s := range sessions {
+		out = append(out, OutSession{
+			ID:         s.Sid,
+			Label:      s.Label,
+			IP:         s.IP,
+			UserAgent:  s.UserAgent,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			Current:    s.Sid == sid,
+		})
+	}
+
+	if b, err := json.Marshal(out); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+func (h handler) RevokeSession(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	// users can only revoke their own sessions
+	session, err := h.SessionStore.Get(rctx, ctx.Params("id"))
+	if err != nil || session.Uid != uid {
+		if err != nil && err != sessionStore.ErrNotFound {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return fiber.NewError(fiber.StatusNotFound, "Not found")
+	}
+
+	if err = h.revokeSession(rctx, session.Sid); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionSessionRevoked,
+		Target:  session.Sid,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{"label": session.Label, "ip": session.IP},
+	})
+
+	return nil
+}
+
+// Revokes every session belonging to the user except the one making the request
+func (h handler) RevokeOtherSessions(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+	sid := ctx.Locals("sid").(string)
+
+	sessions, err := h.SessionStore.List(rctx, uid)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	for _, s := range sessions {
+		if s.Sid != sid {
+			if err = h.revokeSession(rctx, s.Sid); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			audit.Record(h.Pool, audit.Entry{
+				ActorID: uid,
+				Action:  audit.ActionSessionRevoked,
+				Target:  s.Sid,
+				IP:      ctx.IP(),
+				Details: map[string]interface{}{"label": s.Label, "ip": s.IP},
+			})
+		}
+	}
+
+	return nil
+}
+
+// Deletes the session and closes any websocket connections opened with it. Unregistering
+// the connection also removes the user from WebRTC.
+func (h handler) revokeSession(rctx context.Context, sid string) error {
+	if err := h.SessionStore.Delete(rctx, sid); err != nil {
+		return err
+	}
+
+	h.closeSessionConns(sid)
+
+	return nil
+}
+
+func (h handler) sessionConns(sid string) []socketServer.ConnectionData {
+	recvChan := make(chan []socketServer.ConnectionData, 1)
+	h.SocketServer.GetSessionConns <- socketServer.GetSessionConns{
+		Sid:      sid,
+		RecvChan: recvChan,
+	}
+	conns := <-recvChan
+
+	close(recvChan)
+
+	return conns
+}
+
+func (h handler) closeSessionConns(sid string) {
+	for _, c := range h.sessionConns(sid) {
+		h.SocketServer.UnregisterConn <- c.Conn
+		c.Conn.Close()
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/validation"
+)
+
+type OutSettings struct {
+	RequireAdminTwoFactor bool `json:"require_admin_two_factor"`
+}
+
+func (h handler) GetSettings(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	out := OutSettings{}
+	if err := h.Pool.QueryRow(rctx, `
+		SELECT COALESCE((SELECT value::boolean FROM settings WHERE key = 'require_admin_two_factor'), FALSE);
+	`).Scan(&out.RequireAdminTwoFactor); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	if b, err := json.Marshal(out); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// Only the settings included in the body are changed
+func (h handler) UpdateSettings(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.Settings{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	if body.RequireAdminTwoFactor != nil {
+		// otherwise the admin would lose their own admin permissions straight away
+		if *body.RequireAdminTwoFactor {
+			var enabled bool
+			if err := h.Pool.QueryRow(rctx, `
+				SELECT totp_secret IS NOT NULL FROM users WHERE id = (SELECT user_id FROM streamers WHERE id = $1);
+			`, uid).Scan(&enabled); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			if !enabled {
+				return fiber.NewError(fiber.StatusBadRequest, "Enable two factor authentication on your own account first")
+			}
+		}
+
+		if err := h.setSetting(rctx, uid, "require_admin_two_factor", *body.RequireAdminTwoFactor); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+
+		audit.Record(h.Pool, audit.Entry{
+			ActorID: uid,
+			Action:  audit.ActionSettingChanged,
+			Target:  "require_admin_two_factor",
+			IP:      ctx.IP(),
+			Details: map[string]interface{}{
+				"value": *body.RequireAdminTwoFactor,
+			},
+		})
+	}
+
+	return nil
+}
+
+func (h handler) setSetting(rctx context.Context, uid string, key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = h.Pool.Exec(rctx, `
+		INSERT INTO settings (key,value,updated_by) VALUES($1,$2,(SELECT user_id FROM streamers WHERE id = $3))
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_by = EXCLUDED.updated_by, updated_at = NOW();
+	`, key, b, uid)
+	return err
+}
@@ -0,0 +1,503 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/encryption"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/validation"
+)
+
+type OutShareLink struct {
+	ID           string     `json:"id"`
+	StreamName   string     `json:"stream_name"`
+	StartSeconds *int       `json:"start_seconds"`
+	EndSeconds   *int       `json:"end_seconds"`
+	MaxDownloads *int       `json:"max_downloads"`
+	Downloads    int        `json:"downloads"`
+	CreatedBy    *string    `json:"created_by"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at"`
+}
+
+type OutCreatedShareLink struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Streamers can share their own recordings, admins can share any recording. The URL is
+// only returned once, it can't be recreated without the expiry it was signed with.
+func (h handler) ShareRecording(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.ShareRecording{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+	isAdmin := ctx.Locals("role").(string) == authHelpers.RoleAdmin
+	name := ctx.Params("name")
+
+	var vidID string
+	var seconds int
+	if err := h.Pool.QueryRow(rctx, `
+		SELECT id,seconds FROM vid_meta WHERE LOWER(name) = LOWER($1) AND (streamer = $2 OR $3);
+	`, name, uid, isAdmin).Scan(&vidID, &seconds); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return fiber.NewError(fiber.StatusNotFound, "Recording not found")
+	}
+
+	if body.StartSeconds != nil && *body.StartSeconds >= seconds {
+		return fiber.NewError(fiber.StatusBadRequest, "The clip starts after the end of the recording")
+	}
+
+	// the signature only has second precision
+	expiresAt := time.Now().Add(time.Minute * time.Duration(body.ExpiresInMinutes)).Truncate(time.Second)
+
+	out := OutCreatedShareLink{ExpiresAt: expiresAt}
+	if err := h.Pool.QueryRow(rctx, `
+		INSERT INTO share_links (vid_id,start_seconds,end_seconds,max_downloads,created_by,expires_at)
+		VALUES($1,$2,$3,$4,$5,$6) RETURNING id;
+	`, vidID, body.StartSeconds, body.EndSeconds, body.MaxDownloads, uid, expiresAt).Scan(&out.ID); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	out.URL = fmt.Sprintf("%v/api/share/%v?expires=%v&sig=%v", publicURL(ctx), out.ID, expiresAt.Unix(), h.ShareLinks.Sign(out.ID, expiresAt))
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionShareCreated,
+		Target:  name,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{
+			"link":          out.ID,
+			"expires_at":    expiresAt,
+			"start_seconds": body.StartSeconds,
+			"end_seconds":   body.EndSeconds,
+			"max_downloads": body.MaxDownloads,
+		},
+	})
+
+	if b, err := json.Marshal(out); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// Streamers get the links for their own recordings, admins get every link
+func (h handler) GetShareLinks(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+	isAdmin := ctx.Locals("role").(string) == authHelpers.RoleAdmin
+
+	links := []OutShareLink{}
+
+	if rows, err := h.Pool.Query(rctx, `
+		SELECT share_links.id,vid_meta.name,start_seconds,end_seconds,max_downloads,downloads,created_by,share_links.created_at,expires_at,revoked_at FROM share_links
+		INNER JOIN vid_meta ON vid_meta.id = share_links.vid_id
+		WHERE vid_meta.streamer = $1 OR $2
+		ORDER BY share_links.created_at DESC;
+	`, uid, isAdmin); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			l := OutShareLink{}
+			if err = rows.Scan(&l.ID, &l.StreamName, &l.StartSeconds, &l.EndSeconds, &l.MaxDownloads, &l.Downloads, &l.CreatedBy, &l.CreatedAt, &l.ExpiresAt, &l.RevokedAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			links = append(links, l)
+		}
+	}
+
+	if b, err := json.Marshal(links); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+func (h handler) RevokeShareLink(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+	isAdmin := ctx.Locals("role").(string) == authHelpers.RoleAdmin
+
+	var name string
+	if err := h.Pool.QueryRow(rctx, `
+		UPDATE share_links SET revoked_at = NOW() FROM vid_meta
+		WHERE share_links.id = $1 AND vid_meta.id = share_links.vid_id AND revoked_at IS NULL AND (vid_meta.streamer = $2 OR $3)
+		RETURNING vid_meta.name;
+	`, ctx.Params("id"), uid, isAdmin).Scan(&name); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return fiber.NewError(fiber.StatusNotFound, "Not found")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionShareRevoked,
+		Target:  name,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{"link": ctx.Params("id")},
+	})
+
+	return nil
+}
+
+// Public. The response is streamed rather than buffered, since unlike DownloadStreamVideo
+// it isn't split into sections. Clips are approximate: the byte range is worked out from
+// the average bitrate of the recording, then both ends are moved forward to the start of
+// the next WebM cluster, since players can only start decoding at a cluster. The WebM
+// header, up to its first cluster, is put in front of the clip.
+//
+// Links without a download limit support single Range requests so that the recording can
+// be streamed, and requests that don't start at the beginning aren't counted as downloads.
+// Links with a limit ignore Range, every request is a download.
+func (h handler) DownloadShareLink(ctx *fiber.Ctx) error {
+	id := ctx.Params("id")
+	if !h.ShareLinks.Verify(id, ctx.Query("expires"), ctx.Query("sig")) {
+		audit.Record(h.Pool, audit.Entry{
+			Action:  audit.ActionShareRefused,
+			Target:  id,
+			IP:      ctx.IP(),
+			Details: map[string]interface{}{"reason": "signature"},
+		})
+		return fiber.NewError(fiber.StatusForbidden, "This link is invalid or has expired")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	chunkSize, err := strconv.Atoi(os.Getenv("VID_CHUNK_SIZE"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to parse VID_CHUNK_SIZE environment variable")
+	}
+
+	rangeHeader := ctx.Get(fiber.HeaderRange)
+	// the length isn't known yet, but whether the range starts after the beginning is
+	seekFrom, _, seeking, _ := parseByteRange(rangeHeader, math.MaxInt)
+	seeking = seeking && seekFrom > 0
+
+	// counting the download and checking the link in one statement, so that the limit can't be exceeded
+	var vidID, name string
+	var size, seconds, headerSize, downloads int
+	var start, end, maxDownloads *int
+	var dataKey []byte
+	var masterKeyID *string
+	if err := h.Pool.QueryRow(rctx, `
+		UPDATE share_links SET downloads = downloads + CASE WHEN $2 AND max_downloads IS NULL THEN 0 ELSE 1 END
+		FROM vid_meta
+		WHERE share_links.id = $1 AND vid_meta.id = share_links.vid_id AND revoked_at IS NULL AND expires_at > NOW()
+		AND (max_downloads IS NULL OR downloads < max_downloads)
+		RETURNING vid_meta.id,vid_meta.name,vid_meta.size,vid_meta.seconds,vid_meta.header_size,vid_meta.data_key,vid_meta.master_key_id,start_seconds,end_seconds,max_downloads,downloads;
+	`, id, seeking).Scan(&vidID, &name, &size, &seconds, &headerSize, &dataKey, &masterKeyID, &start, &end, &maxDownloads, &downloads); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		audit.Record(h.Pool, audit.Entry{
+			Action:  audit.ActionShareRefused,
+			Target:  id,
+			IP:      ctx.IP(),
+			Details: map[string]interface{}{"reason": "revoked, expired or download limit reached"},
+		})
+		return fiber.NewError(fiber.StatusForbidden, "This link is invalid or has expired")
+	}
+
+	rec, err := h.Vault.Recording(vidID, dataKey, masterKeyID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	// byte ranges to write, the header then the clip. Recordings from before the header
+	// size was recorded are always sent whole.
+	ranges := [][2]int{{0, size}}
+	if start != nil && end != nil && headerSize > 0 && headerSize < size && seconds > 0 {
+		bytesPerSecond := float64(size-headerSize) / float64(seconds)
+		from := headerSize + int(float64(*start)*bytesPerSecond)
+		to := headerSize + int(float64(*end)*bytesPerSecond)
+		if to > size {
+			to = size
+		}
+		if from < to {
+			var headerEnd int
+			if headerEnd, err = h.findCluster(rctx, rec, vidID, 0, headerSize, chunkSize); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			if from, err = h.findCluster(rctx, rec, vidID, from, size, chunkSize); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			if to, err = h.findCluster(rctx, rec, vidID, to, size, chunkSize); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			if from < to {
+				ranges = [][2]int{{0, headerEnd}, {from, to}}
+			}
+		}
+	}
+	length := 0
+	for _, r := range ranges {
+		length += r[1] - r[0]
+	}
+
+	if maxDownloads != nil {
+		rangeHeader = ""
+		ctx.Set(fiber.HeaderAcceptRanges, "none")
+	} else {
+		ctx.Set(fiber.HeaderAcceptRanges, "bytes")
+	}
+	from, to, partial, ok := parseByteRange(rangeHeader, length)
+	if !ok {
+		ctx.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%v", length))
+		return fiber.NewError(fiber.StatusRequestedRangeNotSatisfiable, "Range not satisfiable")
+	}
+	if partial {
+		ranges = sliceRanges(ranges, from, to)
+		ctx.Status(fiber.StatusPartialContent)
+		ctx.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %v-%v/%v", from, to-1, length))
+	}
+
+	if !seeking {
+		audit.Record(h.Pool, audit.Entry{
+			Action:  audit.ActionShareDownload,
+			Target:  name,
+			IP:      ctx.IP(),
+			Details: map[string]interface{}{"link": id, "downloads": downloads},
+		})
+	}
+
+	filename := url.PathEscape(name)
+	if start != nil && end != nil {
+		filename = fmt.Sprintf("%v-%v-%v", filename, *start, *end)
+	}
+	ctx.Response().Header.SetContentType("video/webm")
+	ctx.Response().Header.Set("Content-Disposition", fmt.Sprintf(`inline; filename="%v.webm"`, filename))
+
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// the download can take much longer than a normal request
+		sctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+
+		for _, r := range ranges {
+			if err := h.writeVideoBytes(sctx, w, rec, vidID, r[0], r[1], chunkSize); err != nil {
+				log.Printf("Share link %v download failed: %v", id, err)
+				return
+			}
+		}
+	})
+	ctx.Response().Header.SetContentLength(to - from)
+
+	return nil
+}
+
+// Parses a Range header against content of the given length. to is exclusive. partial
+// is false when the whole content should be sent, which is the case when there is no
+// header, or it can't be parsed, or it asks for more than one range. ok is false when
+// the range can't be satisfied.
+func parseByteRange(header string, length int) (from int, to int, partial bool, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, length, false, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, length, false, true
+	}
+
+	if first == "" {
+		// the last n bytes
+		n, err := strconv.Atoi(last)
+		if err != nil {
+			return 0, length, false, true
+		}
+		if n <= 0 || length == 0 {
+			return 0, 0, false, false
+		}
+		if n > length {
+			n = length
+		}
+		return length - n, length, true, true
+	}
+
+	from, err := strconv.Atoi(first)
+	if err != nil || from < 0 {
+		return 0, length, false, true
+	}
+	if from >= length {
+		return 0, 0, false, false
+	}
+	to = length
+	if last != "" {
+		end, err := strconv.Atoi(last)
+		if err != nil || end < from {
+			return 0, length, false, true
+		}
+		if end+1 < to {
+			to = end + 1
+		}
+	}
+	return from, to, true, true
+}
+
+// Narrows byte ranges of the recording down to the part from from to to (exclusive) of
+// the content they make up when written one after another
+func sliceRanges(ranges [][2]int, from int, to int) [][2]int {
+	out := [][2]int{}
+	pos := 0
+	for _, r := range ranges {
+		length := r[1] - r[0]
+		lo, hi := r[0], r[1]
+		if from > pos {
+			lo += from - pos
+		}
+		if to < pos+length {
+			hi -= pos + length - to
+		}
+		if lo < hi {
+			out = append(out, [2]int{lo, hi})
+		}
+		pos += length
+	}
+	return out
+}
+
+// WebM cluster element ID
+var webmClusterID = []byte{0x1f, 0x43, 0xb6, 0x75}
+
+// Returns the offset of the first WebM cluster that starts at or after from, or to if
+// none starts before to. The cluster ID could in theory turn up inside a frame, which
+// would only make the clip start or end at the wrong place.
+func (h handler) findCluster(ctx context.Context, rec *encryption.Recording, vidID string, from int, to int, chunkSize int) (int, error) {
+	conn, err := h.Pool.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	// the end of the previous chunk, in case the ID is split between two chunks
+	var carry []byte
+	var sealed []byte
+	for index := from / chunkSize; index*chunkSize < to; index++ {
+		if err = conn.QueryRow(ctx, `
+			SELECT bytes FROM vid_chunks WHERE vid_id = $1 AND index = $2;
+		`, vidID, index).Scan(&sealed); err != nil {
+			return 0, err
+		}
+		data, err := rec.Open(index, sealed)
+		if err != nil {
+			return 0, err
+		}
+
+		buf := append(carry, data...)
+		bufOffset := index*chunkSize - len(carry)
+		lo := 0
+		if from > bufOffset {
+			lo = from - bufOffset
+		}
+		if lo < len(buf) {
+			if i := bytes.Index(buf[lo:], webmClusterID); i != -1 {
+				if pos := bufOffset + lo + i; pos < to {
+					return pos, nil
+				}
+				return to, nil
+			}
+		}
+		if keep := len(webmClusterID) - 1; len(buf) > keep {
+			carry = append([]byte{}, buf[len(buf)-keep:]...)
+		} else {
+			carry = buf
+		}
+	}
+
+	return to, nil
+}
+
+// Writes bytes from the recording, from is inclusive and to is exclusive. Every chunk
+// except the last one is full, so the chunk index can be worked out from the offset.
+func (h handler) writeVideoBytes(ctx context.Context, w *bufio.Writer, rec *encryption.Recording, vidID string, from int, to int, chunkSize int) error {
+	conn, err := h.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	var sealed []byte
+	for index := from / chunkSize; index*chunkSize < to; index++ {
+		if err = conn.QueryRow(ctx, `
+			SELECT bytes FROM vid_chunks WHERE vid_id = $1 AND index = $2;
+		`, vidID, index).Scan(&sealed); err != nil {
+			return err
+		}
+		bytes, err := rec.Open(index, sealed)
+		if err != nil {
+			return err
+		}
+
+		offset := index * chunkSize
+		lo, hi := 0, len(bytes)
+		if from > offset {
+			lo = from - offset
+		}
+		if to-offset < hi {
+			hi = to - offset
+		}
+		if lo >= hi {
+			continue
+		}
+
+		if _, err = w.Write(bytes[lo:hi]); err != nil {
+			return err
+		}
+		// flushing errors when the visitor has gone away
+		if err = w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Share links need to be absolute. PUBLIC_URL overrides the URL the request came in on,
+// for when the server is behind a reverse proxy.
+func publicURL(ctx *fiber.Ctx) string {
+	if u := os.Getenv("PUBLIC_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return ctx.BaseURL()
+}
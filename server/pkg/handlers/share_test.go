@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header   string
+		length   int
+		from, to int
+		partial  bool
+		ok       bool
+	}{
+		{"", 100, 0, 100, false, true},
+		{"bytes=0-", 100, 0, 100, true, true},
+		{"bytes=10-19", 100, 10, 20, true, true},
+		{"bytes=10-1000", 100, 10, 100, true, true},
+		{"bytes=-30", 100, 70, 100, true, true},
+		{"bytes=-1000", 100, 0, 100, true, true},
+		{"bytes=100-", 100, 0, 0, false, false},
+		{"bytes=-0", 100, 0, 0, false, false},
+		// ignored, the whole content is sent
+		{"bytes=0-1,5-6", 100, 0, 100, false, true},
+		{"bytes=20-10", 100, 0, 100, false, true},
+		{"bytes=a-b", 100, 0, 100, false, true},
+		{"items=0-10", 100, 0, 100, false, true},
+	}
+
+	for _, tt := range tests {
+		from, to, partial, ok := parseByteRange(tt.header, tt.length)
+		if from != tt.from || to != tt.to || partial != tt.partial || ok != tt.ok {
+			t.Errorf("parseByteRange(%q, %v) = %v, %v, %v, %v, want %v, %v, %v, %v",
+				tt.header, tt.length, from, to, partial, ok, tt.from, tt.to, tt.partial, tt.ok)
+		}
+	}
+}
+
+func TestSliceRanges(t *testing.T) {
+	// a 10 byte header followed by a clip from 500 to 600
+	ranges := [][2]int{{0, 10}, {500, 600}}
+
+	tests := []struct {
+		from, to int
+		want     [][2]int
+	}{
+		{0, 110, [][2]int{{0, 10}, {500, 600}}},
+		{0, 5, [][2]int{{0, 5}}},
+		{5, 15, [][2]int{{5, 10}, {500, 505}}},
+		{10, 110, [][2]int{{500, 600}}},
+		{60, 70, [][2]int{{550, 560}}},
+	}
+
+	for _, tt := range tests {
+		if got := sliceRanges(ranges, tt.from, tt.to); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sliceRanges(%v, %v) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
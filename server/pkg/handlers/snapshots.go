@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	armServer "github.com/web-stuff-98/go-react-vid-streams/pkg/armServer"
+	videoServer "github.com/web-stuff-98/go-react-vid-streams/pkg/videoServer"
+)
+
+var MaxSnapshotSize int = 2 * 1024 * 1024
+
+func (h handler) UploadSnapshot(ctx *fiber.Ctx) error {
+	data := ctx.Body()
+
+	name := ctx.Params("name")
+	if name == "" || len(name) > 24 {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if len(data) == 0 || len(data) > MaxSnapshotSize {
+		return fiber.NewError(fiber.StatusBadRequest, "Snapshot must be a JPEG no larger than 2mb")
+	}
+	// JPEG SOI marker
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}) {
+		return fiber.NewError(fiber.StatusBadRequest, "Snapshot must be a JPEG no larger than 2mb")
+	}
+
+	uid := ctx.Locals("uid").(string)
+
+	if !canPublish(ctx.Locals("device"), name) {
+		return fiber.NewError(fiber.StatusForbidden, "This device can't publish to that stream")
+	}
+
+	armedChan := make(chan bool, 1)
+	h.ArmServer.GetArmed <- armServer.GetArmed{
+		Uid:      uid,
+		Name:     name,
+		RecvChan: armedChan,
+	}
+	armed := <-armedChan
+
+	close(armedChan)
+
+	if !armed {
+		return fiber.NewError(fiber.StatusForbidden, "Stream is disarmed")
+	}
+
+	// the request body is reused by fiber after the handler returns
+	snapshot := make([]byte, len(data))
+	copy(snapshot, data)
+
+	errorChan := make(chan error, 1)
+	h.VideoServer.SetSnapshot <- videoServer.SetSnapshot{
+		Uid:       uid,
+		Name:      name,
+		Data:      snapshot,
+		ErrorChan: errorChan,
+	}
+	err := <-errorChan
+
+	close(errorChan)
+
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	return nil
+}
+
+// the optional streamer query param selects between streams with the same name
+func (h handler) GetStreamSnapshot(ctx *fiber.Ctx) error {
+	name := ctx.Params("name")
+	if name == "" || len(name) > 24 {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	recvChan := make(chan *videoServer.Snapshot, 1)
+	h.VideoServer.GetSnapshot <- videoServer.GetSnapshot{
+		Uid:      ctx.Query("streamer", ""),
+		Name:     name,
+		RecvChan: recvChan,
+	}
+	snapshot := <-recvChan
+
+	close(recvChan)
+
+	if snapshot == nil {
+		return fiber.NewError(fiber.StatusNotFound, "Not found")
+	}
+
+	ctx.Response().Header.SetContentType("image/jpeg")
+	ctx.Response().Header.Set("Cache-Control", "no-store")
+	ctx.Response().Header.Set("Last-Modified", snapshot.CreatedAt.UTC().Format(time.RFC1123))
+	ctx.Write(snapshot.Data)
+
+	return nil
+}
+
+func (h handler) GetVideoThumbnail(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	name := ctx.Params("name")
+	if name == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	var thumbnail []byte
+	if err := h.Pool.QueryRow(rctx, `
+		SELECT thumbnail FROM vid_meta WHERE name = $1;
+	`, name).Scan(&thumbnail); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		} else {
+			return fiber.NewError(fiber.StatusNotFound, "Recording not found")
+		}
+	}
+	if thumbnail == nil {
+		return fiber.NewError(fiber.StatusNotFound, "Recording has no thumbnail")
+	}
+
+	ctx.Response().Header.SetContentType("image/jpeg")
+	ctx.Response().Header.Set("Content-Disposition", fmt.Sprintf(`inline; filename="%v.jpg"`, url.PathEscape(name)))
+	ctx.Write(thumbnail)
+
+	return nil
+}
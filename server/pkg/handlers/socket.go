@@ -1,41 +1,86 @@
 package handlers
 
 import (
-	"context"
 	"encoding/json"
 	"log"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
 	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
 	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
+	videoServer "github.com/web-stuff-98/go-react-vid-streams/pkg/videoServer"
 )
 
 type decodedMsg struct {
-	Type string                 `json:"event"`
-	Data map[string]interface{} `json:"data"`
-}
-
-func SendSocketErrorMessage(m string, c *websocket.Conn) {
-	c.WriteJSON(map[string]string{
-		"msg": m,
-	})
+	Type string `json:"event"`
+	// optional, sent back in the ACK or ERROR event
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data"`
 }
 
 func (h handler) WebSocketHandler() func(*fiber.Ctx) error {
 	return websocket.New(func(c *websocket.Conn) {
+		// identifies this connection, a user can have several open at once
+		connID := uuid.New().String()
+		// dead connections are noticed by the read failing once the client stops answering pings
+		socketServer.WatchPongs(c, h.SocketServer, func() {
+			sendHeartbeat(h, connID)
+		})
+		deviceID := ""
+		if d, ok := c.Locals("device").(*authHelpers.Device); ok {
+			deviceID = d.ID
+		}
+		writerStopped := make(chan struct{})
 		h.SocketServer.RegisterConn <- socketServer.ConnectionData{
-			Uid:  c.Locals("uid").(string),
-			Conn: c,
+			ID:            connID,
+			Uid:           c.Locals("uid").(string),
+			Sid:           c.Locals("sid").(string),
+			DeviceID:      deviceID,
+			Conn:          c,
+			WriterStopped: writerStopped,
+		}
+		ackTimeout := time.Second * 10
+		if seconds, err := strconv.Atoi(os.Getenv("SOCKET_ACK_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+			ackTimeout = time.Second * time.Duration(seconds)
+		}
+		sc := socketContext{
+			Uid:        c.Locals("uid").(string),
+			Role:       c.Locals("role").(string),
+			ConnID:     connID,
+			Conn:       c,
+			AckTimeout: ackTimeout,
 		}
+		events := make(chan *decodedMsg, maxQueuedSocketEvents)
+		workerDone := make(chan struct{})
+		go socketWorker(events, workerDone, h, sc)
 		defer func() {
+			// events that have been received are handled before unregistering, otherwise a
+			// WEBRTC_JOIN could be handled after the WebRTC server has been told the
+			// connection is gone, leaving the peer behind
+			close(events)
+			<-workerDone
 			h.SocketServer.UnregisterConn <- c
+			h.VideoServer.StatsSubscription <- videoServer.StatsSubscription{
+				ConnID:    connID,
+				Subscribe: false,
+			}
+			// the connection is released when this returns, so wait for the writer. Closing
+			// makes any write it's in the middle of, or is about to start, fail straight away.
+			c.Close()
+			<-writerStopped
 		}()
 		for {
 			if _, p, err := c.ReadMessage(); err != nil {
 				log.Println("ws reader error:", err)
 				return
 			} else {
+				socketServer.ExtendReadDeadline(c, h.SocketServer)
+				sendHeartbeat(h, connID)
+				// older clients send their own pings as text, protocol level pings have replaced them
 				if len(p) == 4 {
 					if string(p) == "PING" {
 						continue
@@ -47,23 +92,26 @@ func (h handler) WebSocketHandler() func(*fiber.Ctx) error {
 					c.Close()
 					return
 				} else {
-					if err := handleSocketEvent(decoded.Data, decoded.Type, h, c.Locals("uid").(string), c); err != nil {
-						SendSocketErrorMessage(err.Error(), c)
-					}
+					queueSocketEvent(decoded, h, sc, events)
 				}
 			}
 		}
 	})
 }
 
+// Never blocks, it's called from the reader. A dropped heartbeat doesn't matter
+// because another one comes with the next message or pong.
+func sendHeartbeat(h handler, connID string) {
+	select {
+	case h.HealthMonitor.Heartbeat <- connID:
+	default:
+	}
+}
+
+// must come after RequireRole, which authenticates the session
 func (h handler) WebSocketAuth(ctx *fiber.Ctx) error {
-	if uid, _, err := authHelpers.GetUidAndSid(h.RedisClient, ctx, context.Background(), h.Pool); err != nil {
-		return fiber.ErrForbidden
-	} else {
-		if websocket.IsWebSocketUpgrade(ctx) {
-			ctx.Locals("uid", uid)
-			return ctx.Next()
-		}
-		return fiber.ErrUpgradeRequired
+	if websocket.IsWebSocketUpgrade(ctx) {
+		return ctx.Next()
 	}
+	return fiber.ErrUpgradeRequired
 }
@@ -1,127 +1,316 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/websocket/v2"
+	healthMonitor "github.com/web-stuff-98/go-react-vid-streams/pkg/healthMonitor"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
+	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
+	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
 	socketValidation "github.com/web-stuff-98/go-react-vid-streams/pkg/socketValidation"
+	videoServer "github.com/web-stuff-98/go-react-vid-streams/pkg/videoServer"
 	webRTCserver "github.com/web-stuff-98/go-react-vid-streams/pkg/webRTCserver"
 )
 
-func handleSocketEvent(data map[string]interface{}, event string, h handler, uid string, c *websocket.Conn) error {
-	var err error
+// Every event a client can send. Each one declares its payload type, from the
+// socketValidation package, and the minimum role required to send it. Viewers need
+// to be able to exchange signals with streamers to watch them, but only streamers
+// can publish.
+//
+// Events sent with an id are answered with an ACK event carrying the same id once
+// they have been handled, or with an ERROR event. Requests also send data back in
+// the ACK. If handling takes longer than SOCKET_ACK_TIMEOUT_SECONDS (default 10) a
+// TIMEOUT error is sent instead, the event might still be handled afterwards.
+//
+// Each connection has a worker that handles its events one at a time, in the order they
+// were received, so that a slow handler doesn't hold up the reader (and the pongs it
+// reads). Up to maxQueuedSocketEvents can be waiting for the worker, past that events
+// are answered with a BUSY error.
+var socketEvents = map[string]socketEvent{
+	"WEBRTC_JOIN":             newSocketRequest(authHelpers.RoleViewer, webRTCJoin),
+	"WEBRTC_LEAVE":            newSocketEvent(authHelpers.RoleViewer, webRTCLeave),
+	"WEBRTC_SENDING_SIGNAL":   newSocketEvent(authHelpers.RoleViewer, webRTCSendingSignal),
+	"WEBRTC_RETURNING_SIGNAL": newSocketEvent(authHelpers.RoleViewer, webRTCReturningSignal),
+	"WEBRTC_MOTION_UPDATE":    newSocketEvent(authHelpers.RoleStreamer, webRTCMotionUpdate),
+	"STATS_SUBSCRIBE":         newSocketEvent(authHelpers.RoleAdmin, statsSubscribe),
+	"STATS_UNSUBSCRIBE":       newSocketEvent(authHelpers.RoleViewer, statsUnsubscribe),
+}
+
+// Error codes sent in ERROR events
+const (
+	SocketErrUnknownEvent = "UNKNOWN_EVENT"
+	SocketErrBadRequest   = "BAD_REQUEST"
+	SocketErrForbidden    = "FORBIDDEN"
+	SocketErrInternal     = "INTERNAL"
+	SocketErrTimeout      = "TIMEOUT"
+	SocketErrBusy         = "BUSY"
+)
+
+// request ids are only echoed back, but there's no reason for them to be long
+const maxSocketRequestIDLength = 64
+
+// per connection, events received but not handled yet
+const maxQueuedSocketEvents = 32
+
+type socketEvent struct {
+	role string
+	// decodes and validates the payload, then handles the event. The result is sent in the ACK.
+	handle func(data json.RawMessage, h handler, sc socketContext) (interface{}, error)
+}
+
+// The connection an event was received on
+type socketContext struct {
+	Uid    string
+	Role   string
+	ConnID string
+	Conn   *websocket.Conn
+	// how long the client waits for an ACK
+	AckTimeout time.Duration
+}
+
+// Returned by event handlers to send a specific error code. Any other error is sent as INTERNAL.
+type socketError struct {
+	Code string
+	Msg  string
+	// json names of the fields that failed validation
+	Fields []string
+}
+
+func (e *socketError) Error() string {
+	return e.Msg
+}
+
+// json names are used in validation errors, so that clients can tell which field was wrong
+var socketValidator = func() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}()
+
+func newSocketEvent[T any](role string, handle func(data *T, h handler, sc socketContext) error) socketEvent {
+	return newSocketRequest(role, func(data *T, h handler, sc socketContext) (interface{}, error) {
+		return nil, handle(data, h, sc)
+	})
+}
 
-	switch event {
-	case "WEBRTC_JOIN":
-		err = webRTCJoin(data, h, uid, c)
-	case "WEBRTC_LEAVE":
-		err = webRTCLeave(data, h, uid, c)
-	case "WEBRTC_SENDING_SIGNAL":
-		err = webRTCSendingSignal(data, h, uid, c)
-	case "WEBRTC_RETURNING_SIGNAL":
-		err = webRTCReturningSignal(data, h, uid, c)
-	case "WEBRTC_MOTION_UPDATE":
-		err = webRTCMotionUpdate(data, h, uid, c)
+// Like newSocketEvent, but the handler returns data for the ACK
+func newSocketRequest[T any](role string, handle func(data *T, h handler, sc socketContext) (interface{}, error)) socketEvent {
+	return socketEvent{
+		role: role,
+		handle: func(raw json.RawMessage, h handler, sc socketContext) (interface{}, error) {
+			data := new(T)
+			if err := decodeSocketPayload(raw, data); err != nil {
+				return nil, err
+			}
+			return handle(data, h, sc)
+		},
+	}
+}
+
+// Called from the reader, never blocks
+func queueSocketEvent(msg *decodedMsg, h handler, sc socketContext, events chan<- *decodedMsg) {
+	if len(msg.ID) > maxSocketRequestIDLength {
+		// the id is too long to send back
+		msg.ID = ""
+		sendSocketError(&socketError{Code: SocketErrBadRequest, Msg: "Request id too long"}, msg, sc, h.SocketServer)
+		return
+	}
+
+	select {
+	case events <- msg:
 	default:
-		return fmt.Errorf("Unrecognized socket event")
+		sendSocketError(&socketError{Code: SocketErrBusy, Msg: "Too many events waiting to be handled"}, msg, sc, h.SocketServer)
 	}
+}
 
-	return err
+// One per connection. Returns once events has been closed and drained, then closes done.
+func socketWorker(events <-chan *decodedMsg, done chan<- struct{}, h handler, sc socketContext) {
+	defer close(done)
+
+	for msg := range events {
+		handleSocketEvent(msg, h, sc)
+	}
 }
 
-func UnmarshalMap(m map[string]interface{}, s interface{}) error {
-	b, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("Bad request")
+func handleSocketEvent(msg *decodedMsg, h handler, sc socketContext) {
+	var err error
+	var result interface{}
+
+	// only one response is sent for each event, whichever comes first
+	var respond sync.Once
+	if msg.ID != "" {
+		timer := time.AfterFunc(sc.AckTimeout, func() {
+			respond.Do(func() {
+				sendSocketError(&socketError{Code: SocketErrTimeout, Msg: "Timed out"}, msg, sc, h.SocketServer)
+			})
+		})
+		defer timer.Stop()
 	}
-	err = json.Unmarshal(b, s)
-	if err != nil {
-		return fmt.Errorf("Bad request")
+
+	if event, ok := socketEvents[msg.Type]; !ok {
+		err = &socketError{Code: SocketErrUnknownEvent, Msg: "Unrecognized socket event"}
+	} else if !authHelpers.HasRole(sc.Role, event.role) {
+		err = &socketError{Code: SocketErrForbidden, Msg: "You do not have permission to do that"}
+	} else {
+		result, err = event.handle(msg.Data, h, sc)
 	}
-	v := validator.New()
-	if err := v.Struct(s); err != nil {
-		return fmt.Errorf("Bad request")
+
+	respond.Do(func() {
+		if err != nil {
+			sendSocketError(err, msg, sc, h.SocketServer)
+		} else if msg.ID != "" {
+			socketServer.WriteMessage("ACK", socketMessages.SocketAck{
+				ID:    msg.ID,
+				Event: msg.Type,
+				Data:  result,
+			}, sc.Conn, h.SocketServer)
+		}
+	})
+}
+
+func sendSocketError(err error, msg *decodedMsg, sc socketContext, ss *socketServer.SocketServer) {
+	out := socketMessages.SocketError{
+		ID:    msg.ID,
+		Event: msg.Type,
+		Code:  SocketErrInternal,
+		Msg:   "Internal error",
+	}
+	var se *socketError
+	if errors.As(err, &se) {
+		out.Code = se.Code
+		out.Msg = se.Msg
+		out.Fields = se.Fields
+	}
+	socketServer.WriteMessage("ERROR", out, sc.Conn, ss)
+}
+
+// Events without data are decoded as an empty payload
+func decodeSocketPayload(raw json.RawMessage, data interface{}) error {
+	if len(raw) > 0 && !bytes.Equal(raw, []byte("null")) {
+		if err := json.Unmarshal(raw, data); err != nil {
+			return &socketError{Code: SocketErrBadRequest, Msg: "Bad request"}
+		}
+	}
+	if err := socketValidator.Struct(data); err != nil {
+		se := &socketError{Code: SocketErrBadRequest, Msg: "Bad request"}
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			for _, fe := range ve {
+				// without the top level struct name
+				se.Fields = append(se.Fields, strings.SplitN(fe.Namespace(), ".", 2)[1])
+			}
+		}
+		return se
 	}
 	return nil
 }
 
-func webRTCJoin(inData map[string]interface{}, h handler, uid string, c *websocket.Conn) error {
-	data := &socketValidation.WebRTCJoin{}
-	var err error
-	if err = UnmarshalMap(inData, data); err != nil {
-		return err
+// The ACK tells the client its connection ID, which other peers know it by
+func webRTCJoin(data *socketValidation.WebRTCJoin, h handler, sc socketContext) (interface{}, error) {
+	// viewers can join to watch, but they can't publish streams
+	if len(data.StreamsInfo) > 0 && !authHelpers.HasRole(sc.Role, authHelpers.RoleStreamer) {
+		return nil, &socketError{Code: SocketErrForbidden, Msg: "You do not have permission to publish streams"}
+	}
+	for _, si := range data.StreamsInfo {
+		if !canPublish(sc.Conn.Locals("device"), si.StreamName) {
+			return nil, &socketError{Code: SocketErrForbidden, Msg: "This device can't publish to that stream"}
+		}
 	}
 
 	h.WebRTCServer.JoinWebRTC <- webRTCserver.JoinWebRTC{
-		Uid:         uid,
+		ConnID:      sc.ConnID,
+		Uid:         sc.Uid,
 		StreamsInfo: data.StreamsInfo,
 	}
 
-	return nil
-}
-
-func webRTCLeave(inData map[string]interface{}, h handler, uid string, c *websocket.Conn) error {
-	data := &socketValidation.WebRTCLeave{}
-	var err error
-	if err = UnmarshalMap(inData, data); err != nil {
-		return err
+	names := []string{}
+	for _, si := range data.StreamsInfo {
+		names = append(names, si.StreamName)
+	}
+	h.HealthMonitor.Joined <- healthMonitor.Joined{
+		ConnID: sc.ConnID,
+		Uid:    sc.Uid,
+		Names:  names,
 	}
 
+	return socketMessages.WebRTCJoined{
+		ConnID: sc.ConnID,
+	}, nil
+}
+
+func webRTCLeave(data *socketValidation.WebRTCLeave, h handler, sc socketContext) error {
 	h.WebRTCServer.LeaveWebRTC <- webRTCserver.LeaveWebRTC{
-		Uid: uid,
+		ConnID: sc.ConnID,
+		Uid:    sc.Uid,
 	}
 
 	return nil
 }
 
-func webRTCSendingSignal(inData map[string]interface{}, h handler, uid string, c *websocket.Conn) error {
-	data := &socketValidation.WebRTCSendingSignal{}
-	var err error
-	if err = UnmarshalMap(inData, data); err != nil {
-		return err
-	}
-
+func webRTCSendingSignal(data *socketValidation.WebRTCSendingSignal, h handler, sc socketContext) error {
 	h.WebRTCServer.SignalWebRTC <- webRTCserver.SignalWebRTC{
 		Signal:      data.Signal,
+		ToConnID:    data.ConnID,
 		ToUid:       data.Uid,
-		Uid:         uid,
+		ConnID:      sc.ConnID,
+		Uid:         sc.Uid,
 		StreamsInfo: data.StreamsInfo,
 	}
 
 	return nil
 }
 
-func webRTCReturningSignal(inData map[string]interface{}, h handler, uid string, c *websocket.Conn) error {
-	data := &socketValidation.WebRTCReturningSignal{}
-	var err error
-	if err = UnmarshalMap(inData, data); err != nil {
-		return err
-	}
-
+func webRTCReturningSignal(data *socketValidation.WebRTCReturningSignal, h handler, sc socketContext) error {
 	h.WebRTCServer.ReturnSignalWebRTC <- webRTCserver.ReturnSignalWebRTC{
-		Signal:      data.Signal,
-		CallerID:    data.CallerID,
-		Uid:         uid,
-		StreamsInfo: data.StreamsInfo,
+		Signal:       data.Signal,
+		CallerConnID: data.CallerConnID,
+		CallerID:     data.CallerID,
+		ConnID:       sc.ConnID,
+		Uid:          sc.Uid,
+		StreamsInfo:  data.StreamsInfo,
 	}
 
 	return nil
 }
 
-func webRTCMotionUpdate(inData map[string]interface{}, h handler, uid string, c *websocket.Conn) error {
-	data := &socketValidation.WebRTCMotionUpdate{}
-	var err error
-	if err = UnmarshalMap(inData, data); err != nil {
-		return err
-	}
-
+func webRTCMotionUpdate(data *socketValidation.WebRTCMotionUpdate, h handler, sc socketContext) error {
 	h.WebRTCServer.MotionUpdate <- webRTCserver.MotionUpdate{
-		Uid:           uid,
+		ConnID:        sc.ConnID,
 		MediaStreamId: data.MediaStreamID,
 		Motion:        data.Motion,
 	}
 
 	return nil
 }
+
+func statsSubscribe(data *socketValidation.StatsSubscribe, h handler, sc socketContext) error {
+	h.VideoServer.StatsSubscription <- videoServer.StatsSubscription{
+		ConnID:    sc.ConnID,
+		Subscribe: true,
+	}
+
+	return nil
+}
+
+func statsUnsubscribe(data *socketValidation.StatsUnsubscribe, h handler, sc socketContext) error {
+	h.VideoServer.StatsSubscription <- videoServer.StatsSubscription{
+		ConnID:    sc.ConnID,
+		Subscribe: false,
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
+	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
+	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/sso"
+)
+
+const ssoStateCookie = "oidc_state"
+
+// Lets the client know whether to show the single sign-on button
+func (h handler) GetSSO(ctx *fiber.Ctx) error {
+	if b, err := json.Marshal(map[string]bool{"enabled": h.SSO != nil}); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// Redirects the browser to the identity provider
+func (h handler) SSOLogin(ctx *fiber.Ctx) error {
+	if h.SSO == nil {
+		return fiber.NewError(fiber.StatusNotFound, "Single sign-on is not enabled")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	state, url, err := h.SSO.Begin(rctx)
+	if err != nil {
+		log.Println("Failed to start single sign-on:", err)
+		return fiber.NewError(fiber.StatusBadGateway, "Failed to reach the identity provider")
+	}
+
+	// Lax rather than Strict, since the callback is a redirect from the identity provider
+	ctx.Cookie(&fiber.Cookie{
+		Name:     ssoStateCookie,
+		Value:    state,
+		Expires:  time.Now().Add(time.Minute * 10),
+		MaxAge:   600,
+		Secure:   os.Getenv("ENVIRONMENT") == "PRODUCTION",
+		HTTPOnly: true,
+		SameSite: "Lax",
+		Path:     "/api/auth/oidc",
+	})
+
+	return ctx.Redirect(url, fiber.StatusFound)
+}
+
+// The identity provider redirects back here. Creates the user on their first login and
+// updates their role from their groups on every login, then redirects to the client.
+func (h handler) SSOCallback(ctx *fiber.Ctx) error {
+	if h.SSO == nil {
+		return fiber.NewError(fiber.StatusNotFound, "Single sign-on is not enabled")
+	}
+
+	state := ctx.Query("state")
+	ctx.ClearCookie(ssoStateCookie)
+	if errParam := ctx.Query("error"); errParam != "" {
+		return fiber.NewError(fiber.StatusUnauthorized, "Login was refused by the identity provider: "+errParam)
+	}
+	// the state has to match the cookie, so that someone can't log a victim into their own account
+	if state == "" || state != ctx.Cookies(ssoStateCookie) {
+		return fiber.NewError(fiber.StatusBadRequest, "Login expired, try again")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	identity, err := h.SSO.Complete(rctx, state, ctx.Query("code"))
+	if err != nil {
+		if err == sso.ErrUnknownState {
+			return fiber.NewError(fiber.StatusBadRequest, "Login expired, try again")
+		}
+		log.Println("Failed to complete single sign-on:", err)
+		return fiber.NewError(fiber.StatusUnauthorized, "Failed to verify login with the identity provider")
+	}
+	if identity.Role == "" || !authHelpers.IsRole(identity.Role) {
+		audit.Record(h.Pool, audit.Entry{
+			Action:  audit.ActionLoginFailed,
+			Target:  identity.Username,
+			IP:      ctx.IP(),
+			Details: map[string]interface{}{"method": "oidc", "reason": "no role"},
+		})
+		return fiber.NewError(fiber.StatusForbidden, "You are not in any group that is allowed to use this server")
+	}
+
+	id, created, err := h.provisionSSOUser(rctx, identity)
+	if err != nil {
+		log.Println("Failed to provision single sign-on user:", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: id,
+		Action:  audit.ActionLoginSucceeded,
+		Target:  identity.Username,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{"method": "oidc", "created": created},
+	})
+
+	cookies, err := authHelpers.AuthorizeLogin(h.SessionStore, h.KeyRing, rctx, id, authHelpers.GetClient(ctx, "Single sign-on"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	for _, cookie := range cookies {
+		ctx.Cookie(cookie)
+	}
+
+	return ctx.Redirect(h.SSO.Config.ClientRedirect, fiber.StatusFound)
+}
+
+var invalidUsernameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Returns the uid of the users streamer, and whether the user was created
+func (h handler) provisionSSOUser(rctx context.Context, identity sso.Identity) (string, bool, error) {
+	tx, err := h.Pool.Begin(rctx)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback(rctx)
+
+	// the identity provider decides the role, so it is updated on every login
+	var id string
+	if err = tx.QueryRow(rctx, `
+		UPDATE users SET role = $1 WHERE oidc_subject = $2
+		RETURNING (SELECT id FROM streamers WHERE user_id = users.id);
+	`, identity.Role, identity.Subject).Scan(&id); err == nil {
+		return id, false, tx.Commit(rctx)
+	} else if err != pgx.ErrNoRows {
+		return "", false, err
+	}
+
+	if _, err = tx.Exec(rctx, `LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE;`); err != nil {
+		return "", false, err
+	}
+
+	// usernames from the identity provider might not be valid here, or might already be taken
+	base := invalidUsernameChars.ReplaceAllString(identity.Username, "")
+	if len(base) > 16 {
+		base = base[:16]
+	}
+	if len(base) < 2 {
+		base = "user"
+	}
+	name := base
+	for n := 2; ; n++ {
+		exists := false
+		if err = tx.QueryRow(rctx, `
+			SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(username) = LOWER($1));
+		`, name).Scan(&exists); err != nil {
+			return "", false, err
+		}
+		if !exists {
+			break
+		}
+		suffix := fmt.Sprintf("-%v", n)
+		if len(base)+len(suffix) > 16 {
+			name = base[:16-len(suffix)] + suffix
+		} else {
+			name = base + suffix
+		}
+	}
+
+	var userID string
+	if err = tx.QueryRow(rctx, `
+		INSERT INTO users (username,role,oidc_subject) VALUES($1,$2,$3) RETURNING id;
+	`, name, identity.Role, identity.Subject).Scan(&userID); err != nil {
+		return "", false, err
+	}
+	if err = tx.QueryRow(rctx, `
+		INSERT INTO streamers (name,user_id) VALUES($1,$2) RETURNING id;
+	`, name, userID).Scan(&id); err != nil {
+		return "", false, err
+	}
+
+	if err = tx.Commit(rctx); err != nil {
+		return "", false, err
+	}
+
+	outData := make(map[string]interface{})
+	outData["name"] = name
+	outData["id"] = id
+
+	h.SocketServer.SendDataToAll <- socketServer.SendDataToAll{
+		Data: socketMessages.ChangeData{
+			Entity: "STREAMER",
+			Method: "INSERT",
+			Data:   outData,
+		},
+		EventName: "CHANGE",
+	}
+
+	return id, true, nil
+}
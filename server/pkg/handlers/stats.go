@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"encoding/json"
+
+	"github.com/gofiber/fiber/v2"
+	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
+	videoServer "github.com/web-stuff-98/go-react-vid-streams/pkg/videoServer"
+)
+
+// the optional streamer query param selects between streams with the same name
+func (h handler) GetStreamStats(ctx *fiber.Ctx) error {
+	name := ctx.Params("name")
+	if name == "" || len(name) > 24 {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	recvChan := make(chan *socketMessages.StreamStats, 1)
+	h.VideoServer.GetStats <- videoServer.GetStats{
+		Uid:      ctx.Query("streamer", ""),
+		Name:     name,
+		RecvChan: recvChan,
+	}
+	stats := <-recvChan
+
+	close(recvChan)
+
+	if stats == nil {
+		return fiber.NewError(fiber.StatusNotFound, "No chunks have been received for this stream since the server started")
+	}
+
+	if b, err := json.Marshal(stats); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
@@ -5,13 +5,23 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
+	armServer "github.com/web-stuff-98/go-react-vid-streams/pkg/armServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
+	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/validation"
 )
 
 type OutStreamer struct {
 	Uid  string `json:"uid"`
 	Name string `json:"name"`
+	Role string `json:"role"`
+	// armed state of each stream that has a schedule or override, keyed by
+	// stream name. Streams not present are always armed.
+	Armed map[string]bool `json:"armed"`
 }
 
 func (h handler) GetStreamers(ctx *fiber.Ctx) error {
@@ -20,20 +30,35 @@ func (h handler) GetStreamers(ctx *fiber.Ctx) error {
 
 	var streamers []OutStreamer
 
+	armedChan := make(chan map[string]map[string]bool, 1)
+	h.ArmServer.GetAllArmed <- armServer.GetAllArmed{
+		RecvChan: armedChan,
+	}
+	armed := <-armedChan
+
+	close(armedChan)
+
 	if rows, err := h.Pool.Query(rctx, `
-		SELECT id,name FROM streamers;
+		SELECT streamers.id,streamers.name,users.role FROM streamers
+		INNER JOIN users ON users.id = streamers.user_id;
 	`); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 	} else {
 		defer rows.Close()
 		for rows.Next() {
-			var id, name string
-			if err = rows.Scan(&id, &name); err != nil {
+			var id, name, role string
+			if err = rows.Scan(&id, &name, &role); err != nil {
 				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 			}
+			streamerArmed, ok := armed[id]
+			if !ok {
+				streamerArmed = make(map[string]bool)
+			}
 			streamers = append(streamers, OutStreamer{
-				Uid:  id,
-				Name: name,
+				Uid:   id,
+				Name:  name,
+				Role:  role,
+				Armed: streamerArmed,
 			})
 		}
 	}
@@ -80,3 +105,56 @@ func (h handler) GetStreamer(ctx *fiber.Ctx) error {
 
 	return nil
 }
+
+// admin only. The last admin can't be demoted, otherwise nobody could manage the server.
+func (h handler) SetStreamerRole(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.SetRole{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Params("uid")
+
+	var name string
+	if err := h.Pool.QueryRow(rctx, `
+		UPDATE users SET role = $1 WHERE id = (SELECT user_id FROM streamers WHERE id = $2) AND (
+			$1 = 'admin' OR role != 'admin' OR (SELECT COUNT(*) FROM users WHERE role = 'admin') > 1
+		) RETURNING username;
+	`, body.Role, uid).Scan(&name); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return fiber.NewError(fiber.StatusBadRequest, "Streamer not found, or they are the last admin")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: ctx.Locals("uid").(string),
+		Action:  audit.ActionRoleChanged,
+		Target:  name,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{"role": body.Role},
+	})
+
+	outData := make(map[string]interface{})
+	outData["id"] = uid
+	outData["name"] = name
+	outData["role"] = body.Role
+
+	h.SocketServer.SendDataToAll <- socketServer.SendDataToAll{
+		Data: socketMessages.ChangeData{
+			Entity: "STREAMER",
+			Method: "UPDATE",
+			Data:   outData,
+		},
+		EventName: "CHANGE",
+	}
+
+	return nil
+}
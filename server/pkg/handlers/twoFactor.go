@@ -0,0 +1,366 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/validation"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const recoveryCodeCount = 10
+
+type OutTwoFactorStatus struct {
+	Enabled                bool `json:"enabled"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+	// true when the user is an admin and admins are required to use two factor authentication
+	Required bool `json:"required"`
+}
+
+type OutTwoFactorSetup struct {
+	Secret string `json:"secret"`
+	// otpauth URI for the QR code
+	URI string `json:"uri"`
+}
+
+type OutRecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (h handler) GetTwoFactor(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	out := OutTwoFactorStatus{}
+	if err := h.Pool.QueryRow(rctx, `
+		SELECT users.totp_secret IS NOT NULL,
+			(SELECT COUNT(*) FROM recovery_codes WHERE user_id = users.id AND used_at IS NULL),
+			users.role = 'admin' AND COALESCE((SELECT value::boolean FROM settings WHERE key = 'require_admin_two_factor'), FALSE)
+		FROM users
+		INNER JOIN streamers ON streamers.user_id = users.id
+		WHERE streamers.id = $1;
+	`, uid).Scan(&out.Enabled, &out.RecoveryCodesRemaining, &out.Required); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	if b, err := json.Marshal(out); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// Generates a new secret. Two factor authentication isn't enabled until a code from the
+// secret is confirmed with EnableTwoFactor.
+func (h handler) SetupTwoFactor(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	secret := authHelpers.GenerateTOTPSecret()
+
+	var username string
+	if err := h.Pool.QueryRow(rctx, `
+		UPDATE users SET totp_pending_secret = $1
+		WHERE id = (SELECT user_id FROM streamers WHERE id = $2) AND totp_secret IS NULL
+		RETURNING username;
+	`, secret, uid).Scan(&username); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return fiber.NewError(fiber.StatusBadRequest, "Two factor authentication is already enabled")
+	}
+
+	if b, err := json.Marshal(OutTwoFactorSetup{
+		Secret: secret,
+		URI:    authHelpers.TOTPProvisioningURI(secret, username),
+	}); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// Confirms the secret from SetupTwoFactor. The response contains the recovery codes,
+// which are only shown once.
+func (h handler) EnableTwoFactor(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.TwoFactorCode{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	var pending *string
+	if err := h.Pool.QueryRow(rctx, `
+		SELECT totp_pending_secret FROM users WHERE id = (SELECT user_id FROM streamers WHERE id = $1);
+	`, uid).Scan(&pending); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	if pending == nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Set up two factor authentication first")
+	}
+
+	step, ok := authHelpers.ValidateTOTP(*pending, body.Code, 0, time.Now())
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid code")
+	}
+
+	tx, err := h.Pool.Begin(rctx)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	defer tx.Rollback(rctx)
+
+	var userID string
+	if err = tx.QueryRow(rctx, `
+		UPDATE users SET totp_secret = totp_pending_secret, totp_pending_secret = NULL, totp_last_step = $1
+		WHERE id = (SELECT user_id FROM streamers WHERE id = $2) AND totp_pending_secret = $3
+		RETURNING id;
+	`, step, uid, *pending).Scan(&userID); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return fiber.NewError(fiber.StatusBadRequest, "Set up two factor authentication first")
+	}
+
+	codes, err := replaceRecoveryCodes(rctx, tx, userID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	if err = tx.Commit(rctx); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionTwoFactorOn,
+		Target:  uid,
+		IP:      ctx.IP(),
+	})
+
+	if b, err := json.Marshal(OutRecoveryCodes{RecoveryCodes: codes}); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// Requires the password and a code, so that someone using an unattended session can't
+// turn it off. Admins can't turn it off while it is required for admins.
+func (h handler) DisableTwoFactor(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.DisableTwoFactor{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	var hash, secret *string
+	var lastStep int64
+	var required bool
+	if err := h.Pool.QueryRow(rctx, `
+		SELECT users.password_hash,users.totp_secret,users.totp_last_step,
+			users.role = 'admin' AND COALESCE((SELECT value::boolean FROM settings WHERE key = 'require_admin_two_factor'), FALSE)
+		FROM users
+		INNER JOIN streamers ON streamers.user_id = users.id
+		WHERE streamers.id = $1;
+	`, uid).Scan(&hash, &secret, &lastStep, &required); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	if secret == nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Two factor authentication isn't enabled")
+	}
+	if required {
+		return fiber.NewError(fiber.StatusForbidden, "Two factor authentication is required for admins")
+	}
+	if hash == nil || bcrypt.CompareHashAndPassword([]byte(*hash), []byte(body.Password)) != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "Incorrect password")
+	}
+
+	if ok, err := h.checkTwoFactorCode(rctx, uid, *secret, lastStep, body.Code); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid code")
+	}
+
+	tx, err := h.Pool.Begin(rctx)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	defer tx.Rollback(rctx)
+
+	if _, err = tx.Exec(rctx, `
+		UPDATE users SET totp_secret = NULL, totp_pending_secret = NULL, totp_last_step = 0
+		WHERE id = (SELECT user_id FROM streamers WHERE id = $1);
+	`, uid); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	if _, err = tx.Exec(rctx, `
+		DELETE FROM recovery_codes WHERE user_id = (SELECT user_id FROM streamers WHERE id = $1);
+	`, uid); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	if err = tx.Commit(rctx); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionTwoFactorOff,
+		Target:  uid,
+		IP:      ctx.IP(),
+	})
+
+	return nil
+}
+
+// Replaces the recovery codes, invalidating the old ones. Requires a code from the authenticator app.
+func (h handler) RegenerateRecoveryCodes(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.TwoFactorCode{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	var userID string
+	var secret *string
+	var lastStep int64
+	if err := h.Pool.QueryRow(rctx, `
+		SELECT users.id,users.totp_secret,users.totp_last_step FROM users
+		INNER JOIN streamers ON streamers.user_id = users.id
+		WHERE streamers.id = $1;
+	`, uid).Scan(&userID, &secret, &lastStep); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	if secret == nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Two factor authentication isn't enabled")
+	}
+
+	if ok, err := h.checkTwoFactorCode(rctx, uid, *secret, lastStep, body.Code); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid code")
+	}
+
+	tx, err := h.Pool.Begin(rctx)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	defer tx.Rollback(rctx)
+
+	codes, err := replaceRecoveryCodes(rctx, tx, userID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	if err = tx.Commit(rctx); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionRecoveryCodes,
+		Target:  uid,
+		IP:      ctx.IP(),
+	})
+
+	if b, err := json.Marshal(OutRecoveryCodes{RecoveryCodes: codes}); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// Checks a TOTP code, or failing that a recovery code. Accepted TOTP codes and used
+// recovery codes are recorded so that neither can be used again.
+func (h handler) checkTwoFactorCode(rctx context.Context, uid string, secret string, lastStep int64, code string) (bool, error) {
+	if step, ok := authHelpers.ValidateTOTP(secret, code, lastStep, time.Now()); ok {
+		var id string
+		if err := h.Pool.QueryRow(rctx, `
+			UPDATE users SET totp_last_step = $1
+			WHERE id = (SELECT user_id FROM streamers WHERE id = $2) AND totp_last_step < $1
+			RETURNING id;
+		`, step, uid).Scan(&id); err != nil {
+			if err != pgx.ErrNoRows {
+				return false, err
+			}
+			// the same code was used at the same time by another request
+			return false, nil
+		}
+		return true, nil
+	}
+
+	var id string
+	if err := h.Pool.QueryRow(rctx, `
+		UPDATE recovery_codes SET used_at = NOW()
+		WHERE user_id = (SELECT user_id FROM streamers WHERE id = $1) AND code_hash = $2 AND used_at IS NULL
+		RETURNING id;
+	`, uid, authHelpers.HashRecoveryCode(code)).Scan(&id); err != nil {
+		if err != pgx.ErrNoRows {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func replaceRecoveryCodes(rctx context.Context, tx pgx.Tx, userID string) ([]string, error) {
+	if _, err := tx.Exec(rctx, `DELETE FROM recovery_codes WHERE user_id = $1;`, userID); err != nil {
+		return nil, err
+	}
+	codes := authHelpers.GenerateRecoveryCodes(recoveryCodeCount)
+	for _, code := range codes {
+		if _, err := tx.Exec(rctx, `
+			INSERT INTO recovery_codes (user_id,code_hash) VALUES($1,$2);
+		`, userID, authHelpers.HashRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/validation"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type OutUser struct {
+	ID          string    `json:"id"`
+	StreamerID  string    `json:"streamer_id"`
+	Username    string    `json:"username"`
+	Role        string    `json:"role"`
+	HasPassword bool      `json:"has_password"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type OutInvite struct {
+	ID        string     `json:"id"`
+	Role      string     `json:"role"`
+	UserID    *string    `json:"user_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+type OutCreatedInvite struct {
+	ID        string    `json:"id"`
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (h handler) ChangePassword(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.ChangePassword{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if !authHelpers.PasswordValidates(body.NewPassword) {
+		return fiber.NewError(fiber.StatusBadRequest, "Password must be between 8 and 72 characters and contain at least 3 of lowercase, uppercase, numbers and symbols")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	uid := ctx.Locals("uid").(string)
+
+	var userID string
+	var hash *string
+	if err := h.Pool.QueryRow(rctx, `
+		SELECT users.id,users.password_hash FROM users
+		INNER JOIN streamers ON streamers.user_id = users.id
+		WHERE streamers.id = $1;
+	`, uid).Scan(&userID, &hash); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+	if hash == nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid credentials")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(*hash), []byte(body.CurrentPassword)); err != nil {
+		if err != bcrypt.ErrMismatchedHashAndPassword {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid credentials")
+	}
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	if _, err = h.Pool.Exec(rctx, `
+		UPDATE users SET password_hash = $1 WHERE id = $2;
+	`, string(newHash), userID); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionPasswordChanged,
+		Target:  userID,
+		IP:      ctx.IP(),
+	})
+
+	return nil
+}
+
+func (h handler) GetUsers(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	users := []OutUser{}
+
+	if rows, err := h.Pool.Query(rctx, `
+		SELECT users.id,streamers.id,users.username,users.role,users.password_hash IS NOT NULL,users.created_at FROM users
+		INNER JOIN streamers ON streamers.user_id = users.id
+		ORDER BY users.created_at;
+	`); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			u := OutUser{}
+			if err = rows.Scan(&u.ID, &u.StreamerID, &u.Username, &u.Role, &u.HasPassword, &u.CreatedAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			users = append(users, u)
+		}
+	}
+
+	if b, err := json.Marshal(users); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+// The invite code is only returned once, only its hash is stored
+func (h handler) CreateInvite(ctx *fiber.Ctx) error {
+	v := validator.New()
+	body := &validation.CreateInvite{}
+	if err := json.Unmarshal(ctx.Body(), &body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+	if err := v.Struct(body); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+	}
+
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	lifetime := time.Hour * 24 * 7
+	if hours, err := strconv.Atoi(os.Getenv("INVITE_LIFETIME_HOURS")); err == nil && hours > 0 {
+		lifetime = time.Hour * time.Duration(hours)
+	}
+
+	code := authHelpers.GenerateToken()
+	out := OutCreatedInvite{
+		Code:      code,
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+
+	if err := h.Pool.QueryRow(rctx, `
+		INSERT INTO invites (code_hash,role,user_id,created_by,expires_at)
+		VALUES($1,$2,$3,(SELECT user_id FROM streamers WHERE id = $4),$5) RETURNING id;
+	`, authHelpers.HashToken(code), body.Role, body.UserID, ctx.Locals("uid").(string), out.ExpiresAt).Scan(&out.ID); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: ctx.Locals("uid").(string),
+		Action:  audit.ActionInviteCreated,
+		Target:  out.ID,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{"role": body.Role, "user_id": body.UserID},
+	})
+
+	if b, err := json.Marshal(out); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+func (h handler) GetInvites(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	invites := []OutInvite{}
+
+	if rows, err := h.Pool.Query(rctx, `
+		SELECT id,role,user_id,created_at,expires_at,used_at FROM invites ORDER BY created_at DESC;
+	`); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			i := OutInvite{}
+			if err = rows.Scan(&i.ID, &i.Role, &i.UserID, &i.CreatedAt, &i.ExpiresAt, &i.UsedAt); err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+			}
+			invites = append(invites, i)
+		}
+	}
+
+	if b, err := json.Marshal(invites); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	} else {
+		ctx.Response().Header.Add("Content-Type", "application/json")
+		ctx.Write(b)
+	}
+
+	return nil
+}
+
+func (h handler) DeleteInvite(ctx *fiber.Ctx) error {
+	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	var id string
+	if err := h.Pool.QueryRow(rctx, `
+		DELETE FROM invites WHERE id = $1 RETURNING id;
+	`, ctx.Params("id")).Scan(&id); err != nil {
+		if err != pgx.ErrNoRows {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+		}
+		return fiber.NewError(fiber.StatusNotFound, "Not found")
+	}
+
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: ctx.Locals("uid").(string),
+		Action:  audit.ActionInviteDeleted,
+		Target:  id,
+		IP:      ctx.IP(),
+	})
+
+	return nil
+}
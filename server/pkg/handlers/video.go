@@ -10,8 +10,12 @@ import (
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/pgtype"
 	"github.com/jackc/pgx/v5"
+	armServer "github.com/web-stuff-98/go-react-vid-streams/pkg/armServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/audit"
+	healthMonitor "github.com/web-stuff-98/go-react-vid-streams/pkg/healthMonitor"
 	"github.com/web-stuff-98/go-react-vid-streams/pkg/helpers/authHelpers"
 	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
 	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
@@ -48,9 +52,11 @@ func (h handler) DownloadStreamVideo(ctx *fiber.Ctx) error {
 
 	var size int
 	var id string
+	var dataKey []byte
+	var masterKeyID *string
 	if err = conn.QueryRow(rctx, `
-		SELECT size,id FROM vid_meta WHERE name = $1;
-	`, name).Scan(&size, &id); err != nil {
+		SELECT size,id,data_key,master_key_id FROM vid_meta WHERE name = $1;
+	`, name).Scan(&size, &id, &dataKey, &masterKeyID); err != nil {
 		if err != pgx.ErrNoRows {
 			return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 		} else {
@@ -58,10 +64,23 @@ func (h handler) DownloadStreamVideo(ctx *fiber.Ctx) error {
 		}
 	}
 
+	rec, err := h.Vault.Recording(id, dataKey, masterKeyID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
+	}
+
 	if i*SectionSize > size {
 		return fiber.NewError(fiber.StatusBadRequest, "Requested section index exceeds video size")
 	}
 
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: ctx.Locals("uid").(string),
+		Action:  audit.ActionRecordingDown,
+		Target:  name,
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{"id": id, "section": i},
+	})
+
 	ctx.Response().Header.SetContentType("video/webm")
 	ctx.Response().Header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v-%v-%v.webm"`, url.PathEscape(name), "section", iRaw))
 	if size <= SectionSize {
@@ -96,9 +115,13 @@ func (h handler) DownloadStreamVideo(ctx *fiber.Ctx) error {
 			}
 			return err
 		} else {
+			chunk, err := rec.Open(index, chunkBytes.Bytes)
+			if err != nil {
+				return err
+			}
 			index++
-			bytesDone += len(chunkBytes.Bytes)
-			if _, err = ctx.Write(chunkBytes.Bytes); err != nil {
+			bytesDone += len(chunk)
+			if _, err = ctx.Write(chunk); err != nil {
 				return err
 			}
 		}
@@ -276,12 +299,24 @@ func (h handler) HandleChunk(ctx *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "Bad request")
 	}
 
-	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
-	defer cancel()
+	uid := ctx.Locals("uid").(string)
 
-	uid, _, err := authHelpers.GetUidAndSid(h.RedisClient, ctx, rctx, h.Pool)
-	if err != nil {
-		return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+	if !canPublish(ctx.Locals("device"), streamName) {
+		return fiber.NewError(fiber.StatusForbidden, "This device can't publish to that stream")
+	}
+
+	armedChan := make(chan bool, 1)
+	h.ArmServer.GetArmed <- armServer.GetArmed{
+		Uid:      uid,
+		Name:     streamName,
+		RecvChan: armedChan,
+	}
+	armed := <-armedChan
+
+	close(armedChan)
+
+	if !armed {
+		return fiber.NewError(fiber.StatusForbidden, "Stream is disarmed")
 	}
 
 	errorChan := make(chan error, 1)
@@ -291,13 +326,18 @@ func (h handler) HandleChunk(ctx *fiber.Ctx) error {
 		Uid:       uid,
 		ErrorChan: errorChan,
 	}
-	err = <-errorChan
+	err := <-errorChan
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 	}
 
 	close(errorChan)
 
+	h.HealthMonitor.ChunkReceived <- healthMonitor.ChunkReceived{
+		Uid:  uid,
+		Name: streamName,
+	}
+
 	return nil
 }
 
@@ -305,10 +345,6 @@ func (h handler) HandleChunk(ctx *fiber.Ctx) error {
 	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
 	defer cancel()
 
-	if _, _, err := authHelpers.GetUidAndSid(h.RedisClient, ctx, rctx, h.Pool); err != nil {
-		return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
-	}
-
 	var out []string
 
 	if rows, err := h.Pool.Query(rctx, `
@@ -353,10 +389,6 @@ func (h handler) GetOldStreams(ctx *fiber.Ctx) error {
 	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
 	defer cancel()
 
-	if _, _, err := authHelpers.GetUidAndSid(h.RedisClient, ctx, rctx, h.Pool); err != nil {
-		return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
-	}
-
 	recvChan := make(chan []socketvalidation.StreamInfo, 1)
 	h.WebRTCServer.GetActiveStreams <- webRTCserver.GetActiveStreams{
 		RecvChan: recvChan,
@@ -412,13 +444,23 @@ func (h handler) GetOldStreams(ctx *fiber.Ctx) error {
 	}
 }
 
+// streamers can only delete their own streams, admins can delete any stream
 func (h handler) DeleteStream(ctx *fiber.Ctx) error {
 	rctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
 	defer cancel()
 
-	uid, _, err := authHelpers.GetUidAndSid(h.RedisClient, ctx, rctx, h.Pool)
-	if err != nil {
-		return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+	uid := ctx.Locals("uid").(string)
+
+	// admins can delete other streamers streams by passing the streamer, stream names are
+	// only unique per streamer
+	owner := ctx.Query("streamer", uid)
+	if owner != uid {
+		if ctx.Locals("role").(string) != authHelpers.RoleAdmin {
+			return fiber.NewError(fiber.StatusForbidden, "You can only delete your own streams")
+		}
+		if _, err := uuid.Parse(owner); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Bad request")
+		}
 	}
 
 	conn, err := h.Pool.Acquire(rctx)
@@ -427,19 +469,14 @@ func (h handler) DeleteStream(ctx *fiber.Ctx) error {
 	}
 	defer conn.Release()
 
-	h.WebRTCServer.DeleteStream <- webRTCserver.DeleteStream{
-		Uid:        uid,
-		StreamName: ctx.Params("name"),
-	}
-
 	var id string
 
 	if deleteStmt, err := conn.Conn().Prepare(rctx, "delete_stream_delete_stmt", `
-		DELETE FROM vid_meta WHERE LOWER(name) = LOWER($1) RETURNING id;
+		DELETE FROM vid_meta WHERE LOWER(name) = LOWER($1) AND streamer = $2 RETURNING id;
 	`); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 	} else {
-		if err = conn.Conn().QueryRow(rctx, deleteStmt.Name, ctx.Params("name")).Scan(&id); err != nil {
+		if err = conn.Conn().QueryRow(rctx, deleteStmt.Name, ctx.Params("name"), owner).Scan(&id); err != nil {
 			if err != pgx.ErrNoRows {
 				return fiber.NewError(fiber.StatusInternalServerError, "Internal error")
 			}
@@ -447,9 +484,33 @@ func (h handler) DeleteStream(ctx *fiber.Ctx) error {
 		}
 	}
 
+	audit.Record(h.Pool, audit.Entry{
+		ActorID: uid,
+		Action:  audit.ActionStreamDeleted,
+		Target:  ctx.Params("name"),
+		IP:      ctx.IP(),
+		Details: map[string]interface{}{"id": id, "owner": owner},
+	})
+
+	h.WebRTCServer.DeleteStream <- webRTCserver.DeleteStream{
+		Uid:        owner,
+		StreamName: ctx.Params("name"),
+	}
+
+	h.HealthMonitor.RemoveStream <- healthMonitor.RemoveStream{
+		Uid:  owner,
+		Name: ctx.Params("name"),
+	}
+
+	h.VideoServer.RemoveStats <- videoServer.CloseStream{
+		Uid:  owner,
+		Name: ctx.Params("name"),
+	}
+
 	outData := make(map[string]interface{})
 	outData["name"] = ctx.Params("name")
 	outData["id"] = id
+	outData["streamer_id"] = owner
 
 	h.SocketServer.SendDataToAll <- socketServer.SendDataToAll{
 		Data: socketMessages.ChangeData{
@@ -0,0 +1,398 @@
+package healthmonitor
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	armServer "github.com/web-stuff-98/go-react-vid-streams/pkg/armServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/notifier"
+	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
+	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
+)
+
+/*
+Watches every stream for signs of life. A stream whose camera still has a
+socket connection but hasn't uploaded a chunk for longer than the stalled
+threshold is flagged as stalled, and a stream whose camera hasn't sent anything
+over its socket for longer than the offline threshold is flagged as offline.
+Every state change is broadcast and outages are recorded in the database.
+
+Heartbeats come from the socket connection that published the stream, any message
+or pong from it counts. Other connections of the same user, like a dashboard left
+open in another tab, don't keep a stream alive.
+*/
+
+type HealthMonitor struct {
+	Streams Streams
+
+	// receives connection IDs
+	Heartbeat     chan string
+	ChunkReceived chan ChunkReceived
+	Joined        chan Joined
+	RemoveStream  chan RemoveStream
+	GetHealth     chan GetHealth
+}
+
+// ------ Mutex protected ------ //
+
+type Streams struct {
+	// outer map key is streamer uid, inner map key is stream name
+	data map[string]map[string]*StreamHealth
+	// last socket heartbeat for each connection ID
+	heartbeats map[string]time.Time
+	mutex      sync.RWMutex
+}
+
+// ------ Channel structs ------ //
+
+type ChunkReceived struct {
+	Uid  string
+	Name string
+}
+
+type Joined struct {
+	// the connection publishing the streams
+	ConnID string
+	Uid    string
+	Names  []string
+}
+
+type RemoveStream struct {
+	Uid  string
+	Name string
+}
+
+type GetHealth struct {
+	RecvChan chan []socketMessages.StreamHealth
+}
+
+// ------ General structs ------ //
+
+// A change in the status of a stream, the outage with EndID (if any) has ended and
+// an outage of StartKind (if any) has started
+type outageTransition struct {
+	Uid       string
+	Name      string
+	EndID     string
+	StartKind string
+}
+
+type StreamHealth struct {
+	// the connection that last published the stream
+	ConnID    string
+	Status    string
+	LastChunk time.Time
+	LastJoin  time.Time
+	OutageID  string
+}
+
+const (
+	StatusHealthy = "HEALTHY"
+	StatusStalled = "STALLED"
+	StatusOffline = "OFFLINE"
+)
+
+// ------ Initialization ------ //
+
+func Init(ss *socketServer.SocketServer, as *armServer.ArmServer, n *notifier.Notifier, db *pgxpool.Pool) *HealthMonitor {
+	hm := &HealthMonitor{
+		Streams: Streams{
+			data:       make(map[string]map[string]*StreamHealth),
+			heartbeats: make(map[string]time.Time),
+		},
+
+		// buffered, and sent to without blocking, so that socket readers are never held up
+		Heartbeat:     make(chan string, 256),
+		ChunkReceived: make(chan ChunkReceived),
+		Joined:        make(chan Joined),
+		RemoveStream:  make(chan RemoveStream),
+		GetHealth:     make(chan GetHealth),
+	}
+	closeOpenOutages(db)
+	runServer(hm, ss, as, n, db)
+	return hm
+}
+
+func runServer(hm *HealthMonitor, ss *socketServer.SocketServer, as *armServer.ArmServer, n *notifier.Notifier, db *pgxpool.Pool) {
+	go heartbeat(hm)
+	go chunkReceived(hm)
+	go joined(hm)
+	go removeStream(hm)
+	go getHealth(hm)
+	go watchForOutages(hm, ss, as, n, db)
+}
+
+// outages left open by the last run of the server can't be resolved anymore
+func closeOpenOutages(db *pgxpool.Pool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	if _, err := db.Exec(ctx, `
+		UPDATE stream_outages SET ended_at = NOW() WHERE ended_at IS NULL;
+	`); err != nil {
+		log.Fatalln("Failed to close open outages:", err)
+	}
+}
+
+// ------ Loops ------ //
+
+func heartbeat(hm *HealthMonitor) {
+	for {
+		connID := <-hm.Heartbeat
+
+		hm.Streams.mutex.Lock()
+
+		hm.Streams.heartbeats[connID] = time.Now()
+
+		hm.Streams.mutex.Unlock()
+	}
+}
+
+func chunkReceived(hm *HealthMonitor) {
+	for {
+		data := <-hm.ChunkReceived
+
+		hm.Streams.mutex.Lock()
+
+		hm.Streams.stream(data.Uid, data.Name).LastChunk = time.Now()
+
+		hm.Streams.mutex.Unlock()
+	}
+}
+
+func joined(hm *HealthMonitor) {
+	for {
+		data := <-hm.Joined
+
+		hm.Streams.mutex.Lock()
+
+		now := time.Now()
+		hm.Streams.heartbeats[data.ConnID] = now
+		for _, name := range data.Names {
+			sh := hm.Streams.stream(data.Uid, name)
+			sh.LastJoin = now
+			sh.ConnID = data.ConnID
+		}
+
+		hm.Streams.mutex.Unlock()
+	}
+}
+
+func removeStream(hm *HealthMonitor) {
+	for {
+		data := <-hm.RemoveStream
+
+		hm.Streams.mutex.Lock()
+
+		if streams, ok := hm.Streams.data[data.Uid]; ok {
+			delete(streams, data.Name)
+		}
+
+		hm.Streams.mutex.Unlock()
+	}
+}
+
+func getHealth(hm *HealthMonitor) {
+	for {
+		data := <-hm.GetHealth
+
+		hm.Streams.mutex.RLock()
+
+		out := []socketMessages.StreamHealth{}
+		for uid, streams := range hm.Streams.data {
+			for name, sh := range streams {
+				out = append(out, sh.toMessage(uid, name, hm.Streams.heartbeats[sh.ConnID]))
+			}
+		}
+
+		hm.Streams.mutex.RUnlock()
+
+		data.RecvChan <- out
+	}
+}
+
+func watchForOutages(hm *HealthMonitor, ss *socketServer.SocketServer, as *armServer.ArmServer, n *notifier.Notifier, db *pgxpool.Pool) {
+	stalledAfter := durationFromEnv("HEALTH_STALLED_AFTER", time.Second*15)
+	offlineAfter := durationFromEnv("HEALTH_OFFLINE_AFTER", time.Second*60)
+
+	for {
+		time.Sleep(time.Second * 5)
+
+		armedChan := make(chan map[string]map[string]bool, 1)
+		as.GetAllArmed <- armServer.GetAllArmed{
+			RecvChan: armedChan,
+		}
+		armed := <-armedChan
+		close(armedChan)
+
+		hm.Streams.mutex.Lock()
+
+		now := time.Now()
+		changed := []socketMessages.StreamHealth{}
+		offline := []notifier.Notification{}
+		transitions := []outageTransition{}
+		publishing := make(map[string]struct{})
+		for uid, streams := range hm.Streams.data {
+			for name, sh := range streams {
+				publishing[sh.ConnID] = struct{}{}
+				lastHeartbeat := hm.Streams.heartbeats[sh.ConnID]
+				status := StatusHealthy
+				if now.Sub(latest(lastHeartbeat, sh.LastChunk, sh.LastJoin)) > offlineAfter {
+					status = StatusOffline
+				} else if now.Sub(latest(sh.LastChunk, sh.LastJoin)) > stalledAfter {
+					// disarmed streams don't upload chunks, so they can't be stalled
+					if streamArmed, ok := armed[uid][name]; !ok || streamArmed {
+						status = StatusStalled
+					}
+				}
+				if status == sh.Status {
+					continue
+				}
+
+				transition := outageTransition{Uid: uid, Name: name, EndID: sh.OutageID}
+				if status != StatusHealthy {
+					transition.StartKind = status
+				}
+				transitions = append(transitions, transition)
+				sh.OutageID = ""
+				if status == StatusOffline {
+					offline = append(offline, notifier.Notification{
+						Event:      notifier.EventCameraOffline,
+						StreamerID: uid,
+						StreamName: name,
+					})
+				}
+
+				sh.Status = status
+				changed = append(changed, sh.toMessage(uid, name, lastHeartbeat))
+			}
+		}
+
+		// heartbeats from connections that aren't publishing anything are only kept
+		// for as long as they could make a difference
+		for connID, t := range hm.Streams.heartbeats {
+			if _, ok := publishing[connID]; !ok && now.Sub(t) > offlineAfter {
+				delete(hm.Streams.heartbeats, connID)
+			}
+		}
+
+		hm.Streams.mutex.Unlock()
+
+		// the outages are recorded after unlocking, so that a slow database doesn't hold
+		// up heartbeats
+		recordOutages(hm, db, transitions)
+
+		for _, notification := range offline {
+			n.Notify <- notification
+		}
+
+		for _, msg := range changed {
+			ss.SendDataToAll <- socketServer.SendDataToAll{
+				Data:      msg,
+				EventName: "STREAM_HEALTH",
+			}
+		}
+	}
+}
+
+// ------ Helper functions ------ //
+
+// must be called with the mutex locked
+func (s *Streams) stream(uid string, name string) *StreamHealth {
+	if _, ok := s.data[uid]; !ok {
+		s.data[uid] = make(map[string]*StreamHealth)
+	}
+	if _, ok := s.data[uid][name]; !ok {
+		s.data[uid][name] = &StreamHealth{
+			Status: StatusHealthy,
+		}
+	}
+	return s.data[uid][name]
+}
+
+func (sh *StreamHealth) toMessage(uid string, name string, lastHeartbeat time.Time) socketMessages.StreamHealth {
+	return socketMessages.StreamHealth{
+		StreamerID:    uid,
+		Name:          name,
+		Status:        sh.Status,
+		LastHeartbeat: lastHeartbeat,
+		LastChunk:     sh.LastChunk,
+		LastJoin:      sh.LastJoin,
+	}
+}
+
+func startOutage(db *pgxpool.Pool, uid string, name string, kind string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	var id string
+	if err := db.QueryRow(ctx, `
+		INSERT INTO stream_outages (streamer,stream_name,kind) VALUES($1,$2,$3) RETURNING id;
+	`, uid, name, kind).Scan(&id); err != nil {
+		log.Println("Failed to record outage:", err)
+	}
+	return id
+}
+
+func endOutage(db *pgxpool.Pool, id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	if _, err := db.Exec(ctx, `
+		UPDATE stream_outages SET ended_at = NOW() WHERE id = $1;
+	`, id); err != nil {
+		log.Println("Failed to record end of outage:", err)
+	}
+}
+
+// Must be called with the mutex unlocked. Only watchForOutages changes the status of a
+// stream, but the stream can be removed, and added again, while the outage is recorded.
+func recordOutages(hm *HealthMonitor, db *pgxpool.Pool, transitions []outageTransition) {
+	for _, t := range transitions {
+		if t.EndID != "" {
+			endOutage(db, t.EndID)
+		}
+		if t.StartKind == "" {
+			continue
+		}
+		id := startOutage(db, t.Uid, t.Name, t.StartKind)
+		if id == "" {
+			continue
+		}
+
+		hm.Streams.mutex.Lock()
+		sh, ok := hm.Streams.data[t.Uid][t.Name]
+		ok = ok && sh.Status == t.StartKind && sh.OutageID == ""
+		if ok {
+			sh.OutageID = id
+		}
+		hm.Streams.mutex.Unlock()
+
+		if !ok {
+			endOutage(db, id)
+		}
+	}
+}
+
+func latest(times ...time.Time) time.Time {
+	var out time.Time
+	for _, t := range times {
+		if t.After(out) {
+			out = t
+		}
+	}
+	return out
+}
+
+// reads a number of seconds from an environment variable
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv(key)); err == nil && seconds > 0 {
+		return time.Second * time.Duration(seconds)
+	}
+	return fallback
+}
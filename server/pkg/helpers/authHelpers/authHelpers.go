@@ -2,47 +2,85 @@ package authHelpers
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/redis/go-redis/v9"
+	keyRing "github.com/web-stuff-98/go-react-vid-streams/pkg/keyRing"
+	sessionStore "github.com/web-stuff-98/go-react-vid-streams/pkg/sessionStore"
 )
 
-func createCookie(token string, expiry time.Time) *fiber.Cookie {
+// The access token is a short lived JWT identifying the session. The refresh token is
+// a long lived opaque token that is rotated every time it is used, it is only sent to
+// the auth routes.
+const (
+	accessCookieName  = "session_token"
+	refreshCookieName = "refresh_token"
+)
+
+// JWTs are only accepted for the purpose they were issued for
+const (
+	accessAudience    = "access"
+	challengeAudience = "login_challenge"
+)
+
+func accessTokenLifetime() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_LIFETIME_SECONDS")); err == nil && seconds > 0 {
+		return time.Second * time.Duration(seconds)
+	}
+	return time.Minute * 2
+}
+
+func refreshTokenLifetime() time.Duration {
+	if hours, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_LIFETIME_HOURS")); err == nil && hours > 0 {
+		return time.Hour * time.Duration(hours)
+	}
+	return time.Hour * 24 * 30
+}
+
+func createCookie(name, value, path string, lifetime time.Duration) *fiber.Cookie {
 	return &fiber.Cookie{
-		Name:     "session_token",
-		Value:    token,
-		Expires:  expiry,
-		MaxAge:   120,
+		Name:     name,
+		Value:    value,
+		Expires:  time.Now().Add(lifetime),
+		MaxAge:   int(lifetime.Seconds()),
 		Secure:   os.Getenv("ENVIRONMENT") == "PRODUCTION",
 		HTTPOnly: true,
 		SameSite: "Strict",
-		Path:     "/",
+		Path:     path,
 	}
 }
 
-func GetClearedCookie() *fiber.Cookie {
+func clearedCookie(name, path string) *fiber.Cookie {
 	return &fiber.Cookie{
-		Name:     "session_token",
+		Name:     name,
 		Value:    "",
 		Expires:  time.Unix(0, 0),
 		MaxAge:   -1,
 		Secure:   os.Getenv("ENVIRONMENT") == "PRODUCTION",
 		HTTPOnly: true,
 		SameSite: "Strict",
-		Path:     "/",
+		Path:     path,
+	}
+}
+
+func GetClearedCookies() []*fiber.Cookie {
+	return []*fiber.Cookie{
+		clearedCookie(accessCookieName, "/"),
+		clearedCookie(refreshCookieName, "/api/auth"),
 	}
 }
 
-// not being used - streamers don't have password anymore
 // copied the regex from some stack overflow post. Same validation as with client.
-/*func PasswordValidates(pass string) bool {
+func PasswordValidates(pass string) bool {
 	count := 0
 	if 8 <= len(pass) && len(pass) <= 72 {
 		if matched, _ := regexp.MatchString(".*\\d.*", pass); matched {
@@ -59,68 +97,155 @@ func GetClearedCookie() *fiber.Cookie {
 		}
 	}
 	return count >= 3
-}*/
+}
+
+// Creates a session in the session store. Returns the cookies for the access token,
+// which is a JWT containing the session ID, and the refresh token.
+func AuthorizeLogin(store sessionStore.SessionStore, kr *keyRing.KeyRing, ctx context.Context, uid string, client sessionStore.Client) ([]*fiber.Cookie, error) {
+	s := sessionStore.Session{
+		Sid:       uuid.New().String(),
+		Uid:       uid,
+		CreatedAt: time.Now(),
+		Client:    client,
+	}
+	return issueTokens(store, kr, ctx, s)
+}
 
-// Creates the session ID on redis and encodes it as a JWT into a cookie
-func AuthorizeLogin(redisClient *redis.Client, ctx context.Context, uid string) (*fiber.Cookie, error) {
-	sid := uuid.New()
-	sessionDuration := time.Minute * 2
+// Rotates the refresh token and signs a new access token for the session. The session
+// expires if the refresh token isn't used within the refresh token lifetime.
+func issueTokens(store sessionStore.SessionStore, kr *keyRing.KeyRing, ctx context.Context, s sessionStore.Session) ([]*fiber.Cookie, error) {
+	accessLifetime := accessTokenLifetime()
+	refreshLifetime := refreshTokenLifetime()
 
-	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
-		Issuer:    sid.String(),
-		ExpiresAt: time.Now().Add(sessionDuration).Unix(),
+	token, err := kr.Sign(jwt.RegisteredClaims{
+		ID:        s.Sid,
+		Audience:  jwt.ClaimStrings{accessAudience},
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessLifetime)),
 	})
-	token, err := claims.SignedString([]byte(os.Getenv("SECRET")))
 	if err != nil {
-		log.Fatalln("Error in Authorize helper function generating token:", err)
+		return nil, err
 	}
-	cookie := createCookie(token, time.Now().Add(sessionDuration))
 
-	cmd := redisClient.Set(ctx, sid.String(), uid, sessionDuration)
-	if cmd.Err() != nil {
-		log.Fatalln("Redis error in Authorize helper function:", cmd.Err())
+	// the session ID is included so that a reused refresh token can be traced back to its session
+	refreshToken := s.Sid + "." + GenerateToken()
+	s.RefreshHash = HashToken(refreshToken)
+	s.ExpiresAt = time.Now().Add(refreshLifetime)
+	s.LastSeenAt = time.Now()
+
+	if err := store.Set(ctx, s); err != nil {
+		return nil, err
 	}
 
-	return cookie, nil
+	return []*fiber.Cookie{
+		createCookie(accessCookieName, token, "/", accessLifetime),
+		createCookie(refreshCookieName, refreshToken, "/api/auth", refreshLifetime),
+	}, nil
+}
+
+// Describes the client making the request, the label is given by the client when logging in
+func GetClient(ctx *fiber.Ctx, label string) sessionStore.Client {
+	userAgent := ctx.Get(fiber.HeaderUserAgent)
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+	return sessionStore.Client{
+		Label:     label,
+		IP:        ctx.IP(),
+		UserAgent: userAgent,
+	}
 }
 
-// Decrypt the JWT stored inside the cookie, queries the db for the user ID and returns the user ID and session ID
-// if the client has not logged in as a streamer yet but logged into the server then the uid will be an empty string
-func GetUidAndSid(redisClient *redis.Client, ctx *fiber.Ctx, rctx context.Context, db *pgxpool.Pool) (uid string, sid string, err error) {
-	cookie := string(ctx.Request().Header.Cookie("session_token"))
+// Verifies the access token JWT stored inside the cookie, and looks up the session it belongs to.
+// Returns the user ID and session ID.
+func GetUidAndSid(store sessionStore.SessionStore, kr *keyRing.KeyRing, ctx *fiber.Ctx, rctx context.Context) (uid string, sid string, err error) {
+	cookie := string(ctx.Request().Header.Cookie(accessCookieName))
 	if cookie == "" {
 		return "", "", fmt.Errorf("No cookie")
 	}
 
-	token, err := jwt.ParseWithClaims(cookie, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("SECRET")), nil
-	})
-	sessionID := token.Claims.(*jwt.StandardClaims).Issuer
+	claims := &jwt.RegisteredClaims{}
+	if err := kr.Parse(cookie, claims, accessAudience); err != nil {
+		return "", "", fmt.Errorf("Invalid token: %w", err)
+	}
+	sessionID := claims.ID
 	if sessionID == "" {
 		return "", "", fmt.Errorf("Empty value")
 	}
-	val, err := redisClient.Get(rctx, sessionID).Result()
+	session, err := store.Get(rctx, sessionID)
 	if err != nil {
 		return "", "", fmt.Errorf("Error retrieving session")
 	}
 
-	return val, sessionID, nil
+	return session.Uid, sessionID, nil
+}
+
+// The login challenge is given out after the password has been checked for accounts
+// with two factor authentication, and is exchanged for a session along with a code.
+func CreateLoginChallenge(kr *keyRing.KeyRing, uid string) (string, error) {
+	return kr.Sign(jwt.RegisteredClaims{
+		Subject:   uid,
+		Audience:  jwt.ClaimStrings{challengeAudience},
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 5)),
+	})
 }
 
-func RefreshToken(redisClient *redis.Client, ctx *fiber.Ctx, rctx context.Context, db *pgxpool.Pool) (*fiber.Cookie, error) {
-	if uid, sid, err := GetUidAndSid(redisClient, ctx, rctx, db); err != nil {
-		return GetClearedCookie(), err
+func ParseLoginChallenge(kr *keyRing.KeyRing, challenge string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	if err := kr.Parse(challenge, claims, challengeAudience); err != nil || claims.Subject == "" {
+		return "", fmt.Errorf("Invalid challenge")
+	}
+	return claims.Subject, nil
+}
+
+var ErrRefreshTokenReused = errors.New("Refresh token reused")
+
+// how long the refresh token replaced by the current one can still be used
+const refreshReuseGrace = time.Second * 30
+
+// Exchanges the refresh token for a new access token and refresh token. Refresh tokens
+// can only be used once, apart from the previous one during a short grace period. If an
+// older refresh token is presented it has most likely been stolen, ErrRefreshTokenReused
+// is returned along with the session ID, and the caller should revoke the session.
+func RefreshToken(store sessionStore.SessionStore, kr *keyRing.KeyRing, ctx *fiber.Ctx, rctx context.Context) (cookies []*fiber.Cookie, sid string, err error) {
+	refreshToken := string(ctx.Request().Header.Cookie(refreshCookieName))
+	sid, _, ok := strings.Cut(refreshToken, ".")
+	if !ok || sid == "" {
+		return GetClearedCookies(), "", fmt.Errorf("No refresh token")
+	}
+
+	session, err := store.Get(rctx, sid)
+	if err != nil {
+		return GetClearedCookies(), "", err
+	}
+
+	hash := []byte(HashToken(refreshToken))
+	current := subtle.ConstantTimeCompare(hash, []byte(session.RefreshHash)) == 1
+	previous := session.PreviousRefreshHash != "" &&
+		time.Since(session.RotatedAt) < refreshReuseGrace &&
+		subtle.ConstantTimeCompare(hash, []byte(session.PreviousRefreshHash)) == 1
+	if !current && !previous {
+		return GetClearedCookies(), sid, ErrRefreshTokenReused
+	}
+
+	// the token being replaced is always the current one, so a client using the previous
+	// token can't make the token another client has just received unusable
+	session.PreviousRefreshHash = session.RefreshHash
+	session.RotatedAt = time.Now()
+
+	// the label given at login is kept, the rest is updated in case the client moved networks
+	client := GetClient(ctx, session.Label)
+	session.Client = client
+
+	if cookies, err := issueTokens(store, kr, rctx, session); err != nil {
+		return GetClearedCookies(), sid, err
 	} else {
-		redisClient.Del(rctx, sid)
-		if cookie, err := AuthorizeLogin(redisClient, rctx, uid); err != nil {
-			return GetClearedCookie(), err
-		} else {
-			return cookie, nil
-		}
+		return cookies, sid, nil
 	}
 }
 
 // kind of useless verbose function
-func DeleteSession(redisClient *redis.Client, ctx context.Context, sid string) {
-	redisClient.Del(ctx, sid)
+func DeleteSession(store sessionStore.SessionStore, ctx context.Context, sid string) {
+	store.Delete(ctx, sid)
 }
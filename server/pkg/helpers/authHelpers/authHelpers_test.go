@@ -0,0 +1,258 @@
+package authHelpers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	keyRing "github.com/web-stuff-98/go-react-vid-streams/pkg/keyRing"
+	sessionStore "github.com/web-stuff-98/go-react-vid-streams/pkg/sessionStore"
+)
+
+// Responds with the uid and sid separated by a space, or 401 with the error
+func getUidAndSidApp(store sessionStore.SessionStore, kr *keyRing.KeyRing) *fiber.App {
+	app := fiber.New()
+	app.Get("/", func(ctx *fiber.Ctx) error {
+		uid, sid, err := GetUidAndSid(store, kr, ctx, context.Background())
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+		}
+		return ctx.SendString(uid + " " + sid)
+	})
+	return app
+}
+
+func TestGetUidAndSid(t *testing.T) {
+	insideGrace := time.Now().Add(-time.Minute * 30)
+	outsideGrace := time.Now().Add(-time.Minute * 90)
+	current := keyRing.Key{ID: "current", Secret: []byte("current secret"), CreatedAt: time.Now().Add(-time.Hour)}
+	recent := keyRing.Key{ID: "recent", Secret: []byte("recent secret"), CreatedAt: time.Now().Add(-time.Hour * 25), RetiredAt: &insideGrace}
+	old := keyRing.Key{ID: "old", Secret: []byte("old secret"), CreatedAt: time.Now().Add(-time.Hour * 49), RetiredAt: &outsideGrace}
+	kr := keyRing.New([]keyRing.Key{current, recent, old}, time.Hour*24, time.Hour)
+
+	store := sessionStore.NewMemoryStore("")
+	cookies, err := AuthorizeLogin(store, kr, context.Background(), "uid", sessionStore.Client{})
+	if err != nil {
+		t.Fatalf("AuthorizeLogin: %v", err)
+	}
+	var accessToken string
+	for _, c := range cookies {
+		if c.Name == accessCookieName {
+			accessToken = c.Value
+		}
+	}
+	claims := &jwt.RegisteredClaims{}
+	if err = kr.Parse(accessToken, claims, accessAudience); err != nil {
+		t.Fatalf("parsing issued access token: %v", err)
+	}
+	sid := claims.ID
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, modify func(c *jwt.RegisteredClaims)) string {
+		c := jwt.RegisteredClaims{
+			ID:        sid,
+			Audience:  jwt.ClaimStrings{accessAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		}
+		if modify != nil {
+			modify(&c)
+		}
+		token := jwt.NewWithClaims(method, c)
+		token.Header["kid"] = kid
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("signing test token: %v", err)
+		}
+		return s
+	}
+	challenge, err := CreateLoginChallenge(kr, "uid")
+	if err != nil {
+		t.Fatalf("CreateLoginChallenge: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		// nil for no cookie at all
+		cookie  *string
+		wantErr bool
+	}{
+		{"issued by AuthorizeLogin", &accessToken, false},
+		{"no cookie", nil, true},
+		{"empty", ptr(""), true},
+		{"garbage", ptr("garbage"), true},
+		{"garbage segments", ptr("e30.e30.e30"), true},
+		{"truncated", ptr(accessToken[:len(accessToken)-4]), true},
+		{"alg none", ptr(sign(jwt.SigningMethodNone, current.ID, jwt.UnsafeAllowNoneSignatureType, nil)), true},
+		{"alg RS256", ptr(sign(jwt.SigningMethodRS256, current.ID, rsaKey, nil)), true},
+		{"unknown kid", ptr(sign(jwt.SigningMethodHS256, "unknown", current.Secret, nil)), true},
+		{"wrong aud", ptr(challenge), true},
+		{"no exp", ptr(sign(jwt.SigningMethodHS256, current.ID, current.Secret, func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = nil
+		})), true},
+		{"expired", ptr(sign(jwt.SigningMethodHS256, current.ID, current.Secret, func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Second * 10))
+		})), true},
+		{"no session ID", ptr(sign(jwt.SigningMethodHS256, current.ID, current.Secret, func(c *jwt.RegisteredClaims) {
+			c.ID = ""
+		})), true},
+		{"session that doesn't exist", ptr(sign(jwt.SigningMethodHS256, current.ID, current.Secret, func(c *jwt.RegisteredClaims) {
+			c.ID = "not a session"
+		})), true},
+		{"retired key inside the grace period", ptr(sign(jwt.SigningMethodHS256, recent.ID, recent.Secret, nil)), false},
+		{"retired key outside the grace period", ptr(sign(jwt.SigningMethodHS256, old.ID, old.Secret, nil)), true},
+	}
+
+	app := getUidAndSidApp(store, kr)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.cookie != nil {
+				req.AddCookie(&http.Cookie{Name: accessCookieName, Value: *tt.cookie})
+			}
+			res, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("request: %v", err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+
+			if tt.wantErr {
+				if res.StatusCode != http.StatusUnauthorized {
+					t.Errorf("status = %v (%s), want 401", res.StatusCode, body)
+				}
+				return
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %v (%s), want 200", res.StatusCode, body)
+			}
+			if got, want := string(body), "uid "+sid; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseLoginChallenge(t *testing.T) {
+	current := keyRing.Key{ID: "current", Secret: []byte("current secret"), CreatedAt: time.Now()}
+	kr := keyRing.New([]keyRing.Key{current}, time.Hour*24, time.Hour)
+
+	challenge, err := CreateLoginChallenge(kr, "uid")
+	if err != nil {
+		t.Fatalf("CreateLoginChallenge: %v", err)
+	}
+	if uid, err := ParseLoginChallenge(kr, challenge); err != nil || uid != "uid" {
+		t.Errorf("ParseLoginChallenge = %q, %v", uid, err)
+	}
+
+	// access tokens can't be used as challenges
+	store := sessionStore.NewMemoryStore("")
+	cookies, err := AuthorizeLogin(store, kr, context.Background(), "uid", sessionStore.Client{})
+	if err != nil {
+		t.Fatalf("AuthorizeLogin: %v", err)
+	}
+	for _, c := range cookies {
+		if c.Name == accessCookieName {
+			if _, err := ParseLoginChallenge(kr, c.Value); err == nil {
+				t.Error("an access token was accepted as a login challenge")
+			}
+		}
+	}
+
+	for _, garbage := range []string{"", "garbage", strings.Repeat("a.", 2) + "a"} {
+		if _, err := ParseLoginChallenge(kr, garbage); err == nil {
+			t.Errorf("ParseLoginChallenge(%q) succeeded", garbage)
+		}
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func TestRefreshToken(t *testing.T) {
+	kr := keyRing.New([]keyRing.Key{{ID: "current", Secret: []byte("current secret"), CreatedAt: time.Now()}}, time.Hour*24, time.Hour)
+	store := sessionStore.NewMemoryStore("")
+
+	// responds with the new refresh token, or 401 with the sid when a token is reused
+	app := fiber.New()
+	app.Post("/", func(ctx *fiber.Ctx) error {
+		cookies, sid, err := RefreshToken(store, kr, ctx, context.Background())
+		if err == ErrRefreshTokenReused {
+			return fiber.NewError(fiber.StatusUnauthorized, "reused "+sid)
+		} else if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+		}
+		for _, c := range cookies {
+			if c.Name == refreshCookieName {
+				return ctx.SendString(c.Value)
+			}
+		}
+		return fiber.ErrInternalServerError
+	})
+	refresh := func(token string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.AddCookie(&http.Cookie{Name: refreshCookieName, Value: token})
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	cookies, err := AuthorizeLogin(store, kr, context.Background(), "uid", sessionStore.Client{})
+	if err != nil {
+		t.Fatalf("AuthorizeLogin: %v", err)
+	}
+	var first string
+	for _, c := range cookies {
+		if c.Name == refreshCookieName {
+			first = c.Value
+		}
+	}
+	sid, _, _ := strings.Cut(first, ".")
+
+	status, second := refresh(first)
+	if status != http.StatusOK {
+		t.Fatalf("refreshing with the current token: %v %v", status, second)
+	}
+	// another tab refreshing with the same token at the same time
+	status, third := refresh(first)
+	if status != http.StatusOK {
+		t.Fatalf("refreshing with the previous token inside the grace period: %v %v", status, third)
+	}
+	// the first tabs response might arrive last, so its token has to keep working
+	status, fourth := refresh(second)
+	if status != http.StatusOK {
+		t.Fatalf("refreshing with the token replaced by the other tab: %v %v", status, fourth)
+	}
+	if status, body := refresh(first); status != http.StatusUnauthorized || body != "reused "+sid {
+		t.Errorf("refreshing with an older token: %v %v, want reuse of %v", status, body, sid)
+	}
+
+	session, err := store.Get(context.Background(), sid)
+	if err != nil {
+		t.Fatalf("getting session: %v", err)
+	}
+	session.RotatedAt = time.Now().Add(-refreshReuseGrace)
+	store.Set(context.Background(), session)
+	if status, body := refresh(third); status != http.StatusUnauthorized || body != "reused "+sid {
+		t.Errorf("refreshing with the previous token after the grace period: %v %v", status, body)
+	}
+
+	if status, _ := refresh("garbage"); status != http.StatusUnauthorized {
+		t.Errorf("refreshing with garbage: %v", status)
+	}
+}
@@ -0,0 +1,52 @@
+package authHelpers
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Admins can do everything. Streamers can publish and manage their own streams.
+// Viewers can only watch.
+const (
+	RoleAdmin    = "admin"
+	RoleStreamer = "streamer"
+	RoleViewer   = "viewer"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer:   1,
+	RoleStreamer: 2,
+	RoleAdmin:    3,
+}
+
+func IsRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// Roles are hierarchical, so an admin has every permission a streamer has
+func HasRole(role string, required string) bool {
+	return roleRanks[role] >= roleRanks[required] && roleRanks[role] != 0
+}
+
+// Returns the role the user currently has permissions for. When admins are required to
+// use two factor authentication, an admin who hasn't enabled it only gets the permissions
+// of a streamer until they do. Single sign-on users are left to the identity provider.
+func GetRole(ctx context.Context, db *pgxpool.Pool, uid string) (string, error) {
+	var role string
+	var twoFactorEnabled, twoFactorRequired bool
+	if err := db.QueryRow(ctx, `
+		SELECT users.role, users.totp_secret IS NOT NULL OR users.oidc_subject IS NOT NULL,
+			COALESCE((SELECT value::boolean FROM settings WHERE key = 'require_admin_two_factor'), FALSE)
+		FROM streamers
+		INNER JOIN users ON users.id = streamers.user_id
+		WHERE streamers.id = $1;
+	`, uid).Scan(&role, &twoFactorEnabled, &twoFactorRequired); err != nil {
+		return "", err
+	}
+	if role == RoleAdmin && twoFactorRequired && !twoFactorEnabled {
+		return RoleStreamer, nil
+	}
+	return role, nil
+}
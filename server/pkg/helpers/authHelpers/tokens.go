@@ -0,0 +1,85 @@
+package authHelpers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// compared against when logging in as a user that doesn't exist, so that
+// failed logins take the same amount of time whether or not the user exists
+var DummyPasswordHash = func() string {
+	hash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalln("Failed to generate dummy password hash:", err)
+	}
+	return string(hash)
+}()
+
+// Generates a random URL safe token for invites and other one time codes.
+// Only the hash of the token should be stored.
+func GenerateToken() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalln("Failed to generate random token:", err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Device tokens are accepted as a bearer token in the Authorization header,
+// or in the token query param for clients that can't set headers (websockets)
+func GetDeviceToken(ctx *fiber.Ctx) string {
+	if header := ctx.Get(fiber.HeaderAuthorization); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return ctx.Query("token", "")
+}
+
+type Device struct {
+	ID      string
+	Uid     string
+	Streams []string
+}
+
+// Looks up an unrevoked device token and records when it was last used. Devices make a
+// request every second while uploading, so last_used_at is only written once a minute.
+func GetDevice(ctx context.Context, db *pgxpool.Pool, token string) (*Device, error) {
+	d := &Device{}
+	if err := db.QueryRow(ctx, `
+		WITH device AS (
+			SELECT id,streamer,streams,last_used_at FROM device_tokens
+			WHERE token_hash = $1 AND revoked_at IS NULL
+		), used AS (
+			UPDATE device_tokens SET last_used_at = NOW()
+			WHERE id IN (
+				SELECT id FROM device WHERE last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute'
+			)
+		)
+		SELECT id,streamer,streams FROM device;
+	`, HashToken(token)).Scan(&d.ID, &d.Uid, &d.Streams); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Device) CanPublish(name string) bool {
+	for _, s := range d.Streams {
+		if strings.EqualFold(s, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package authHelpers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// TOTP as described in RFC 6238, with the defaults every authenticator app supports:
+// SHA1, 6 digits and a 30 second period.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// codes from one step either side of the current one are accepted to allow for clock drift
+	totpSkew = 1
+)
+
+// Secrets are 20 random bytes in unpadded base32, which is what GenerateToken produces
+func GenerateTOTPSecret() string {
+	return GenerateToken()
+}
+
+// The URI that authenticator apps read from the QR code
+func TOTPProvisioningURI(secret string, username string) string {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "Vid Streams"
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	// some authenticator apps show a + in the issuer literally
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+username) + "?" + strings.ReplaceAll(params.Encode(), "+", "%20")
+}
+
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// Returns the time step the code matched, so that the caller can record it and refuse
+// the same code being used twice. Only steps after lastStep are accepted.
+func ValidateTOTP(secret string, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Recovery codes are formatted like "abcde-fghij" so that they're easy to write down
+func GenerateRecoveryCodes(n int) []string {
+	codes := make([]string, n)
+	for i := range codes {
+		token := strings.ToLower(GenerateToken())
+		codes[i] = token[:5] + "-" + token[5:10]
+	}
+	return codes
+}
+
+// Recovery codes are hashed the same way whether or not they were typed with the dash
+func HashRecoveryCode(code string) string {
+	return HashToken(strings.ReplaceAll(strings.ToLower(strings.TrimSpace(code)), "-", ""))
+}
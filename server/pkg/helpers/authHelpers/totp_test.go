@@ -0,0 +1,111 @@
+package authHelpers
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 secret from RFC 6238 appendix B, "12345678901234567890" in base32
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+// RFC 6238 appendix B SHA1 test vectors. The RFC uses 8 digits, these are the last 6.
+func TestTOTPVectors(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		step, ok := ValidateTOTP(rfcSecret, tt.code, 0, time.Unix(tt.unix, 0))
+		if !ok {
+			t.Errorf("%v: code %v rejected", tt.unix, tt.code)
+			continue
+		}
+		if step != tt.unix/totpPeriod {
+			t.Errorf("%v: matched step %v, want %v", tt.unix, step, tt.unix/totpPeriod)
+		}
+	}
+}
+
+func TestTOTPDrift(t *testing.T) {
+	// the code for step 1111111111 / 30 = 37037037
+	const code = "050471"
+	stepStart := time.Unix(37037037*totpPeriod, 0)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"same step", stepStart, true},
+		{"one step later", stepStart.Add(time.Second * totpPeriod), true},
+		{"one step earlier", stepStart.Add(-time.Second * totpPeriod), true},
+		{"two steps later", stepStart.Add(time.Second * totpPeriod * 2), false},
+		{"two steps earlier", stepStart.Add(-time.Second * totpPeriod * 2), false},
+	}
+
+	for _, tt := range tests {
+		if _, ok := ValidateTOTP(rfcSecret, code, 0, tt.now); ok != tt.want {
+			t.Errorf("%v: accepted = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestTOTPReuse(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	step, ok := ValidateTOTP(rfcSecret, "050471", 0, now)
+	if !ok {
+		t.Fatal("code rejected the first time")
+	}
+	if _, ok := ValidateTOTP(rfcSecret, "050471", step, now); ok {
+		t.Error("code accepted again after its step was recorded")
+	}
+	// a code from an earlier step inside the drift window is refused too
+	if _, ok := ValidateTOTP(rfcSecret, "081804", step, now); ok {
+		t.Error("code from before the recorded step accepted")
+	}
+	// the next step's code is still fine
+	if _, ok := ValidateTOTP(rfcSecret, totpCodeAt(t, now.Add(time.Second*totpPeriod)), step, now.Add(time.Second*totpPeriod)); !ok {
+		t.Error("code from the next step rejected")
+	}
+}
+
+func TestTOTPMalformed(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	for _, tt := range []struct {
+		secret string
+		code   string
+	}{
+		{rfcSecret, ""},
+		{rfcSecret, "05047"},
+		{rfcSecret, "0504711"},
+		{"not base32!", "050471"},
+	} {
+		if _, ok := ValidateTOTP(tt.secret, tt.code, 0, now); ok {
+			t.Errorf("ValidateTOTP(%q, %q) accepted", tt.secret, tt.code)
+		}
+	}
+	// surrounding whitespace and a lowercase secret are fine
+	if _, ok := ValidateTOTP(strings.ToLower(rfcSecret), " 050471 ", 0, now); !ok {
+		t.Error("code with surrounding whitespace or lowercase secret rejected")
+	}
+}
+
+func totpCodeAt(t *testing.T, now time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, now.Unix()/totpPeriod)
+}
@@ -0,0 +1,242 @@
+package keyring
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Keys for signing JWTs. Every token is signed with the current key and carries its
+key ID in the kid header. The current key is replaced on a schedule, and the keys
+it replaced are still accepted for a grace period so that tokens signed just before
+a rotation stay valid until they expire. Keys are kept in the database so that
+restarting the server doesn't invalidate every token.
+
+The grace period should be longer than the longest lived token, which is the access
+token (see ACCESS_TOKEN_LIFETIME_SECONDS).
+*/
+
+type KeyRing struct {
+	keys        map[string]Key
+	current     string
+	mutex       sync.RWMutex
+	rotateEvery time.Duration
+	grace       time.Duration
+}
+
+type Key struct {
+	ID        string
+	Secret    []byte
+	CreatedAt time.Time
+	// nil for the current key
+	RetiredAt *time.Time
+}
+
+var ErrUnknownKey = errors.New("Unknown signing key")
+
+// Only HMAC SHA256 is ever used, tokens claiming any other algorithm are rejected
+var signingMethod = jwt.SigningMethodHS256
+
+func Init(db *pgxpool.Pool) *KeyRing {
+	kr := New(nil,
+		time.Hour*time.Duration(intFromEnv("SIGNING_KEY_ROTATION_HOURS", 24)),
+		time.Minute*time.Duration(intFromEnv("SIGNING_KEY_GRACE_MINUTES", 60)),
+	)
+	kr.load(db)
+	if kr.current == "" {
+		if err := kr.rotate(db); err != nil {
+			log.Fatalln("Failed to create signing key:", err)
+		}
+	}
+	go kr.watchRotation(db)
+	return kr
+}
+
+// Builds a key ring from keys that have already been loaded, without rotating them. The
+// newest key that hasn't been retired is the current key.
+func New(keys []Key, rotateEvery time.Duration, grace time.Duration) *KeyRing {
+	kr := &KeyRing{
+		keys:        make(map[string]Key),
+		rotateEvery: rotateEvery,
+		grace:       grace,
+	}
+	for _, k := range keys {
+		kr.add(k)
+	}
+	return kr
+}
+
+// Signs the claims with the current key
+func (kr *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	kr.mutex.RLock()
+	key := kr.keys[kr.current]
+	kr.mutex.RUnlock()
+
+	token := jwt.NewWithClaims(signingMethod, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Secret)
+}
+
+// Verifies the signature, algorithm, audience and expiry of the token and decodes it into claims.
+// Tokens without an expiry are rejected.
+func (kr *KeyRing) Parse(tokenString string, claims jwt.Claims, audience string) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, kr.keyFunc,
+		jwt.WithValidMethods([]string{signingMethod.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithAudience(audience),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return err
+	}
+	if !token.Valid {
+		return jwt.ErrTokenSignatureInvalid
+	}
+	return nil
+}
+
+func (kr *KeyRing) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, ok := t.Header["kid"].(string)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	kr.mutex.RLock()
+	key, ok := kr.keys[kid]
+	kr.mutex.RUnlock()
+
+	if !ok || (key.RetiredAt != nil && time.Since(*key.RetiredAt) > kr.grace) {
+		return nil, ErrUnknownKey
+	}
+	return key.Secret, nil
+}
+
+func (kr *KeyRing) load(db *pgxpool.Pool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	rows, err := db.Query(ctx, `
+		SELECT id,secret,created_at,retired_at FROM signing_keys
+		WHERE retired_at IS NULL OR retired_at > $1;
+	`, time.Now().Add(-kr.grace))
+	if err != nil {
+		log.Fatalln("Failed to load signing keys:", err)
+	}
+	defer rows.Close()
+
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+
+	for rows.Next() {
+		k := Key{}
+		if err = rows.Scan(&k.ID, &k.Secret, &k.CreatedAt, &k.RetiredAt); err != nil {
+			log.Fatalln("Failed to load signing keys:", err)
+		}
+		kr.add(k)
+	}
+}
+
+// must be called with the mutex locked, or before the key ring is shared
+func (kr *KeyRing) add(k Key) {
+	kr.keys[k.ID] = k
+	if k.RetiredAt == nil && (kr.current == "" || k.CreatedAt.After(kr.keys[kr.current].CreatedAt)) {
+		kr.current = k.ID
+	}
+}
+
+// Creates a new current key and retires the old one
+func (kr *KeyRing) rotate(db *pgxpool.Pool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	k := Key{
+		ID:        hex.EncodeToString(id),
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, `
+		UPDATE signing_keys SET retired_at = $1 WHERE retired_at IS NULL;
+	`, k.CreatedAt); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO signing_keys (id,secret,created_at) VALUES($1,$2,$3);
+	`, k.ID, k.Secret, k.CreatedAt); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM signing_keys WHERE retired_at < $1;
+	`, k.CreatedAt.Add(-kr.grace)); err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+
+	for id, old := range kr.keys {
+		if old.RetiredAt == nil {
+			retiredAt := k.CreatedAt
+			old.RetiredAt = &retiredAt
+			kr.keys[id] = old
+		} else if k.CreatedAt.Sub(*old.RetiredAt) > kr.grace {
+			delete(kr.keys, id)
+		}
+	}
+	kr.keys[k.ID] = k
+	kr.current = k.ID
+
+	return nil
+}
+
+func (kr *KeyRing) watchRotation(db *pgxpool.Pool) {
+	for {
+		time.Sleep(time.Minute)
+
+		kr.mutex.RLock()
+		due := time.Since(kr.keys[kr.current].CreatedAt) > kr.rotateEvery
+		kr.mutex.RUnlock()
+
+		if due {
+			if err := kr.rotate(db); err != nil {
+				log.Println("Failed to rotate signing key:", err)
+			} else {
+				log.Println("Rotated signing key")
+			}
+		}
+	}
+}
+
+func intFromEnv(key string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
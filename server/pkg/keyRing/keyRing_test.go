@@ -0,0 +1,143 @@
+package keyring
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testAudience = "access"
+
+func testKey(id string, retiredAgo *time.Duration) Key {
+	k := Key{
+		ID:        id,
+		Secret:    []byte("secret for key " + id),
+		CreatedAt: time.Now().Add(-time.Hour * 48),
+	}
+	if retiredAgo != nil {
+		retiredAt := time.Now().Add(-*retiredAgo)
+		k.RetiredAt = &retiredAt
+	}
+	return k
+}
+
+func validClaims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		ID:        "sid",
+		Audience:  jwt.ClaimStrings{testAudience},
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("signing test token: %v", err)
+	}
+	return s
+}
+
+func TestParse(t *testing.T) {
+	insideGrace := time.Minute * 30
+	outsideGrace := time.Minute * 90
+	current := testKey("current", nil)
+	recent := testKey("recent", &insideGrace)
+	old := testKey("old", &outsideGrace)
+	kr := New([]Key{current, recent, old}, time.Hour*24, time.Hour)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+
+	withClaims := func(modify func(c *jwt.RegisteredClaims)) jwt.RegisteredClaims {
+		c := validClaims()
+		modify(&c)
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", sign(t, signingMethod, current.ID, current.Secret, validClaims()), false},
+		{"empty", "", true},
+		{"garbage", "not a token", true},
+		{"garbage segments", "aaa.bbb.ccc", true},
+		{"alg none", sign(t, jwt.SigningMethodNone, current.ID, jwt.UnsafeAllowNoneSignatureType, validClaims()), true},
+		{"alg RS256", sign(t, jwt.SigningMethodRS256, current.ID, rsaKey, validClaims()), true},
+		{"alg HS512", sign(t, jwt.SigningMethodHS512, current.ID, current.Secret, validClaims()), true},
+		{"no kid", sign(t, signingMethod, "", current.Secret, validClaims()), true},
+		{"unknown kid", sign(t, signingMethod, "unknown", current.Secret, validClaims()), true},
+		{"signed with another keys secret", sign(t, signingMethod, current.ID, recent.Secret, validClaims()), true},
+		{"wrong aud", sign(t, signingMethod, current.ID, current.Secret, withClaims(func(c *jwt.RegisteredClaims) {
+			c.Audience = jwt.ClaimStrings{"refresh"}
+		})), true},
+		{"no aud", sign(t, signingMethod, current.ID, current.Secret, withClaims(func(c *jwt.RegisteredClaims) {
+			c.Audience = nil
+		})), true},
+		{"no exp", sign(t, signingMethod, current.ID, current.Secret, withClaims(func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = nil
+		})), true},
+		{"expired", sign(t, signingMethod, current.ID, current.Secret, withClaims(func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+		})), true},
+		{"issued in the future", sign(t, signingMethod, current.ID, current.Secret, withClaims(func(c *jwt.RegisteredClaims) {
+			c.IssuedAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+		})), true},
+		{"retired key inside the grace period", sign(t, signingMethod, recent.ID, recent.Secret, validClaims()), false},
+		{"retired key outside the grace period", sign(t, signingMethod, old.ID, old.Secret, validClaims()), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := kr.Parse(tt.token, &jwt.RegisteredClaims{}, testAudience)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseUnknownKeyError(t *testing.T) {
+	current := testKey("current", nil)
+	kr := New([]Key{current}, time.Hour*24, time.Hour)
+
+	token := sign(t, signingMethod, "unknown", current.Secret, validClaims())
+	if err := kr.Parse(token, &jwt.RegisteredClaims{}, testAudience); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Parse error = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestSignUsesCurrentKey(t *testing.T) {
+	retired := time.Minute
+	older := testKey("older", nil)
+	newer := testKey("newer", nil)
+	newer.CreatedAt = older.CreatedAt.Add(time.Hour)
+	kr := New([]Key{older, newer, testKey("retired", &retired)}, time.Hour*24, time.Hour)
+
+	s, err := kr.Sign(validClaims())
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(s, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatalf("decoding signed token: %v", err)
+	}
+	if kid := token.Header["kid"]; kid != newer.ID {
+		t.Errorf("kid = %v, want %v", kid, newer.ID)
+	}
+	if err = kr.Parse(s, &jwt.RegisteredClaims{}, testAudience); err != nil {
+		t.Errorf("Parse of a signed token: %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package loginguard
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Slows down password guessing. Failed logins are counted per IP and per account.
+After a few free attempts every further failure doubles the time until the next
+attempt is allowed, and once the failures reach the lockout threshold the IP or
+account is locked out for the lockout duration. Counts are forgotten once there
+have been no failures for the lockout duration, or when an admin clears them.
+
+Attempts that pass the check are tracked until their result comes in, so that
+sending many guesses at once can't get around the backoff.
+*/
+
+type LoginGuard struct {
+	Attempts Attempts
+
+	Check        chan Check
+	Result       chan Result
+	GetLockouts  chan GetLockouts
+	ClearLockout chan ClearLockout
+}
+
+// ------ Mutex protected ------ //
+
+type Attempts struct {
+	// key is the kind and value, for example "ACCOUNT:bob"
+	data  map[string]*Attempt
+	mutex sync.RWMutex
+}
+
+// ------ Channel structs ------ //
+
+// Receives how long to wait until the next attempt is allowed, 0 if it is allowed now.
+// Every allowed attempt must be followed by a Result.
+type Check struct {
+	Username string
+	IP       string
+	RecvChan chan time.Duration
+}
+
+// Receives true if the result caused the IP or account to be locked out
+type Result struct {
+	Username string
+	IP       string
+	Outcome  string
+	RecvChan chan bool
+}
+
+type GetLockouts struct {
+	RecvChan chan []Lockout
+}
+
+// Receives false if there was nothing to clear
+type ClearLockout struct {
+	Kind     string
+	Value    string
+	RecvChan chan bool
+}
+
+// ------ General structs ------ //
+
+type Attempt struct {
+	Failures    int
+	LastFailure time.Time
+	// the next attempt isn't allowed until after this time
+	BlockedUntil time.Time
+	Locked       bool
+	// attempts that passed the check and are waiting for their result
+	InFlight int
+}
+
+type Lockout struct {
+	Kind        string    `json:"kind"`
+	Value       string    `json:"value"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+const (
+	KindIP      = "IP"
+	KindAccount = "ACCOUNT"
+)
+
+const (
+	OutcomeSuccess = "SUCCESS"
+	OutcomeFailure = "FAILURE"
+	// the attempt couldn't be checked, because of a database error for example
+	OutcomeAborted = "ABORTED"
+)
+
+// how many attempts can be waiting for their result at once
+const (
+	maxInFlightAccount = 1
+	maxInFlightIP      = 4
+)
+
+// failures allowed before backing off
+const freeAttempts = 3
+
+// the backoff never goes above this, only a lockout blocks for longer
+const maxBackoff = time.Minute * 5
+
+type config struct {
+	accountThreshold int
+	ipThreshold      int
+	lockoutDuration  time.Duration
+}
+
+// ------ Initialization ------ //
+
+func Init() *LoginGuard {
+	lg := &LoginGuard{
+		Attempts: Attempts{
+			data: make(map[string]*Attempt),
+		},
+
+		Check:        make(chan Check),
+		Result:       make(chan Result),
+		GetLockouts:  make(chan GetLockouts),
+		ClearLockout: make(chan ClearLockout),
+	}
+	cfg := config{
+		accountThreshold: intFromEnv("LOGIN_LOCKOUT_THRESHOLD", 10),
+		// an IP can be shared by a whole household, so it gets more attempts than an account
+		ipThreshold:     intFromEnv("LOGIN_IP_LOCKOUT_THRESHOLD", 30),
+		lockoutDuration: time.Minute * time.Duration(intFromEnv("LOGIN_LOCKOUT_MINUTES", 15)),
+	}
+	runServer(lg, cfg)
+	return lg
+}
+
+func runServer(lg *LoginGuard, cfg config) {
+	go check(lg)
+	go result(lg, cfg)
+	go getLockouts(lg)
+	go clearLockout(lg)
+	go sweepAttempts(lg, cfg)
+}
+
+// ------ Loops ------ //
+
+func check(lg *LoginGuard) {
+	for {
+		data := <-lg.Check
+
+		lg.Attempts.mutex.Lock()
+
+		var wait time.Duration
+		keys := map[string]int{
+			key(KindIP, data.IP):            maxInFlightIP,
+			key(KindAccount, data.Username): maxInFlightAccount,
+		}
+		for k, maxInFlight := range keys {
+			if a, ok := lg.Attempts.data[k]; ok {
+				if remaining := time.Until(a.BlockedUntil); remaining > wait {
+					wait = remaining
+				}
+				if a.InFlight >= maxInFlight && wait < time.Second {
+					wait = time.Second
+				}
+			}
+		}
+		if wait == 0 {
+			for k := range keys {
+				a, ok := lg.Attempts.data[k]
+				if !ok {
+					a = &Attempt{}
+					lg.Attempts.data[k] = a
+				}
+				a.InFlight++
+			}
+		}
+
+		lg.Attempts.mutex.Unlock()
+
+		data.RecvChan <- wait
+	}
+}
+
+func result(lg *LoginGuard, cfg config) {
+	for {
+		data := <-lg.Result
+
+		lg.Attempts.mutex.Lock()
+
+		lockedOut := false
+		for kind, value := range map[string]string{KindIP: data.IP, KindAccount: data.Username} {
+			k := key(kind, value)
+			a, ok := lg.Attempts.data[k]
+			if !ok {
+				a = &Attempt{}
+				lg.Attempts.data[k] = a
+			}
+			if a.InFlight > 0 {
+				a.InFlight--
+			}
+
+			if data.Outcome == OutcomeSuccess && kind == KindAccount {
+				// Only the account is reset. Resetting the IP would let someone clear their IP
+				// backoff by logging in to an account of their own between guesses.
+				a.Failures = 0
+				a.Locked = false
+				a.BlockedUntil = time.Time{}
+			}
+			if data.Outcome != OutcomeFailure {
+				continue
+			}
+
+			now := time.Now()
+			a.Failures++
+			a.LastFailure = now
+
+			threshold := cfg.accountThreshold
+			if kind == KindIP {
+				threshold = cfg.ipThreshold
+			}
+
+			if a.Failures >= threshold {
+				if !a.Locked {
+					lockedOut = true
+				}
+				a.Locked = true
+				a.BlockedUntil = now.Add(cfg.lockoutDuration)
+			} else if a.Failures > freeAttempts {
+				backoff := time.Second * time.Duration(math.Pow(2, float64(a.Failures-freeAttempts-1)))
+				if backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				a.BlockedUntil = now.Add(backoff)
+			}
+		}
+
+		lg.Attempts.mutex.Unlock()
+
+		data.RecvChan <- lockedOut
+	}
+}
+
+func getLockouts(lg *LoginGuard) {
+	for {
+		data := <-lg.GetLockouts
+
+		lg.Attempts.mutex.RLock()
+
+		out := []Lockout{}
+		for k, a := range lg.Attempts.data {
+			if a.Locked && time.Now().Before(a.BlockedUntil) {
+				kind, value, _ := strings.Cut(k, ":")
+				out = append(out, Lockout{
+					Kind:        kind,
+					Value:       value,
+					Failures:    a.Failures,
+					LockedUntil: a.BlockedUntil,
+				})
+			}
+		}
+
+		lg.Attempts.mutex.RUnlock()
+
+		data.RecvChan <- out
+	}
+}
+
+func clearLockout(lg *LoginGuard) {
+	for {
+		data := <-lg.ClearLockout
+
+		lg.Attempts.mutex.Lock()
+
+		k := key(data.Kind, data.Value)
+		_, ok := lg.Attempts.data[k]
+		delete(lg.Attempts.data, k)
+
+		lg.Attempts.mutex.Unlock()
+
+		data.RecvChan <- ok
+	}
+}
+
+func sweepAttempts(lg *LoginGuard, cfg config) {
+	for {
+		time.Sleep(time.Minute)
+
+		lg.Attempts.sweep(time.Now(), cfg)
+	}
+}
+
+// ------ Helper functions ------ //
+
+// Forgets the counts once there have been no failures for the lockout duration
+func (at *Attempts) sweep(now time.Time, cfg config) {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	for k, a := range at.data {
+		if a.InFlight == 0 && now.Sub(a.LastFailure) > cfg.lockoutDuration && now.After(a.BlockedUntil) {
+			delete(at.data, k)
+		}
+	}
+}
+
+// usernames are case insensitive, so they're counted in lowercase
+func key(kind string, value string) string {
+	if kind == KindAccount {
+		value = strings.ToLower(strings.TrimSpace(value))
+	}
+	return kind + ":" + value
+}
+
+func intFromEnv(key string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
@@ -0,0 +1,164 @@
+package loginguard
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestGuard(cfg config) *LoginGuard {
+	lg := &LoginGuard{
+		Attempts: Attempts{
+			data: make(map[string]*Attempt),
+		},
+
+		Check:        make(chan Check),
+		Result:       make(chan Result),
+		GetLockouts:  make(chan GetLockouts),
+		ClearLockout: make(chan ClearLockout),
+	}
+	runServer(lg, cfg)
+	return lg
+}
+
+func checkAttempt(t *testing.T, lg *LoginGuard, username string, ip string) time.Duration {
+	t.Helper()
+	recvChan := make(chan time.Duration, 1)
+	lg.Check <- Check{Username: username, IP: ip, RecvChan: recvChan}
+	wait := <-recvChan
+	if wait == 0 {
+		// allowed attempts have to be followed by a result, which doesn't count for anything here
+		sendResult(lg, username, ip, OutcomeAborted)
+	}
+	return wait
+}
+
+func sendResult(lg *LoginGuard, username string, ip string, outcome string) bool {
+	recvChan := make(chan bool, 1)
+	lg.Result <- Result{Username: username, IP: ip, Outcome: outcome, RecvChan: recvChan}
+	return <-recvChan
+}
+
+func listLockouts(lg *LoginGuard) map[string]Lockout {
+	recvChan := make(chan []Lockout, 1)
+	lg.GetLockouts <- GetLockouts{RecvChan: recvChan}
+	out := make(map[string]Lockout)
+	for _, l := range <-recvChan {
+		out[key(l.Kind, l.Value)] = l
+	}
+	return out
+}
+
+func TestLockoutThreshold(t *testing.T) {
+	lg := newTestGuard(config{accountThreshold: 6, ipThreshold: 100, lockoutDuration: time.Hour})
+
+	for i := 1; i < 6; i++ {
+		if sendResult(lg, "bob", "1.1.1.1", OutcomeFailure) {
+			t.Fatalf("locked out after %v failures, threshold is 6", i)
+		}
+	}
+	if len(listLockouts(lg)) != 0 {
+		t.Fatal("lockout listed before the threshold")
+	}
+	// past the free attempts the failures back off without locking out
+	if wait := checkAttempt(t, lg, "bob", "1.1.1.1"); wait <= 0 || wait > maxBackoff {
+		t.Errorf("wait after 5 failures = %v, want a backoff", wait)
+	}
+
+	if !sendResult(lg, "bob", "1.1.1.1", OutcomeFailure) {
+		t.Fatal("not locked out at the threshold")
+	}
+	if sendResult(lg, "bob", "1.1.1.1", OutcomeFailure) {
+		t.Error("a failure while locked out reported a new lockout")
+	}
+	if _, ok := listLockouts(lg)[key(KindAccount, "bob")]; !ok {
+		t.Error("account lockout not listed")
+	}
+	if wait := checkAttempt(t, lg, "bob", "1.1.1.1"); wait <= maxBackoff {
+		t.Errorf("wait while locked out = %v, want about the lockout duration", wait)
+	}
+}
+
+func TestLockoutExpires(t *testing.T) {
+	cfg := config{accountThreshold: 2, ipThreshold: 100, lockoutDuration: time.Millisecond * 100}
+	lg := newTestGuard(cfg)
+
+	sendResult(lg, "bob", "1.1.1.1", OutcomeFailure)
+	if !sendResult(lg, "bob", "1.1.1.1", OutcomeFailure) {
+		t.Fatal("not locked out at the threshold")
+	}
+	if wait := checkAttempt(t, lg, "bob", "1.1.1.1"); wait == 0 {
+		t.Fatal("attempt allowed while locked out")
+	}
+
+	time.Sleep(cfg.lockoutDuration + time.Millisecond*50)
+
+	if wait := checkAttempt(t, lg, "bob", "1.1.1.1"); wait != 0 {
+		t.Errorf("wait after the lockout expired = %v", wait)
+	}
+	if len(listLockouts(lg)) != 0 {
+		t.Error("expired lockout still listed")
+	}
+
+	// the counts are forgotten by the next sweep
+	lg.Attempts.sweep(time.Now(), cfg)
+	lg.Attempts.mutex.RLock()
+	remaining := len(lg.Attempts.data)
+	lg.Attempts.mutex.RUnlock()
+	if remaining != 0 {
+		t.Errorf("%v entries left after sweeping", remaining)
+	}
+}
+
+func TestSuccessResetsAccount(t *testing.T) {
+	lg := newTestGuard(config{accountThreshold: 10, ipThreshold: 10, lockoutDuration: time.Minute})
+
+	for i := 0; i < 5; i++ {
+		sendResult(lg, "bob", "1.1.1.1", OutcomeFailure)
+	}
+	sendResult(lg, "bob", "1.1.1.1", OutcomeSuccess)
+
+	lg.Attempts.mutex.RLock()
+	account := *lg.Attempts.data[key(KindAccount, "bob")]
+	ip := *lg.Attempts.data[key(KindIP, "1.1.1.1")]
+	lg.Attempts.mutex.RUnlock()
+
+	if account.Failures != 0 || !account.BlockedUntil.IsZero() || account.Locked {
+		t.Errorf("account not reset by a success: %+v", account)
+	}
+	// logging in to an account of your own doesn't clear the backoff of your IP
+	if ip.Failures != 5 || ip.BlockedUntil.IsZero() {
+		t.Errorf("IP reset by a success: %+v", ip)
+	}
+	if wait := checkAttempt(t, lg, "bob", "2.2.2.2"); wait != 0 {
+		t.Errorf("account still backing off after a success: %v", wait)
+	}
+}
+
+func TestKeysPerIPAndAccount(t *testing.T) {
+	lg := newTestGuard(config{accountThreshold: 3, ipThreshold: 5, lockoutDuration: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		sendResult(lg, "bob", "1.1.1.1", OutcomeFailure)
+	}
+	// the account is locked from every IP, usernames are case insensitive
+	if wait := checkAttempt(t, lg, " BOB", "2.2.2.2"); wait == 0 {
+		t.Error("locked account allowed from another IP")
+	}
+	if wait := checkAttempt(t, lg, "alice", "2.2.2.2"); wait != 0 {
+		t.Errorf("other account and IP held up: %v", wait)
+	}
+
+	// failures against different accounts add up for the IP
+	for _, username := range []string{"carol", "dave"} {
+		sendResult(lg, username, "1.1.1.1", OutcomeFailure)
+	}
+	if _, ok := listLockouts(lg)[key(KindIP, "1.1.1.1")]; !ok {
+		t.Fatal("IP not locked out after failures against several accounts")
+	}
+	if wait := checkAttempt(t, lg, "erin", "1.1.1.1"); wait == 0 {
+		t.Error("locked IP allowed to try another account")
+	}
+	if wait := checkAttempt(t, lg, "erin", "3.3.3.3"); wait != 0 {
+		t.Errorf("account held up by another IPs lockout: %v", wait)
+	}
+}
@@ -0,0 +1,176 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// A Channel delivers a notification to a single target (an email address, an ntfy topic URL or a webhook URL)
+type Channel interface {
+	Send(ctx context.Context, target string, n Notification) error
+}
+
+var httpClient = &http.Client{Timeout: time.Second * 10}
+
+// ------ SMTP email ------ //
+
+type SMTPChannel struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func SMTPChannelFromEnv() *SMTPChannel {
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "25"
+	}
+	return &SMTPChannel{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
+
+func (c *SMTPChannel) Send(ctx context.Context, target string, n Notification) error {
+	if c.Host == "" {
+		return fmt.Errorf("SMTP is not configured")
+	}
+
+	var auth smtp.Auth
+	if c.Username != "" {
+		auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+
+	boundary := fmt.Sprintf("notification-%v", time.Now().UnixNano())
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %v\r\n", target)
+	fmt.Fprintf(&msg, "Subject: %v\r\n", n.Title())
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%v\r\n\r\n", boundary)
+	fmt.Fprintf(&msg, "--%v\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%v\r\n", boundary, n.Message())
+	for _, a := range n.Attachments {
+		fmt.Fprintf(&msg, "--%v\r\nContent-Type: %v\r\nContent-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=%q\r\n\r\n", boundary, a.ContentType, a.Filename)
+		msg.WriteString(base64.StdEncoding.EncodeToString(a.Data))
+		msg.WriteString("\r\n")
+	}
+	fmt.Fprintf(&msg, "--%v--\r\n", boundary)
+
+	return smtp.SendMail(c.Host+":"+c.Port, auth, c.From, []string{target}, msg.Bytes())
+}
+
+// ------ ntfy-style HTTP push ------ //
+
+// The target is the full topic URL, e.g. https://ntfy.sh/my-cameras
+type NtfyChannel struct {
+	Token string
+}
+
+func NtfyChannelFromEnv() *NtfyChannel {
+	return &NtfyChannel{
+		Token: os.Getenv("NTFY_TOKEN"),
+	}
+}
+
+func (c *NtfyChannel) Send(ctx context.Context, target string, n Notification) error {
+	var body io.Reader = strings.NewReader(n.Message())
+	var filename string
+	if len(n.Attachments) > 0 {
+		// ntfy takes a single attachment as the request body, with the message moved into a header
+		body = bytes.NewReader(n.Attachments[0].Data)
+		filename = n.Attachments[0].Filename
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", n.Title())
+	req.Header.Set("Tags", strings.ToLower(n.Event))
+	if filename != "" {
+		req.Header.Set("Filename", filename)
+		req.Header.Set("Message", n.Message())
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	return doRequest(req)
+}
+
+// ------ Generic webhook ------ //
+
+type WebhookChannel struct{}
+
+type webhookPayload struct {
+	Event       string              `json:"event"`
+	StreamerID  string              `json:"streamer_id"`
+	StreamName  string              `json:"stream_name"`
+	Message     string              `json:"message"`
+	Time        time.Time           `json:"time"`
+	Attachments []webhookAttachment `json:"attachments,omitempty"`
+}
+
+type webhookAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	// base64 encoded by encoding/json
+	Data []byte `json:"data"`
+}
+
+func (c *WebhookChannel) Send(ctx context.Context, target string, n Notification) error {
+	payload := webhookPayload{
+		Event:      n.Event,
+		StreamerID: n.StreamerID,
+		StreamName: n.StreamName,
+		Message:    n.Message(),
+		Time:       n.Time,
+	}
+	for _, a := range n.Attachments {
+		payload.Attachments = append(payload.Attachments, webhookAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Data:        a.Data,
+		})
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return doRequest(req)
+}
+
+func doRequest(req *http.Request) error {
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status code %v", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package notifier
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNotification = Notification{
+	Event:      EventMotionStart,
+	StreamerID: "streamer-id",
+	StreamName: "garden",
+	Time:       time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+}
+
+var testAttachment = Attachment{
+	Filename:    "garden.jpg",
+	ContentType: "image/jpeg",
+	Data:        []byte("jpeg data"),
+}
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// records the requests it gets and responds with the status code
+func testServer(t *testing.T, status int) (*httptest.Server, chan receivedRequest) {
+	received := make(chan receivedRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedRequest{header: r.Header, body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func TestNtfyChannel(t *testing.T) {
+	srv, received := testServer(t, http.StatusOK)
+
+	c := &NtfyChannel{Token: "secret"}
+	if err := c.Send(context.Background(), srv.URL+"/cameras", testNotification); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	r := <-received
+	if got := r.header.Get("Title"); got != testNotification.Title() {
+		t.Errorf("Title = %q, want %q", got, testNotification.Title())
+	}
+	if got := r.header.Get("Tags"); got != "motion_start" {
+		t.Errorf("Tags = %q", got)
+	}
+	if got := r.header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q", got)
+	}
+	if string(r.body) != testNotification.Message() {
+		t.Errorf("body = %q, want the message", r.body)
+	}
+}
+
+func TestNtfyChannelAttachment(t *testing.T) {
+	srv, received := testServer(t, http.StatusOK)
+
+	n := testNotification
+	n.Attachments = []Attachment{testAttachment}
+	if err := (&NtfyChannel{}).Send(context.Background(), srv.URL, n); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	r := <-received
+	if string(r.body) != string(testAttachment.Data) {
+		t.Errorf("body = %q, want the attachment", r.body)
+	}
+	if got := r.header.Get("Filename"); got != testAttachment.Filename {
+		t.Errorf("Filename = %q", got)
+	}
+	if got := r.header.Get("Message"); got != n.Message() {
+		t.Errorf("Message = %q", got)
+	}
+	if got := r.header.Get("Authorization"); got != "" {
+		t.Errorf("Authorization = %q, want none without a token", got)
+	}
+}
+
+func TestWebhookChannel(t *testing.T) {
+	srv, received := testServer(t, http.StatusNoContent)
+
+	n := testNotification
+	n.Attachments = []Attachment{testAttachment}
+	if err := (&WebhookChannel{}).Send(context.Background(), srv.URL, n); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	r := <-received
+	if got := r.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	payload := webhookPayload{}
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatalf("decoding payload: %v", err)
+	}
+	if payload.Event != n.Event || payload.StreamerID != n.StreamerID || payload.StreamName != n.StreamName {
+		t.Errorf("payload = %+v", payload)
+	}
+	if !payload.Time.Equal(n.Time) {
+		t.Errorf("time = %v, want %v", payload.Time, n.Time)
+	}
+	if len(payload.Attachments) != 1 || string(payload.Attachments[0].Data) != string(testAttachment.Data) {
+		t.Errorf("attachments = %+v", payload.Attachments)
+	}
+}
+
+func TestHTTPChannelsReportErrorStatus(t *testing.T) {
+	for name, c := range map[string]Channel{
+		"ntfy":    &NtfyChannel{},
+		"webhook": &WebhookChannel{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv, received := testServer(t, http.StatusInternalServerError)
+			if err := c.Send(context.Background(), srv.URL, testNotification); err == nil {
+				t.Error("expected an error for a 500 response")
+			}
+			<-received
+		})
+	}
+}
+
+// Accepts a single message and sends what it was given as DATA on the channel
+func smtpSink(t *testing.T) (net.Addr, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 localhost ESMTP sink")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+
+	return l.Addr(), received
+}
+
+func TestSMTPChannel(t *testing.T) {
+	addr, received := smtpSink(t)
+	host, port, _ := net.SplitHostPort(addr.String())
+
+	c := &SMTPChannel{Host: host, Port: port, From: "cameras@example.com"}
+	n := testNotification
+	n.Attachments = []Attachment{testAttachment}
+	if err := c.Send(context.Background(), "someone@example.com", n); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	msg := <-received
+	for _, want := range []string{
+		"To: someone@example.com",
+		"Subject: " + n.Title(),
+		n.Message(),
+		`filename="garden.jpg"`,
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message does not contain %q:\n%v", want, msg)
+		}
+	}
+}
+
+func TestSMTPChannelNotConfigured(t *testing.T) {
+	if err := (&SMTPChannel{}).Send(context.Background(), "someone@example.com", testNotification); err == nil {
+		t.Error("expected an error without an SMTP host")
+	}
+}
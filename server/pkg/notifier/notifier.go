@@ -0,0 +1,286 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	videoServer "github.com/web-stuff-98/go-react-vid-streams/pkg/videoServer"
+)
+
+/*
+Sends alerts for motion and camera conditions to the channels users
+have subscribed to. Subscriptions are stored in the database and can be
+limited to a single stream, to a set of events and to outside of quiet hours.
+Each subscription is rate limited per stream, so a camera flapping between
+motion and no motion doesn't send an email every second. The latest snapshot
+of the stream is attached when there is one.
+
+Only admins can subscribe with ntfy or a webhook, since the server makes the request.
+Subscriptions whose owner is no longer an admin are skipped.
+*/
+
+type Notifier struct {
+	Channels   map[string]Channel
+	RateLimits RateLimits
+
+	Notify chan Notification
+}
+
+// ------ Mutex protected ------ //
+
+type RateLimits struct {
+	// key is subscription id + streamer uid + stream name + event, value is when the
+	// last notification was sent. Entries older than maxMinInterval are swept.
+	data  map[string]time.Time
+	mutex sync.Mutex
+}
+
+// ------ Channel structs ------ //
+
+type Notification struct {
+	Event       string
+	StreamerID  string
+	StreamName  string
+	Time        time.Time
+	Attachments []Attachment
+}
+
+// ------ General structs ------ //
+
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+type Subscription struct {
+	ID         string  `json:"id"`
+	Channel    string  `json:"channel"`
+	Target     string  `json:"target"`
+	StreamName *string `json:"stream_name"`
+	// streamer uid the stream name belongs to, nil to match streams of that name from any streamer
+	Streamer    *string  `json:"streamer"`
+	Events      []string `json:"events"`
+	QuietStart  *string  `json:"quiet_start"`
+	QuietEnd    *string  `json:"quiet_end"`
+	Timezone    string   `json:"timezone"`
+	MinInterval int      `json:"min_interval"`
+}
+
+const (
+	EventMotionStart   = "MOTION_START"
+	EventCameraOffline = "CAMERA_OFFLINE"
+)
+
+// the longest min_interval a subscription can have
+const maxMinInterval = time.Hour * 24
+
+const (
+	ChannelEmail   = "EMAIL"
+	ChannelNtfy    = "NTFY"
+	ChannelWebhook = "WEBHOOK"
+)
+
+// ------ Initialization ------ //
+
+func Init(db *pgxpool.Pool, vs *videoServer.VideoServer) *Notifier {
+	n := &Notifier{
+		Channels: map[string]Channel{
+			ChannelEmail:   SMTPChannelFromEnv(),
+			ChannelNtfy:    NtfyChannelFromEnv(),
+			ChannelWebhook: &WebhookChannel{},
+		},
+		RateLimits: RateLimits{
+			data: make(map[string]time.Time),
+		},
+
+		// buffered so that the servers sending notifications aren't held up by delivery
+		Notify: make(chan Notification, 64),
+	}
+	runServer(n, db, vs)
+	return n
+}
+
+func runServer(n *Notifier, db *pgxpool.Pool, vs *videoServer.VideoServer) {
+	go notify(n, db, vs)
+	go sweepRateLimits(n)
+}
+
+// ------ Loops ------ //
+
+func notify(n *Notifier, db *pgxpool.Pool, vs *videoServer.VideoServer) {
+	for {
+		data := <-n.Notify
+
+		if data.Time.IsZero() {
+			data.Time = time.Now()
+		}
+
+		subscriptions, err := getMatchingSubscriptions(db, data)
+		if err != nil {
+			log.Println("Failed to get notification subscriptions:", err)
+			continue
+		}
+		if len(subscriptions) == 0 {
+			continue
+		}
+
+		recvChan := make(chan *videoServer.Snapshot, 1)
+		vs.GetSnapshot <- videoServer.GetSnapshot{
+			Uid:      data.StreamerID,
+			Name:     data.StreamName,
+			RecvChan: recvChan,
+		}
+		if snapshot := <-recvChan; snapshot != nil {
+			data.Attachments = append(data.Attachments, Attachment{
+				Filename:    fmt.Sprintf("%v-%v.jpg", data.StreamName, snapshot.CreatedAt.Unix()),
+				ContentType: "image/jpeg",
+				Data:        snapshot.Data,
+			})
+		}
+		close(recvChan)
+
+		for _, s := range subscriptions {
+			if s.inQuietHours(data.Time) {
+				continue
+			}
+			if !n.RateLimits.allow(s, data) {
+				continue
+			}
+			channel, ok := n.Channels[s.Channel]
+			if !ok {
+				continue
+			}
+			// send in the background so that a slow mail server or webhook doesn't hold up other notifications
+			go func(s Subscription) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+				defer cancel()
+				if err := channel.Send(ctx, s.Target, data); err != nil {
+					log.Printf("Failed to send %v notification to subscription %v: %v", s.Channel, s.ID, err)
+				}
+			}(s)
+		}
+	}
+}
+
+func sweepRateLimits(n *Notifier) {
+	for {
+		time.Sleep(time.Minute)
+
+		n.RateLimits.sweep(time.Now())
+	}
+}
+
+// ------ Helper functions ------ //
+
+func getMatchingSubscriptions(db *pgxpool.Pool, data Notification) ([]Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rows, err := db.Query(ctx, `
+		SELECT id,channel,target,stream_name,streamer,events,quiet_start,quiet_end,timezone,min_interval
+		FROM notification_subscriptions
+		WHERE $1 = ANY(events) AND (stream_name IS NULL OR LOWER(stream_name) = LOWER($2))
+		AND (streamer IS NULL OR streamer = $3)
+		AND (channel = 'EMAIL' OR (
+			SELECT users.role FROM streamers INNER JOIN users ON users.id = streamers.user_id WHERE streamers.id = owner
+		) = 'admin');
+	`, data.Event, data.StreamName, data.StreamerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []Subscription{}
+	for rows.Next() {
+		s := Subscription{}
+		if err = rows.Scan(&s.ID, &s.Channel, &s.Target, &s.StreamName, &s.Streamer, &s.Events, &s.QuietStart, &s.QuietEnd, &s.Timezone, &s.MinInterval); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions, nil
+}
+
+func (rl *RateLimits) allow(s Subscription, data Notification) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	key := s.ID + ":" + data.StreamerID + ":" + data.StreamName + ":" + data.Event
+	if last, ok := rl.data[key]; ok && data.Time.Sub(last) < time.Duration(s.MinInterval)*time.Second {
+		return false
+	}
+	rl.data[key] = data.Time
+	return true
+}
+
+// Removes the entries that are too old to refuse a notification
+func (rl *RateLimits) sweep(now time.Time) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	for key, last := range rl.data {
+		if now.Sub(last) >= maxMinInterval {
+			delete(rl.data, key)
+		}
+	}
+}
+
+// Quiet hours where the end is before the start wrap around past midnight
+func (s Subscription) inQuietHours(t time.Time) bool {
+	if s.QuietStart == nil || s.QuietEnd == nil {
+		return false
+	}
+	start, err := parseClock(*s.QuietStart)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(*s.QuietEnd)
+	if err != nil {
+		return false
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// parses a "HH:MM" string into the number of minutes since midnight
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (n Notification) Title() string {
+	switch n.Event {
+	case EventMotionStart:
+		return fmt.Sprintf("Motion detected on %v", n.StreamName)
+	case EventCameraOffline:
+		return fmt.Sprintf("Camera %v went offline", n.StreamName)
+	}
+	return n.Event
+}
+
+func (n Notification) Message() string {
+	switch n.Event {
+	case EventMotionStart:
+		return fmt.Sprintf("Motion was detected on stream %v at %v", n.StreamName, n.Time.Format(time.RFC1123))
+	case EventCameraOffline:
+		return fmt.Sprintf("Stream %v stopped sending video at %v", n.StreamName, n.Time.Format(time.RFC1123))
+	}
+	return fmt.Sprintf("%v on stream %v at %v", n.Event, n.StreamName, n.Time.Format(time.RFC1123))
+}
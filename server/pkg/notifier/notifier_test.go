@@ -0,0 +1,97 @@
+package notifier
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInQuietHours(t *testing.T) {
+	clock := func(s string) *string { return &s }
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 5, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		start    *string
+		end      *string
+		timezone string
+		t        time.Time
+		want     bool
+	}{
+		{"no quiet hours", nil, nil, "UTC", at(3, 0), false},
+		{"only a start", clock("22:00"), nil, "UTC", at(23, 0), false},
+		{"inside", clock("09:00"), clock("17:00"), "UTC", at(12, 0), true},
+		{"at the start", clock("09:00"), clock("17:00"), "UTC", at(9, 0), true},
+		{"at the end", clock("09:00"), clock("17:00"), "UTC", at(17, 0), false},
+		{"before", clock("09:00"), clock("17:00"), "UTC", at(8, 59), false},
+		{"wraparound before midnight", clock("22:00"), clock("06:00"), "UTC", at(23, 30), true},
+		{"wraparound after midnight", clock("22:00"), clock("06:00"), "UTC", at(2, 0), true},
+		{"wraparound outside", clock("22:00"), clock("06:00"), "UTC", at(12, 0), false},
+		{"wraparound at the end", clock("22:00"), clock("06:00"), "UTC", at(6, 0), false},
+		// 12:00 UTC is 21:00 in Tokyo
+		{"timezone", clock("20:00"), clock("22:00"), "Asia/Tokyo", at(12, 0), true},
+		{"unknown timezone falls back to UTC", clock("11:00"), clock("13:00"), "Nowhere/Nowhere", at(12, 0), true},
+		{"invalid clock", clock("25:00"), clock("06:00"), "UTC", at(2, 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Subscription{QuietStart: tt.start, QuietEnd: tt.end, Timezone: tt.timezone}
+			if got := s.inQuietHours(tt.t); got != tt.want {
+				t.Errorf("inQuietHours = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitsAllow(t *testing.T) {
+	rl := &RateLimits{data: make(map[string]time.Time)}
+	s := Subscription{ID: "sub", MinInterval: 60}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	n := func(event, stream string, after time.Duration) Notification {
+		return Notification{Event: event, StreamerID: "uid", StreamName: stream, Time: start.Add(after)}
+	}
+
+	steps := []struct {
+		name string
+		n    Notification
+		want bool
+	}{
+		{"first", n(EventMotionStart, "garden", 0), true},
+		{"inside the interval", n(EventMotionStart, "garden", time.Second*30), false},
+		{"other stream", n(EventMotionStart, "drive", time.Second*30), true},
+		{"other event", n(EventCameraOffline, "garden", time.Second*30), true},
+		// refused notifications don't restart the interval
+		{"after the interval", n(EventMotionStart, "garden", time.Second*60), true},
+		{"inside the next interval", n(EventMotionStart, "garden", time.Second*90), false},
+	}
+
+	for _, step := range steps {
+		if got := rl.allow(s, step.n); got != step.want {
+			t.Errorf("%v: allow = %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	other := Subscription{ID: "other", MinInterval: 60}
+	if !rl.allow(other, n(EventMotionStart, "garden", time.Second*90)) {
+		t.Error("subscriptions should be rate limited separately")
+	}
+}
+
+func TestRateLimitsSweep(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rl := &RateLimits{data: map[string]time.Time{
+		"recent": now.Add(-time.Hour),
+		"old":    now.Add(-maxMinInterval),
+	}}
+
+	rl.sweep(now)
+
+	if _, ok := rl.data["recent"]; !ok {
+		t.Error("recent entry was swept")
+	}
+	if _, ok := rl.data["old"]; ok {
+		t.Error("entry older than the longest interval was kept")
+	}
+}
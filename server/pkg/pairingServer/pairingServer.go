@@ -0,0 +1,294 @@
+package pairingserver
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Pairing lets a new camera get a device token without anyone typing a password into it.
+The device requests a pairing and shows the 6 digit code it gets back, an admin approves
+the code from their own session, and the device picks up its token by polling the pairing.
+Pairings are only kept in memory and expire if they aren't approved in time.
+*/
+
+type PairingServer struct {
+	Pairings Pairings
+
+	CreatePairing   chan CreatePairing
+	GetPairings     chan GetPairings
+	ClaimPairing    chan ClaimPairing
+	CompletePairing chan CompletePairing
+	PollPairing     chan PollPairing
+}
+
+// ------ Mutex protected ------ //
+
+type Pairings struct {
+	// key is the pairing id
+	data  map[string]*Pairing
+	mutex sync.RWMutex
+}
+
+// ------ Channel structs ------ //
+
+// Receives nil if there are too many pending pairings, in total or from the IP
+type CreatePairing struct {
+	Label    string
+	IP       string
+	RecvChan chan *Pairing
+}
+
+type GetPairings struct {
+	RecvChan chan []Pairing
+}
+
+// Marks the pairing with the code as approved so that it can't be approved twice
+type ClaimPairing struct {
+	Code     string
+	RecvChan chan *Pairing
+}
+
+// Completing with an empty token releases the claim so that the code can be approved again
+type CompletePairing struct {
+	ID    string
+	Token string
+}
+
+type PollPairing struct {
+	ID       string
+	RecvChan chan PollResult
+}
+
+// ------ General structs ------ //
+
+type Pairing struct {
+	// the id is only given to the device, it is the secret used to collect the token
+	ID        string    `json:"-"`
+	Code      string    `json:"code"`
+	Label     string    `json:"label"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Claimed   bool      `json:"-"`
+	Token     string    `json:"-"`
+}
+
+type PollResult struct {
+	Found bool
+	Token string
+}
+
+// the endpoint for requesting a pairing is public, so cap how many can be held in memory,
+// and how many a single IP can hold so that one client can't take every slot
+const (
+	maxPending      = 100
+	maxPendingPerIP = 3
+)
+
+// ------ Initialization ------ //
+
+func Init() *PairingServer {
+	ps := &PairingServer{
+		Pairings: Pairings{
+			data: make(map[string]*Pairing),
+		},
+
+		CreatePairing:   make(chan CreatePairing),
+		GetPairings:     make(chan GetPairings),
+		ClaimPairing:    make(chan ClaimPairing),
+		CompletePairing: make(chan CompletePairing),
+		PollPairing:     make(chan PollPairing),
+	}
+	runServer(ps)
+	return ps
+}
+
+func runServer(ps *PairingServer) {
+	go createPairing(ps)
+	go getPairings(ps)
+	go claimPairing(ps)
+	go completePairing(ps)
+	go pollPairing(ps)
+	go sweepExpiredPairings(ps)
+}
+
+// ------ Loops ------ //
+
+func createPairing(ps *PairingServer) {
+	lifetime := time.Minute * 10
+	if minutes, err := strconv.Atoi(os.Getenv("PAIRING_LIFETIME_MINUTES")); err == nil && minutes > 0 {
+		lifetime = time.Minute * time.Duration(minutes)
+	}
+
+	for {
+		data := <-ps.CreatePairing
+
+		ps.Pairings.mutex.Lock()
+
+		fromIP := 0
+		for _, p := range ps.Pairings.data {
+			// approved pairings waiting to be collected still count
+			if p.IP == data.IP && time.Now().Before(p.ExpiresAt) {
+				fromIP++
+			}
+		}
+		if len(ps.Pairings.data) >= maxPending || fromIP >= maxPendingPerIP {
+			ps.Pairings.mutex.Unlock()
+			data.RecvChan <- nil
+			continue
+		}
+
+		// codes only have to be unique among the pairings that are pending
+		var code string
+		for {
+			code = randomCode()
+			taken := false
+			for _, p := range ps.Pairings.data {
+				if p.Code == code {
+					taken = true
+					break
+				}
+			}
+			if !taken {
+				break
+			}
+		}
+
+		p := &Pairing{
+			ID:        randomID(),
+			Code:      code,
+			Label:     data.Label,
+			IP:        data.IP,
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(lifetime),
+		}
+		ps.Pairings.data[p.ID] = p
+
+		ps.Pairings.mutex.Unlock()
+
+		out := *p
+		data.RecvChan <- &out
+	}
+}
+
+func getPairings(ps *PairingServer) {
+	for {
+		data := <-ps.GetPairings
+
+		ps.Pairings.mutex.RLock()
+
+		out := []Pairing{}
+		for _, p := range ps.Pairings.data {
+			if !p.Claimed && time.Now().Before(p.ExpiresAt) {
+				out = append(out, *p)
+			}
+		}
+
+		ps.Pairings.mutex.RUnlock()
+
+		data.RecvChan <- out
+	}
+}
+
+func claimPairing(ps *PairingServer) {
+	for {
+		data := <-ps.ClaimPairing
+
+		ps.Pairings.mutex.Lock()
+
+		var out *Pairing
+		for _, p := range ps.Pairings.data {
+			if p.Code == data.Code && !p.Claimed && time.Now().Before(p.ExpiresAt) {
+				p.Claimed = true
+				claimed := *p
+				out = &claimed
+				break
+			}
+		}
+
+		ps.Pairings.mutex.Unlock()
+
+		data.RecvChan <- out
+	}
+}
+
+func completePairing(ps *PairingServer) {
+	for {
+		data := <-ps.CompletePairing
+
+		ps.Pairings.mutex.Lock()
+
+		if p, ok := ps.Pairings.data[data.ID]; ok && data.Token == "" {
+			p.Claimed = false
+		} else if ok {
+			p.Token = data.Token
+			// give the device a full lifetime to collect the token
+			p.ExpiresAt = time.Now().Add(p.ExpiresAt.Sub(p.CreatedAt))
+		}
+
+		ps.Pairings.mutex.Unlock()
+	}
+}
+
+// The token is handed over once, then the pairing is removed
+func pollPairing(ps *PairingServer) {
+	for {
+		data := <-ps.PollPairing
+
+		ps.Pairings.mutex.Lock()
+
+		result := PollResult{}
+		if p, ok := ps.Pairings.data[data.ID]; ok && time.Now().Before(p.ExpiresAt) {
+			result.Found = true
+			result.Token = p.Token
+			if p.Token != "" {
+				delete(ps.Pairings.data, data.ID)
+			}
+		}
+
+		ps.Pairings.mutex.Unlock()
+
+		data.RecvChan <- result
+	}
+}
+
+func sweepExpiredPairings(ps *PairingServer) {
+	for {
+		time.Sleep(time.Minute)
+
+		ps.Pairings.mutex.Lock()
+
+		for id, p := range ps.Pairings.data {
+			if time.Now().After(p.ExpiresAt) {
+				delete(ps.Pairings.data, id)
+			}
+		}
+
+		ps.Pairings.mutex.Unlock()
+	}
+}
+
+// ------ Helper functions ------ //
+
+func randomCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		log.Fatalln("Failed to generate pairing code:", err)
+	}
+	return fmt.Sprintf("%06d", n.Int64())
+}
+
+func randomID() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalln("Failed to generate pairing id:", err)
+	}
+	return fmt.Sprintf("%x", b)
+}
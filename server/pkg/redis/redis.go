@@ -33,8 +33,6 @@ func Init() *redis.Client {
 		log.Fatalf("Failed to connect to Redis: %v", err)
 	}
 
-	rdb.FlushDB(context.Background())
-
 	log.Println("Redis client connected")
 
 	return rdb
@@ -0,0 +1,177 @@
+package sessionstore
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Keeps sessions in a map. Expired sessions are swept periodically, and if a
+// snapshot file is configured the sessions are written to it after each sweep
+// that follows a change so that restarting the server doesn't log everyone out.
+type MemoryStore struct {
+	data         map[string]Session
+	mutex        sync.RWMutex
+	dirty        bool
+	snapshotFile string
+}
+
+func NewMemoryStore(snapshotFile string) *MemoryStore {
+	ms := &MemoryStore{
+		data:         make(map[string]Session),
+		snapshotFile: snapshotFile,
+	}
+	if snapshotFile != "" {
+		ms.loadSnapshot()
+	}
+	go ms.sweep()
+	return ms
+}
+
+func (ms *MemoryStore) Set(ctx context.Context, s Session) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.data[s.Sid] = s
+	ms.dirty = true
+
+	return nil
+}
+
+func (ms *MemoryStore) Get(ctx context.Context, sid string) (Session, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	s, ok := ms.data[sid]
+	if !ok || time.Now().After(s.ExpiresAt) {
+		return Session{}, ErrNotFound
+	}
+
+	return s, nil
+}
+
+func (ms *MemoryStore) Delete(ctx context.Context, sid string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	delete(ms.data, sid)
+	ms.dirty = true
+
+	return nil
+}
+
+func (ms *MemoryStore) List(ctx context.Context, uid string) ([]Session, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	sessions := []Session{}
+	now := time.Now()
+	for _, s := range ms.data {
+		if s.Uid == uid && now.Before(s.ExpiresAt) {
+			sessions = append(sessions, s)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (ms *MemoryStore) DeleteAll(ctx context.Context, uid string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for sid, s := range ms.data {
+		if s.Uid == uid {
+			delete(ms.data, sid)
+		}
+	}
+	ms.dirty = true
+
+	return nil
+}
+
+func (ms *MemoryStore) sweep() {
+	for {
+		time.Sleep(time.Second * 30)
+
+		ms.mutex.Lock()
+
+		now := time.Now()
+		for sid, s := range ms.data {
+			if now.After(s.ExpiresAt) {
+				delete(ms.data, sid)
+				ms.dirty = true
+			}
+		}
+
+		var snapshot []Session
+		if ms.dirty && ms.snapshotFile != "" {
+			snapshot = make([]Session, 0, len(ms.data))
+			for _, s := range ms.data {
+				snapshot = append(snapshot, s)
+			}
+		}
+		ms.dirty = false
+
+		ms.mutex.Unlock()
+
+		if snapshot != nil {
+			if err := ms.writeSnapshot(snapshot); err != nil {
+				log.Println("Failed to write session snapshot:", err)
+			}
+		}
+	}
+}
+
+func (ms *MemoryStore) loadSnapshot() {
+	b, err := os.ReadFile(ms.snapshotFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to read session snapshot:", err)
+		}
+		return
+	}
+
+	var snapshot []Session
+	if err = json.Unmarshal(b, &snapshot); err != nil {
+		log.Println("Failed to decode session snapshot:", err)
+		return
+	}
+
+	now := time.Now()
+	for _, s := range snapshot {
+		if now.Before(s.ExpiresAt) {
+			ms.data[s.Sid] = s
+		}
+	}
+
+	log.Printf("Restored %v sessions from snapshot", len(ms.data))
+}
+
+// writes to a temporary file first so that a crash mid-write can't corrupt the snapshot
+func (ms *MemoryStore) writeSnapshot(snapshot []Session) error {
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(ms.snapshotFile), ".sessions-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ms.snapshotFile)
+}
@@ -0,0 +1,115 @@
+package sessionstore
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	rdb "github.com/web-stuff-98/go-react-vid-streams/pkg/redis"
+)
+
+// Keeps sessions in Redis as JSON, expiring at the same time as the session.
+// The session IDs belonging to each user are kept in a set so that they can be listed,
+// IDs of sessions that have expired are removed from the set when it is next listed.
+type RedisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore() *RedisStore {
+	return &RedisStore{
+		client: rdb.Init(),
+	}
+}
+
+func userSessionsKey(uid string) string {
+	return "user_sessions:" + uid
+}
+
+func (rs *RedisStore) Set(ctx context.Context, s Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(s.ExpiresAt)
+	_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.Sid, b, ttl)
+		pipe.SAdd(ctx, userSessionsKey(s.Uid), s.Sid)
+		// sessions are always set with the full refresh token lifetime, so the session
+		// that was set last is the one that expires last
+		pipe.Expire(ctx, userSessionsKey(s.Uid), ttl)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) Get(ctx context.Context, sid string) (Session, error) {
+	b, err := rs.client.Get(ctx, sid).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return Session{}, ErrNotFound
+		}
+		return Session{}, err
+	}
+	s := Session{}
+	if err = json.Unmarshal(b, &s); err != nil {
+		return Session{}, err
+	}
+	return s, nil
+}
+
+func (rs *RedisStore) Delete(ctx context.Context, sid string) error {
+	s, err := rs.Get(ctx, sid)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sid)
+		pipe.SRem(ctx, userSessionsKey(s.Uid), sid)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) List(ctx context.Context, uid string) ([]Session, error) {
+	sessions := []Session{}
+
+	sids, err := rs.client.SMembers(ctx, userSessionsKey(uid)).Result()
+	if err != nil || len(sids) == 0 {
+		return sessions, err
+	}
+	values, err := rs.client.MGet(ctx, sids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := []interface{}{}
+	for i, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			expired = append(expired, sids[i])
+			continue
+		}
+		s := Session{}
+		if err = json.Unmarshal([]byte(str), &s); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	if len(expired) > 0 {
+		rs.client.SRem(ctx, userSessionsKey(uid), expired...)
+	}
+
+	return sessions, nil
+}
+
+func (rs *RedisStore) DeleteAll(ctx context.Context, uid string) error {
+	sids, err := rs.client.SMembers(ctx, userSessionsKey(uid)).Result()
+	if err != nil {
+		return err
+	}
+	return rs.client.Del(ctx, append(sids, userSessionsKey(uid))...).Err()
+}
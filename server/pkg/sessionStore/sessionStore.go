@@ -0,0 +1,62 @@
+package sessionstore
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+Session IDs map to the uid of the streamer who logged in, along with the hash of the
+sessions current refresh token. A session expires when its refresh token does. The store is selected
+with the SESSION_STORE environment variable, "memory" (the default) keeps
+sessions inside the server process, "redis" keeps them in Redis.
+*/
+
+type SessionStore interface {
+	Set(ctx context.Context, s Session) error
+	Get(ctx context.Context, sid string) (Session, error)
+	Delete(ctx context.Context, sid string) error
+	// Lists the unexpired sessions belonging to the uid
+	List(ctx context.Context, uid string) ([]Session, error)
+	DeleteAll(ctx context.Context, uid string) error
+}
+
+type Session struct {
+	Sid       string    `json:"sid"`
+	Uid       string    `json:"uid"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// sha256 of the refresh token that can currently be used for the session
+	RefreshHash string `json:"refresh_hash"`
+	// sha256 of the refresh token it replaced, which can still be used for a short time
+	// after RotatedAt, so that two tabs refreshing at once don't look like token reuse
+	PreviousRefreshHash string    `json:"previous_refresh_hash"`
+	RotatedAt           time.Time `json:"rotated_at"`
+	// updated whenever the refresh token is used
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Client
+}
+
+// What the session was logged in from, shown when listing sessions
+type Client struct {
+	Label     string `json:"label"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+}
+
+var ErrNotFound = errors.New("Session not found")
+
+func Init() SessionStore {
+	switch os.Getenv("SESSION_STORE") {
+	case "redis":
+		return NewRedisStore()
+	case "", "memory":
+		return NewMemoryStore(os.Getenv("SESSION_SNAPSHOT_FILE"))
+	default:
+		log.Fatalln("Unrecognized SESSION_STORE, expected memory or redis")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package sharelinks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Signs share links for recordings, so that people without an account can download
+a recording. The signature covers the link ID and the expiry, everything else about
+the link (the recording, the clip range and the download limit) is kept in the
+share_links table.
+
+Unlike the JWT signing keys this key is never rotated, rotating it would break every
+link that has been given out. It is kept in the database so that links keep working
+after a restart.
+*/
+
+type Signer struct {
+	secret []byte
+}
+
+func Init(db *pgxpool.Pool) *Signer {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalln("Failed to generate share link key:", err)
+	}
+
+	// only the first server to start creates the key
+	if _, err := db.Exec(ctx, `
+		INSERT INTO share_link_key (id,secret) VALUES(1,$1) ON CONFLICT DO NOTHING;
+	`, secret); err != nil {
+		log.Fatalln("Failed to create share link key:", err)
+	}
+	if err := db.QueryRow(ctx, `
+		SELECT secret FROM share_link_key WHERE id = 1;
+	`).Scan(&secret); err != nil {
+		log.Fatalln("Failed to load share link key:", err)
+	}
+
+	return &Signer{secret: secret}
+}
+
+// Returns the URL safe signature for the link
+func (s *Signer) Sign(id string, expiresAt time.Time) string {
+	return base64.RawURLEncoding.EncodeToString(s.mac(id, expiresAt.Unix()))
+}
+
+// Checks the signature and that the link hasn't expired. Expires is the unix timestamp from the URL.
+func (s *Signer) Verify(id string, expires string, signature string) bool {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() >= unix {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, s.mac(id, unix))
+}
+
+func (s *Signer) mac(id string, expires int64) []byte {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(id + "." + strconv.FormatInt(expires, 10)))
+	return m.Sum(nil)
+}
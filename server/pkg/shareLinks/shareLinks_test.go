@@ -0,0 +1,65 @@
+package sharelinks
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	s := &Signer{secret: []byte("share link secret")}
+	other := &Signer{secret: []byte("another secret")}
+
+	expiresAt := time.Now().Add(time.Hour)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	sig := s.Sign("link", expiresAt)
+
+	expiredAt := time.Now().Add(-time.Second)
+	expired := strconv.FormatInt(expiredAt.Unix(), 10)
+
+	raw, _ := base64.RawURLEncoding.DecodeString(sig)
+	padded := base64.URLEncoding.EncodeToString(raw)
+	raw[0] ^= 1
+	flipped := base64.RawURLEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		name    string
+		signer  *Signer
+		id      string
+		expires string
+		sig     string
+		want    bool
+	}{
+		{"valid", s, "link", expires, sig, true},
+		{"expired", s, "expired", expired, s.Sign("expired", expiredAt), false},
+		{"other id", s, "another link", expires, sig, false},
+		{"later expiry", s, "link", strconv.FormatInt(expiresAt.Unix()+60, 10), sig, false},
+		{"expiry not a number", s, "link", "tomorrow", sig, false},
+		{"empty expiry", s, "link", "", sig, false},
+		{"tampered signature", s, "link", expires, flipped, false},
+		{"truncated signature", s, "link", expires, sig[:len(sig)-4], false},
+		{"signature not base64", s, "link", expires, "not*base64!", false},
+		{"padded signature", s, "link", expires, padded, false},
+		{"empty signature", s, "link", expires, "", false},
+		{"signed with another key", other, "link", expires, sig, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.signer.Verify(tt.id, tt.expires, tt.sig); got != tt.want {
+			t.Errorf("%v: Verify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSignIsURLSafe(t *testing.T) {
+	s := &Signer{secret: []byte("share link secret")}
+	for i := 0; i < 50; i++ {
+		sig := s.Sign(strconv.Itoa(i), time.Now().Add(time.Hour))
+		for _, c := range sig {
+			if c == '+' || c == '/' || c == '=' {
+				t.Fatalf("signature %q isn't URL safe", sig)
+			}
+		}
+	}
+}
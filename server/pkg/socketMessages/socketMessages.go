@@ -1,22 +1,29 @@
 package socketmessages
 
-import socketValidation "github.com/web-stuff-98/go-react-vid-streams/pkg/socketValidation"
+import (
+	"time"
+
+	socketValidation "github.com/web-stuff-98/go-react-vid-streams/pkg/socketValidation"
+)
 
 // TYPE: WEBRTC_JOINED_SIGNAL
 type WebRTCUserJoined struct {
-	Signal      string                        `json:"signal"`
-	CallerID    string                        `json:"caller_id"`
-	StreamsInfo []socketValidation.StreamInfo `json:"streams_info"`
+	Signal       string                        `json:"signal"`
+	CallerID     string                        `json:"caller_id"`
+	CallerConnID string                        `json:"caller_conn_id"`
+	StreamsInfo  []socketValidation.StreamInfo `json:"streams_info"`
 }
 
 // TYPE: WEBRTC_USER_LEFT/WEBRTC_USER_JOINED
 type WebRTCUserJoinedLeft struct {
-	Uid string `json:"uid"`
+	Uid    string `json:"uid"`
+	ConnID string `json:"conn_id"`
 }
 
 // TYPE: WEBRTC_RETURN_SIGNAL_OUT
 type WebRTCReturnSignal struct {
 	Uid         string                        `json:"uid"`
+	ConnID      string                        `json:"conn_id"`
 	Signal      string                        `json:"signal"`
 	StreamsInfo []socketValidation.StreamInfo `json:"streams_info"`
 }
@@ -27,6 +34,7 @@ type WebRTCAllUsers struct {
 }
 type WebRTCOutUser struct {
 	Uid         string                        `json:"uid"`
+	ConnID      string                        `json:"conn_id"`
 	StreamsInfo []socketValidation.StreamInfo `json:"streams_info"`
 }
 
@@ -35,6 +43,13 @@ type WebRTCMotionUpdate struct {
 	MediaStreamID string `json:"media_stream_id"`
 	Motion        bool   `json:"motion"`
 	StreamerID    string `json:"streamer_id"`
+	ConnID        string `json:"conn_id"`
+}
+
+// TYPE: STREAMS_OFFLINE
+type StreamsOffline struct {
+	StreamerID string   `json:"streamer_id"`
+	Names      []string `json:"names"`
 }
 
 // TYPE: CHANGE
@@ -43,3 +58,59 @@ type ChangeData struct {
 	Method string                 `json:"method"`
 	Data   map[string]interface{} `json:"data"`
 }
+
+// TYPE: ARM_STATE
+type ArmState struct {
+	StreamerID string `json:"streamer_id"`
+	Name       string `json:"name"`
+	Armed      bool   `json:"armed"`
+}
+
+// TYPE: STREAM_HEALTH
+type StreamHealth struct {
+	StreamerID    string    `json:"streamer_id"`
+	Name          string    `json:"name"`
+	Status        string    `json:"status"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	LastChunk     time.Time `json:"last_chunk"`
+	LastJoin      time.Time `json:"last_join"`
+}
+
+// TYPE: STREAM_STATS
+type StreamStatsList struct {
+	Streams []StreamStats `json:"streams"`
+}
+type StreamStats struct {
+	StreamerID string `json:"streamer_id"`
+	Name       string `json:"name"`
+	// bits per second over the last minute
+	Bitrate float64 `json:"bitrate"`
+	// chunks per minute over the last minute
+	ChunkRate        float64   `json:"chunk_rate"`
+	AverageChunkSize float64   `json:"average_chunk_size"`
+	GapsDetected     int       `json:"gaps_detected"`
+	BytesStoredToday int64     `json:"bytes_stored_today"`
+	LastSeen         time.Time `json:"last_seen"`
+}
+
+// TYPE: ERROR
+type SocketError struct {
+	// the id the client sent along with the event, empty if it didn't send one
+	ID     string   `json:"id"`
+	Event  string   `json:"event"`
+	Code   string   `json:"code"`
+	Msg    string   `json:"msg"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// TYPE: ACK
+type SocketAck struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// ACK data for WEBRTC_JOIN
+type WebRTCJoined struct {
+	ConnID string `json:"conn_id"`
+}
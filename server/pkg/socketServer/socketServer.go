@@ -2,11 +2,34 @@ package handlers
 
 import (
 	"encoding/json"
+	"log"
+	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gofiber/websocket/v2"
 )
 
+/*
+Every connection has its own writer goroutine with a bounded send queue, so that a
+slow client can't hold up the other clients, or whatever is sending to it. Sending
+never blocks. When a clients queue is full, messages that will be superseded anyway
+(see droppableEvents) are dropped, and for anything else the client is disconnected,
+since it would be left out of sync.
+
+SOCKET_SEND_QUEUE_SIZE sets the queue size (default 64) and SOCKET_WRITE_TIMEOUT_SECONDS
+sets the write deadline (default 10), a client that takes longer than that to accept a
+message is disconnected.
+
+The writer also sends a ping every SOCKET_PING_INTERVAL_SECONDS (default 25). If nothing,
+not even a pong, is read from the client for SOCKET_PONG_TIMEOUT_SECONDS (default 60)
+the read fails, and the connection is unregistered like any other disconnect.
+
+A user can have any number of connections open, from different tabs or devices. Each
+connection has its own ID, events sent to a uid go to all of the users connections.
+*/
+
 type SocketServer struct {
 	Connections Connections
 
@@ -14,22 +37,25 @@ type SocketServer struct {
 	SendDataToUid       chan SendDataToUid
 	SendDataToUids      chan SendDataToUids
 	SendDataToConns     chan SendDataToConns
+	SendDataToConnID    chan SendDataToConnID
+	SendDataToConnIDs   chan SendDataToConnIDs
 	SendDataToAll       chan SendDataToAll
 	SendDataToAllExcept chan SendDataToAllExcept
 
-	MessageLoop chan Message
-
 	RegisterConn   chan ConnectionData
 	UnregisterConn chan *websocket.Conn
-}
 
-// ------ Channels ------ //
+	GetSessionConns chan GetSessionConns
+	GetDeviceConns  chan GetDeviceConns
 
-type Message struct {
-	Conn *websocket.Conn
-	Data []byte
+	sendQueueSize int
+	writeTimeout  time.Duration
+	pingInterval  time.Duration
+	pongTimeout   time.Duration
 }
 
+// ------ Channels ------ //
+
 type SendData struct {
 	Data      interface{}
 	Conn      *websocket.Conn
@@ -54,48 +80,124 @@ type SendDataToConns struct {
 	EventName string
 }
 
+type SendDataToConnID struct {
+	Data      interface{}
+	ConnID    string
+	EventName string
+}
+
+type SendDataToConnIDs struct {
+	Data      interface{}
+	ConnIDs   map[string]struct{}
+	EventName string
+}
+
 type SendDataToAll struct {
 	Data      interface{}
 	EventName string
 }
 
+type GetSessionConns struct {
+	Sid      string
+	RecvChan chan []ConnectionData
+}
+
+type GetDeviceConns struct {
+	DeviceID string
+	RecvChan chan []ConnectionData
+}
+
 type SendDataToAllExcept struct {
 	Data      interface{}
 	EventName string
-	Exclude   string
+	// uid, all of the users connections are excluded
+	Exclude string
+	// a single connection
+	ExcludeConnID string
 }
 
 // ------ Mutex protected ------ //
 
 type Connections struct {
-	data  map[*websocket.Conn]string
-	mutex sync.RWMutex
+	data map[*websocket.Conn]string
+	// session ID of each connection, device connections don't have a session
+	sids map[*websocket.Conn]string
+	// device ID of each connection opened with a device token
+	devices map[*websocket.Conn]string
+	ids     map[*websocket.Conn]string
+	byID    map[string]*websocket.Conn
+	byUid   map[string]map[*websocket.Conn]struct{}
+	queues  map[*websocket.Conn]*sendQueue
+	mutex   sync.RWMutex
 }
 
 // ------ General structs ------ //
 
 type ConnectionData struct {
-	Uid  string
-	Conn *websocket.Conn
+	// generated for each connection, used to address a connection without the connection itself
+	ID  string
+	Uid string
+	Sid string
+	// empty unless the connection was opened with a device token
+	DeviceID string
+	Conn     *websocket.Conn
+	// closed by the connections writer when it exits. The websocket handler must not
+	// return before then, because the connection is put back in a pool once it does.
+	WriterStopped chan struct{}
+}
+
+type sendQueue struct {
+	messages chan []byte
+	// closed to make the writer disconnect the client
+	kick     chan struct{}
+	kickOnce sync.Once
+	// closed when the connection is unregistered
+	done chan struct{}
+	// closed by the writer when it exits
+	stopped chan struct{}
+}
+
+// Events that are sent periodically, so a client that misses one gets the next
+var droppableEvents = map[string]struct{}{
+	"STREAM_STATS":  {},
+	"STREAM_HEALTH": {},
 }
 
 func Init(rtcDC chan string) *SocketServer {
 	ss := &SocketServer{
 		Connections: Connections{
-			data: make(map[*websocket.Conn]string),
+			data:    make(map[*websocket.Conn]string),
+			sids:    make(map[*websocket.Conn]string),
+			devices: make(map[*websocket.Conn]string),
+			ids:     make(map[*websocket.Conn]string),
+			byID:    make(map[string]*websocket.Conn),
+			byUid:   make(map[string]map[*websocket.Conn]struct{}),
+			queues:  make(map[*websocket.Conn]*sendQueue),
 		},
 
 		SendData:            make(chan SendData),
 		SendDataToUid:       make(chan SendDataToUid),
 		SendDataToUids:      make(chan SendDataToUids),
 		SendDataToConns:     make(chan SendDataToConns),
+		SendDataToConnID:    make(chan SendDataToConnID),
+		SendDataToConnIDs:   make(chan SendDataToConnIDs),
 		SendDataToAll:       make(chan SendDataToAll),
 		SendDataToAllExcept: make(chan SendDataToAllExcept),
 
-		MessageLoop: make(chan Message),
-
 		RegisterConn:   make(chan ConnectionData),
 		UnregisterConn: make(chan *websocket.Conn),
+
+		GetSessionConns: make(chan GetSessionConns),
+		GetDeviceConns:  make(chan GetDeviceConns),
+
+		sendQueueSize: intFromEnv("SOCKET_SEND_QUEUE_SIZE", 64),
+		writeTimeout:  time.Second * time.Duration(intFromEnv("SOCKET_WRITE_TIMEOUT_SECONDS", 10)),
+		pingInterval:  time.Second * time.Duration(intFromEnv("SOCKET_PING_INTERVAL_SECONDS", 25)),
+		pongTimeout:   time.Second * time.Duration(intFromEnv("SOCKET_PONG_TIMEOUT_SECONDS", 60)),
+	}
+	if ss.pongTimeout <= ss.pingInterval {
+		log.Println("SOCKET_PONG_TIMEOUT_SECONDS should be longer than SOCKET_PING_INTERVAL_SECONDS, using double the ping interval")
+		ss.pongTimeout = ss.pingInterval * 2
 	}
 	runServer(ss, rtcDC)
 	return ss
@@ -106,37 +208,89 @@ func runServer(ss *SocketServer, rtcDC chan string) {
 	go sendDataMulti(ss)
 	go sendDataToUid(ss)
 	go sendDataToUids(ss)
+	go sendDataToConnID(ss)
+	go sendDataToConnIDs(ss)
 	go sendDataToAll(ss)
 	go sendDataToAllExcept(ss)
-	go messageLoop(ss)
 	go registerConn(ss)
 	go unregisterConn(ss, rtcDC)
+	go getSessionConns(ss)
+	go getDeviceConns(ss)
+}
+
+// Sets the read deadline, which is pushed back whenever a pong comes in. onPong is called
+// for every pong, from the reader goroutine. Must be called from the connections reader
+// goroutine before it starts reading.
+func WatchPongs(c *websocket.Conn, ss *SocketServer, onPong func()) {
+	c.SetReadDeadline(time.Now().Add(ss.pongTimeout))
+	c.SetPongHandler(func(string) error {
+		onPong()
+		return c.SetReadDeadline(time.Now().Add(ss.pongTimeout))
+	})
+}
+
+// Pushes back the read deadline, for when a message other than a pong is read
+func ExtendReadDeadline(c *websocket.Conn, ss *SocketServer) {
+	c.SetReadDeadline(time.Now().Add(ss.pongTimeout))
 }
 
+// Queues the event for the connection. Never blocks.
 func WriteMessage(t string, m interface{}, c *websocket.Conn, ss *SocketServer) {
-	withType := make(map[string]interface{})
-	withType["event"] = t
-	withType["data"] = m
+	if c == nil {
+		return
+	}
+
+	if b, err := encodeEvent(t, m); err == nil {
+		ss.Connections.mutex.RLock()
+		enqueue(ss, c, t, b)
+		ss.Connections.mutex.RUnlock()
+	}
+}
 
+// Queues a message that isn't wrapped in an event. Never blocks.
+func WriteJSON(v interface{}, c *websocket.Conn, ss *SocketServer) {
 	if c == nil {
 		return
 	}
 
-	if b, err := json.Marshal(withType); err == nil {
-		ss.MessageLoop <- Message{
-			Conn: c,
-			Data: b,
-		}
+	if b, err := json.Marshal(v); err == nil {
+		ss.Connections.mutex.RLock()
+		enqueue(ss, c, "", b)
+		ss.Connections.mutex.RUnlock()
 	}
 }
 
 // ------ Loops ------ //
 
-func messageLoop(ss *SocketServer) {
-	for {
-		data := <-ss.MessageLoop
+// One per connection, the only place anything is written to the connection
+func writePump(ss *SocketServer, c *websocket.Conn, q *sendQueue) {
+	ticker := time.NewTicker(ss.pingInterval)
+	defer ticker.Stop()
+	defer close(q.stopped)
 
-		data.Conn.WriteMessage(1, data.Data)
+	for {
+		select {
+		case <-ticker.C:
+			c.SetWriteDeadline(time.Now().Add(ss.writeTimeout))
+			if err := c.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.Close()
+				return
+			}
+		case b := <-q.messages:
+			c.SetWriteDeadline(time.Now().Add(ss.writeTimeout))
+			if err := c.WriteMessage(websocket.TextMessage, b); err != nil {
+				// closing makes the reader return, which unregisters the connection
+				c.Close()
+				return
+			}
+		case <-q.kick:
+			c.SetWriteDeadline(time.Now().Add(ss.writeTimeout))
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Too slow"))
+			c.Close()
+			return
+		case <-q.done:
+			return
+		}
 	}
 }
 
@@ -152,16 +306,18 @@ func sendDataToUid(ss *SocketServer) {
 	for {
 		data := <-ss.SendDataToUid
 
-		ss.Connections.mutex.Lock()
+		b, err := encodeEvent(data.EventName, data.Data)
+		if err != nil {
+			continue
+		}
 
-		for conn, uid := range ss.Connections.data {
-			if uid == data.Uid {
-				WriteMessage(data.EventName, data.Data, conn, ss)
-				break
-			}
+		ss.Connections.mutex.RLock()
+
+		for c := range ss.Connections.byUid[data.Uid] {
+			enqueue(ss, c, data.EventName, b)
 		}
 
-		ss.Connections.mutex.Unlock()
+		ss.Connections.mutex.RUnlock()
 	}
 }
 
@@ -169,17 +325,60 @@ func sendDataToUids(ss *SocketServer) {
 	for {
 		data := <-ss.SendDataToUids
 
-		ss.Connections.mutex.Lock()
+		b, err := encodeEvent(data.EventName, data.Data)
+		if err != nil {
+			continue
+		}
+
+		ss.Connections.mutex.RLock()
 
-		for k := range data.Uids {
-			for c, uid := range ss.Connections.data {
-				if uid == k {
-					WriteMessage(data.EventName, data.Data, c, ss)
-				}
+		for uid := range data.Uids {
+			for c := range ss.Connections.byUid[uid] {
+				enqueue(ss, c, data.EventName, b)
 			}
 		}
 
-		ss.Connections.mutex.Unlock()
+		ss.Connections.mutex.RUnlock()
+	}
+}
+
+func sendDataToConnID(ss *SocketServer) {
+	for {
+		data := <-ss.SendDataToConnID
+
+		b, err := encodeEvent(data.EventName, data.Data)
+		if err != nil {
+			continue
+		}
+
+		ss.Connections.mutex.RLock()
+
+		if c, ok := ss.Connections.byID[data.ConnID]; ok {
+			enqueue(ss, c, data.EventName, b)
+		}
+
+		ss.Connections.mutex.RUnlock()
+	}
+}
+
+func sendDataToConnIDs(ss *SocketServer) {
+	for {
+		data := <-ss.SendDataToConnIDs
+
+		b, err := encodeEvent(data.EventName, data.Data)
+		if err != nil {
+			continue
+		}
+
+		ss.Connections.mutex.RLock()
+
+		for id := range data.ConnIDs {
+			if c, ok := ss.Connections.byID[id]; ok {
+				enqueue(ss, c, data.EventName, b)
+			}
+		}
+
+		ss.Connections.mutex.RUnlock()
 	}
 }
 
@@ -201,13 +400,18 @@ func sendDataToAll(ss *SocketServer) {
 	for {
 		data := <-ss.SendDataToAll
 
-		ss.Connections.mutex.Lock()
+		b, err := encodeEvent(data.EventName, data.Data)
+		if err != nil {
+			continue
+		}
+
+		ss.Connections.mutex.RLock()
 
 		for c := range ss.Connections.data {
-			WriteMessage(data.EventName, data.Data, c, ss)
+			enqueue(ss, c, data.EventName, b)
 		}
 
-		ss.Connections.mutex.Unlock()
+		ss.Connections.mutex.RUnlock()
 	}
 }
 
@@ -215,15 +419,20 @@ func sendDataToAllExcept(ss *SocketServer) {
 	for {
 		data := <-ss.SendDataToAllExcept
 
-		ss.Connections.mutex.Lock()
+		b, err := encodeEvent(data.EventName, data.Data)
+		if err != nil {
+			continue
+		}
+
+		ss.Connections.mutex.RLock()
 
 		for c, uid := range ss.Connections.data {
-			if uid != data.Exclude {
-				WriteMessage(data.EventName, data.Data, c, ss)
+			if uid != data.Exclude && ss.Connections.ids[c] != data.ExcludeConnID {
+				enqueue(ss, c, data.EventName, b)
 			}
 		}
 
-		ss.Connections.mutex.Unlock()
+		ss.Connections.mutex.RUnlock()
 	}
 }
 
@@ -234,6 +443,28 @@ func registerConn(ss *SocketServer) {
 		ss.Connections.mutex.Lock()
 
 		ss.Connections.data[data.Conn] = data.Uid
+		if data.Sid != "" {
+			ss.Connections.sids[data.Conn] = data.Sid
+		}
+		if data.DeviceID != "" {
+			ss.Connections.devices[data.Conn] = data.DeviceID
+		}
+		ss.Connections.ids[data.Conn] = data.ID
+		ss.Connections.byID[data.ID] = data.Conn
+		if _, ok := ss.Connections.byUid[data.Uid]; !ok {
+			ss.Connections.byUid[data.Uid] = make(map[*websocket.Conn]struct{})
+		}
+		ss.Connections.byUid[data.Uid][data.Conn] = struct{}{}
+		if _, ok := ss.Connections.queues[data.Conn]; !ok {
+			q := &sendQueue{
+				messages: make(chan []byte, ss.sendQueueSize),
+				kick:     make(chan struct{}),
+				done:     make(chan struct{}),
+				stopped:  data.WriterStopped,
+			}
+			ss.Connections.queues[data.Conn] = q
+			go writePump(ss, data.Conn, q)
+		}
 
 		ss.Connections.mutex.Unlock()
 	}
@@ -245,12 +476,116 @@ func unregisterConn(ss *SocketServer, rtcDC chan string) {
 
 		ss.Connections.mutex.Lock()
 
-		if uid, ok := ss.Connections.data[conn]; ok {
-			rtcDC <- uid
+		id, registered := ss.Connections.ids[conn]
+
+		if q, ok := ss.Connections.queues[conn]; ok {
+			close(q.done)
 		}
 
+		if uid, ok := ss.Connections.data[conn]; ok {
+			delete(ss.Connections.byUid[uid], conn)
+			if len(ss.Connections.byUid[uid]) == 0 {
+				delete(ss.Connections.byUid, uid)
+			}
+		}
 		delete(ss.Connections.data, conn)
+		delete(ss.Connections.sids, conn)
+		delete(ss.Connections.devices, conn)
+		delete(ss.Connections.ids, conn)
+		delete(ss.Connections.byID, id)
+		delete(ss.Connections.queues, conn)
 
 		ss.Connections.mutex.Unlock()
+
+		// after unlocking, the WebRTC server might be waiting to send something to a socket
+		if registered {
+			rtcDC <- id
+		}
+	}
+}
+
+func getSessionConns(ss *SocketServer) {
+	for {
+		data := <-ss.GetSessionConns
+
+		ss.Connections.mutex.RLock()
+
+		conns := []ConnectionData{}
+		for c, sid := range ss.Connections.sids {
+			if sid == data.Sid {
+				conns = append(conns, ConnectionData{
+					ID:   ss.Connections.ids[c],
+					Uid:  ss.Connections.data[c],
+					Sid:  sid,
+					Conn: c,
+				})
+			}
+		}
+
+		ss.Connections.mutex.RUnlock()
+
+		data.RecvChan <- conns
+	}
+}
+
+func getDeviceConns(ss *SocketServer) {
+	for {
+		data := <-ss.GetDeviceConns
+
+		ss.Connections.mutex.RLock()
+
+		conns := []ConnectionData{}
+		for c, deviceID := range ss.Connections.devices {
+			if deviceID == data.DeviceID {
+				conns = append(conns, ConnectionData{
+					ID:       ss.Connections.ids[c],
+					Uid:      ss.Connections.data[c],
+					DeviceID: deviceID,
+					Conn:     c,
+				})
+			}
+		}
+
+		ss.Connections.mutex.RUnlock()
+
+		data.RecvChan <- conns
+	}
+}
+
+// ------ Helper functions ------ //
+
+func encodeEvent(t string, m interface{}) ([]byte, error) {
+	withType := make(map[string]interface{})
+	withType["event"] = t
+	withType["data"] = m
+
+	return json.Marshal(withType)
+}
+
+// Must be called with the connections mutex locked, for reading is enough. Connections
+// that haven't been registered are ignored.
+func enqueue(ss *SocketServer, c *websocket.Conn, t string, b []byte) {
+	q, ok := ss.Connections.queues[c]
+	if !ok {
+		return
+	}
+
+	select {
+	case q.messages <- b:
+	default:
+		if _, ok := droppableEvents[t]; ok {
+			return
+		}
+		q.kickOnce.Do(func() {
+			log.Printf("Disconnecting slow socket client %v, send queue full", ss.Connections.data[c])
+			close(q.kick)
+		})
+	}
+}
+
+func intFromEnv(key string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
 	}
+	return fallback
 }
@@ -1,28 +1,34 @@
 package socketvalidation
 
 type StreamInfo struct {
-	MediaStreamID string `json:"media_stream_id"`
-	StreamName    string `json:"name"`
+	MediaStreamID string `json:"media_stream_id" validate:"required,lte=128"`
+	StreamName    string `json:"name" validate:"required,lte=24"`
 	Motion        bool   `json:"motion"`
 }
 
+// Signals are whole SDP offers and answers, trickle ICE is disabled so they include
+// every candidate, which is why the limit is so high.
+
 // WEBRTC_SENDING_SIGNAL
 type WebRTCSendingSignal struct {
-	Signal      string       `json:"signal" validation:"required,lte=4000"`
-	Uid         string       `json:"to_uid"`
-	StreamsInfo []StreamInfo `json:"streams_info"`
+	Signal string `json:"signal" validate:"required,lte=16000"`
+	Uid    string `json:"to_uid" validate:"required_without=ConnID,omitempty,uuid"`
+	// the peer being signalled, to_uid is only used by clients that don't send it
+	ConnID      string       `json:"to_conn_id" validate:"omitempty,uuid"`
+	StreamsInfo []StreamInfo `json:"streams_info" validate:"lte=16,dive"`
 }
 
 // WEBRTC_RETURNING_SIGNAL
 type WebRTCReturningSignal struct {
-	Signal      string       `json:"signal" validation:"required,lte=4000"`
-	CallerID    string       `json:"caller_id"`
-	StreamsInfo []StreamInfo `json:"streams_info"`
+	Signal       string       `json:"signal" validate:"required,lte=16000"`
+	CallerID     string       `json:"caller_id" validate:"required_without=CallerConnID,omitempty,uuid"`
+	CallerConnID string       `json:"caller_conn_id" validate:"omitempty,uuid"`
+	StreamsInfo  []StreamInfo `json:"streams_info" validate:"lte=16,dive"`
 }
 
 // WEBRTC_JOIN
 type WebRTCJoin struct {
-	StreamsInfo []StreamInfo `json:"streams_info"`
+	StreamsInfo []StreamInfo `json:"streams_info" validate:"lte=16,dive"`
 }
 
 // WEBRTC_LEAVE
@@ -30,6 +36,12 @@ type WebRTCLeave struct{}
 
 // WEBRTC_MOTION_UPDATE
 type WebRTCMotionUpdate struct {
-	MediaStreamID string `json:"media_stream_id"`
+	MediaStreamID string `json:"media_stream_id" validate:"required,lte=128"`
 	Motion        bool   `json:"motion"`
 }
+
+// STATS_SUBSCRIBE
+type StatsSubscribe struct{}
+
+// STATS_UNSUBSCRIBE
+type StatsUnsubscribe struct{}
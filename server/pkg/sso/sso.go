@@ -0,0 +1,276 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+/*
+Single sign-on with an OpenID Connect identity provider, using the authorization
+code flow with PKCE. Configured with environment variables, and disabled when
+OIDC_ISSUER isn't set:
+
+OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET (leave empty for public clients),
+OIDC_REDIRECT_URL (the callback route on this server), OIDC_CLIENT_REDIRECT (where
+the browser is sent after logging in), OIDC_GROUPS_CLAIM (defaults to "groups"),
+OIDC_SCOPES (defaults to "openid profile email groups"), OIDC_ADMIN_GROUPS,
+OIDC_STREAMER_GROUPS and OIDC_VIEWER_GROUPS (comma separated group names), and
+OIDC_DEFAULT_ROLE for users in none of the groups. Users in none
+of the groups can't log in if there is no default role.
+
+Logins that have been started but not finished are kept in memory for 10 minutes.
+dex/config.yaml has a Dex config for trying it out locally.
+*/
+
+type SSO struct {
+	Config Config
+
+	provider *oidc.Provider
+	// key is the state param
+	pending map[string]PendingLogin
+	mutex   sync.Mutex
+}
+
+type Config struct {
+	Issuer         string
+	ClientID       string
+	ClientSecret   string
+	RedirectURL    string
+	ClientRedirect string
+	GroupsClaim    string
+	Scopes         []string
+	// key is the group name, value is the role
+	GroupRoles  map[string]string
+	DefaultRole string
+}
+
+type PendingLogin struct {
+	Nonce     string
+	Verifier  string
+	CreatedAt time.Time
+}
+
+// Claims from the ID token, after mapping the groups to a role
+type Identity struct {
+	Subject  string
+	Username string
+	Email    string
+	// empty if the user isn't in any group with a role and there is no default role
+	Role string
+}
+
+var ErrUnknownState = errors.New("Unknown or expired login")
+
+const pendingLifetime = time.Minute * 10
+
+// roles in order of precedence, a user in more than one group gets the highest role
+var rolePrecedence = []string{"admin", "streamer", "viewer"}
+
+// Returns nil when single sign-on isn't configured
+func Init() *SSO {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+
+	cfg := Config{
+		Issuer:         issuer,
+		ClientID:       os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:   os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:    os.Getenv("OIDC_REDIRECT_URL"),
+		ClientRedirect: os.Getenv("OIDC_CLIENT_REDIRECT"),
+		GroupsClaim:    os.Getenv("OIDC_GROUPS_CLAIM"),
+		GroupRoles:     make(map[string]string),
+		DefaultRole:    os.Getenv("OIDC_DEFAULT_ROLE"),
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	cfg.Scopes = strings.Fields(os.Getenv("OIDC_SCOPES"))
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{oidc.ScopeOpenID, "profile", "email", "groups"}
+	}
+	if cfg.ClientRedirect == "" {
+		cfg.ClientRedirect = "/"
+	}
+	// set the lower roles first so that a group listed under more than one role gets the highest
+	for i := len(rolePrecedence) - 1; i >= 0; i-- {
+		role := rolePrecedence[i]
+		for _, group := range strings.Split(os.Getenv("OIDC_"+strings.ToUpper(role)+"_GROUPS"), ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				cfg.GroupRoles[group] = role
+			}
+		}
+	}
+
+	s := &SSO{
+		Config:  cfg,
+		pending: make(map[string]PendingLogin),
+	}
+	go s.sweepPending()
+	return s
+}
+
+// Discovery is done on first use rather than at startup, so that the server can start
+// before the identity provider is reachable
+func (s *SSO) oauth2Config(ctx context.Context) (*oauth2.Config, *oidc.Provider, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.provider == nil {
+		provider, err := oidc.NewProvider(ctx, s.Config.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.provider = provider
+	}
+
+	return &oauth2.Config{
+		ClientID:     s.Config.ClientID,
+		ClientSecret: s.Config.ClientSecret,
+		RedirectURL:  s.Config.RedirectURL,
+		Endpoint:     s.provider.Endpoint(),
+		Scopes:       s.Config.Scopes,
+	}, s.provider, nil
+}
+
+// Starts a login. Returns the state, which the caller should also keep in a cookie to
+// check that the callback comes from the same browser, and the URL to redirect to.
+func (s *SSO) Begin(ctx context.Context) (state string, url string, err error) {
+	config, _, err := s.oauth2Config(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state = randomString()
+	login := PendingLogin{
+		Nonce:     randomString(),
+		Verifier:  randomString(),
+		CreatedAt: time.Now(),
+	}
+	challenge := sha256.Sum256([]byte(login.Verifier))
+
+	s.mutex.Lock()
+	s.pending[state] = login
+	s.mutex.Unlock()
+
+	url = config.AuthCodeURL(state,
+		oidc.Nonce(login.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
+	return state, url, nil
+}
+
+// Exchanges the code from the callback for tokens, and verifies the ID token
+func (s *SSO) Complete(ctx context.Context, state string, code string) (Identity, error) {
+	s.mutex.Lock()
+	login, ok := s.pending[state]
+	delete(s.pending, state)
+	s.mutex.Unlock()
+
+	if !ok || time.Since(login.CreatedAt) > pendingLifetime {
+		return Identity{}, ErrUnknownState
+	}
+
+	config, provider, err := s.oauth2Config(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	token, err := config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", login.Verifier))
+	if err != nil {
+		return Identity{}, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Identity{}, errors.New("No ID token in token response")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: s.Config.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return Identity{}, err
+	}
+	if idToken.Nonce != login.Nonce {
+		return Identity{}, errors.New("ID token nonce mismatch")
+	}
+
+	claims := make(map[string]interface{})
+	if err = idToken.Claims(&claims); err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{
+		Subject:  idToken.Subject,
+		Username: stringClaim(claims, "preferred_username"),
+		Email:    stringClaim(claims, "email"),
+		Role:     s.roleFor(claims),
+	}
+	if identity.Username == "" {
+		identity.Username, _, _ = strings.Cut(identity.Email, "@")
+	}
+	if identity.Username == "" {
+		identity.Username = stringClaim(claims, "name")
+	}
+	return identity, nil
+}
+
+func (s *SSO) roleFor(claims map[string]interface{}) string {
+	roles := make(map[string]bool)
+	if groups, ok := claims[s.Config.GroupsClaim].([]interface{}); ok {
+		for _, g := range groups {
+			if group, ok := g.(string); ok {
+				if role, ok := s.Config.GroupRoles[group]; ok {
+					roles[role] = true
+				}
+			}
+		}
+	}
+	for _, role := range rolePrecedence {
+		if roles[role] {
+			return role
+		}
+	}
+	return s.Config.DefaultRole
+}
+
+func (s *SSO) sweepPending() {
+	for {
+		time.Sleep(time.Minute)
+
+		s.mutex.Lock()
+
+		for state, login := range s.pending {
+			if time.Since(login.CreatedAt) > pendingLifetime {
+				delete(s.pending, state)
+			}
+		}
+
+		s.mutex.Unlock()
+	}
+}
+
+func stringClaim(claims map[string]interface{}, key string) string {
+	if v, ok := claims[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalln("Failed to generate random string:", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,286 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testClientID = "vid-streams"
+
+// Minimal OpenID Connect provider, with discovery, a JWKS and a token endpoint
+// that checks the PKCE verifier
+type fakeProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// key is the authorization code
+	codes map[string]fakeGrant
+	mutex sync.Mutex
+}
+
+type fakeGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := &fakeProvider{key: key, codes: make(map[string]fakeGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                fp.server.URL,
+			"authorization_endpoint":                fp.server.URL + "/auth",
+			"token_endpoint":                        fp.server.URL + "/token",
+			"jwks_uri":                              fp.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		fp.mutex.Lock()
+		grant, ok := fp.codes[r.PostForm.Get("code")]
+		delete(fp.codes, r.PostForm.Get("code"))
+		fp.mutex.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, "signing failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   300,
+			"id_token":     idToken,
+		})
+	})
+	fp.server = httptest.NewServer(mux)
+	t.Cleanup(fp.server.Close)
+	return fp
+}
+
+// Stands in for the user logging in at the authorization endpoint. Returns the code
+// the provider would redirect back with.
+func (fp *fakeProvider) authorize(challenge string, claims jwt.MapClaims) string {
+	code := randomString()
+	fp.mutex.Lock()
+	fp.codes[code] = fakeGrant{challenge: challenge, claims: claims}
+	fp.mutex.Unlock()
+	return code
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func newTestSSO(issuer string, defaultRole string) *SSO {
+	return &SSO{
+		Config: Config{
+			Issuer:      issuer,
+			ClientID:    testClientID,
+			RedirectURL: "http://localhost:8080/api/auth/oidc/callback",
+			GroupsClaim: "groups",
+			Scopes:      []string{"openid", "profile", "email", "groups"},
+			GroupRoles:  map[string]string{"admins": "admin", "streamers": "streamer", "viewers": "viewer"},
+			DefaultRole: defaultRole,
+		},
+		pending: make(map[string]PendingLogin),
+	}
+}
+
+func TestComplete(t *testing.T) {
+	fp := newFakeProvider(t)
+
+	tests := []struct {
+		name        string
+		defaultRole string
+		claims      jwt.MapClaims
+		// replaces the nonce from the authorization URL
+		nonce string
+		// replaces the code challenge from the authorization URL
+		challenge string
+		want      Identity
+		wantErr   bool
+	}{
+		{
+			name:   "highest role of the user's groups",
+			claims: jwt.MapClaims{"preferred_username": "kilgore", "email": "kilgore@example.com", "groups": []string{"viewers", "admins", "other"}},
+			want:   Identity{Subject: "sub", Username: "kilgore", Email: "kilgore@example.com", Role: "admin"},
+		},
+		{
+			name:        "default role when in none of the groups",
+			defaultRole: "viewer",
+			claims:      jwt.MapClaims{"preferred_username": "kilgore", "groups": []string{"other"}},
+			want:        Identity{Subject: "sub", Username: "kilgore", Role: "viewer"},
+		},
+		{
+			name:   "no role without a default",
+			claims: jwt.MapClaims{"preferred_username": "kilgore"},
+			want:   Identity{Subject: "sub", Username: "kilgore"},
+		},
+		{
+			name:   "username from the email",
+			claims: jwt.MapClaims{"email": "kilgore@example.com", "groups": []string{"streamers"}},
+			want:   Identity{Subject: "sub", Username: "kilgore", Email: "kilgore@example.com", Role: "streamer"},
+		},
+		{
+			name:   "username from the name",
+			claims: jwt.MapClaims{"name": "Kilgore Trout"},
+			want:   Identity{Subject: "sub", Username: "Kilgore Trout"},
+		},
+		{
+			name:    "nonce mismatch",
+			claims:  jwt.MapClaims{"preferred_username": "kilgore"},
+			nonce:   "another nonce",
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			claims:  jwt.MapClaims{"preferred_username": "kilgore", "aud": "another client"},
+			wantErr: true,
+		},
+		{
+			name:    "expired ID token",
+			claims:  jwt.MapClaims{"preferred_username": "kilgore", "exp": time.Now().Add(-time.Minute).Unix()},
+			wantErr: true,
+		},
+		{
+			name:      "wrong code verifier",
+			claims:    jwt.MapClaims{"preferred_username": "kilgore"},
+			challenge: "not the challenge",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestSSO(fp.server.URL, tt.defaultRole)
+
+			state, authURL, err := s.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(authURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := u.Query()
+			if query.Get("state") != state || query.Get("code_challenge_method") != "S256" {
+				t.Fatalf("unexpected authorization URL %q", authURL)
+			}
+
+			claims := jwt.MapClaims{
+				"iss":   fp.server.URL,
+				"aud":   testClientID,
+				"sub":   "sub",
+				"iat":   time.Now().Unix(),
+				"exp":   time.Now().Add(time.Minute).Unix(),
+				"nonce": query.Get("nonce"),
+			}
+			if tt.nonce != "" {
+				claims["nonce"] = tt.nonce
+			}
+			for k, v := range tt.claims {
+				claims[k] = v
+			}
+			challenge := query.Get("code_challenge")
+			if tt.challenge != "" {
+				challenge = tt.challenge
+			}
+
+			got, err := s.Complete(ctx, state, fp.authorize(challenge, claims))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompleteUnknownState(t *testing.T) {
+	fp := newFakeProvider(t)
+	ctx := context.Background()
+	s := newTestSSO(fp.server.URL, "")
+
+	if _, err := s.Complete(ctx, "unknown", "code"); !errors.Is(err, ErrUnknownState) {
+		t.Errorf("unknown state: expected ErrUnknownState, got %v", err)
+	}
+
+	state, _, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a failed exchange still uses up the state
+	if _, err := s.Complete(ctx, state, "bad code"); err == nil || errors.Is(err, ErrUnknownState) {
+		t.Errorf("bad code: expected an exchange error, got %v", err)
+	}
+	if _, err := s.Complete(ctx, state, "bad code"); !errors.Is(err, ErrUnknownState) {
+		t.Errorf("reused state: expected ErrUnknownState, got %v", err)
+	}
+
+	state, _, err = s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Lock()
+	login := s.pending[state]
+	login.CreatedAt = time.Now().Add(-pendingLifetime - time.Second)
+	s.pending[state] = login
+	s.mutex.Unlock()
+	if _, err := s.Complete(ctx, state, "code"); !errors.Is(err, ErrUnknownState) {
+		t.Errorf("expired state: expected ErrUnknownState, got %v", err)
+	}
+}
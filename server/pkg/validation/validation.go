@@ -1,14 +1,108 @@
 package validation
 
-type StreamerLoginRegister struct {
-	Name string `json:"name" validate:"required,gte=2,lte=16"`
+type InitialLogin struct {
+	Username string `json:"username" validate:"required,gte=2,lte=16"`
+	Password string `json:"password" validate:"required,lte=72"`
+	// shown when listing sessions, so that the user can tell their devices apart
+	DeviceLabel string `json:"device_label" validate:"lte=48"`
 }
 
-type InitialLogin struct {
-	StreamerName   string `json:"streamer_name" validate:"required,gte=2,lte=16"`
-	ServerPassword string `json:"server_password" validate:"required,gte=8,lte=72"`
+type Register struct {
+	// not required when registering the first account, or when claiming an existing account
+	Username    string `json:"username" validate:"omitempty,gte=2,lte=16"`
+	Password    string `json:"password" validate:"required,gte=8,lte=72"`
+	InviteCode  string `json:"invite_code" validate:"lte=64"`
+	DeviceLabel string `json:"device_label" validate:"lte=48"`
+}
+
+type ChangePassword struct {
+	CurrentPassword string `json:"current_password" validate:"required,lte=72"`
+	NewPassword     string `json:"new_password" validate:"required,gte=8,lte=72"`
+}
+
+type CreateInvite struct {
+	Role string `json:"role" validate:"required,oneof=admin streamer viewer"`
+	// set to let a user from before accounts existed claim their streamer
+	UserID *string `json:"user_id" validate:"omitempty,uuid"`
+}
+
+type SetRole struct {
+	Role string `json:"role" validate:"required,oneof=admin streamer viewer"`
 }
 
 type CreateStream struct {
 	Name string `json:"name" validate:"required,gte=2,lte=16"`
 }
+
+type ArmWindow struct {
+	Day   int    `json:"day" validate:"gte=0,lte=6"`
+	Start string `json:"start" validate:"required,len=5"`
+	End   string `json:"end" validate:"required,len=5"`
+}
+
+type ArmSchedule struct {
+	Timezone string      `json:"timezone" validate:"required,lte=64"`
+	Windows  []ArmWindow `json:"windows" validate:"lte=64,dive"`
+}
+
+type ArmOverride struct {
+	// null clears the override
+	Armed *bool `json:"armed"`
+}
+
+type NotificationSubscription struct {
+	Channel     string   `json:"channel" validate:"required,oneof=EMAIL NTFY WEBHOOK"`
+	Target      string   `json:"target" validate:"required,lte=512"`
+	StreamName  *string  `json:"stream_name" validate:"omitempty,gte=2,lte=24"`
+	Streamer    *string  `json:"streamer" validate:"omitempty,uuid"`
+	Events      []string `json:"events" validate:"required,gte=1,dive,oneof=MOTION_START CAMERA_OFFLINE"`
+	QuietStart  *string  `json:"quiet_start" validate:"required_with=QuietEnd,omitempty,len=5"`
+	QuietEnd    *string  `json:"quiet_end" validate:"required_with=QuietStart,omitempty,len=5"`
+	Timezone    string   `json:"timezone" validate:"required,lte=64"`
+	MinInterval int      `json:"min_interval" validate:"gte=0,lte=86400"`
+}
+
+type CreateDevice struct {
+	Label      string   `json:"label" validate:"required,gte=2,lte=48"`
+	StreamerID string   `json:"streamer_id" validate:"required,uuid"`
+	Streams    []string `json:"streams" validate:"required,gte=1,lte=16,dive,gte=2,lte=24"`
+}
+
+type RequestPairing struct {
+	Label string `json:"label" validate:"required,gte=2,lte=48"`
+}
+
+type ApprovePairing struct {
+	Code       string   `json:"code" validate:"required,len=6,numeric"`
+	StreamerID string   `json:"streamer_id" validate:"required,uuid"`
+	Streams    []string `json:"streams" validate:"required,gte=1,lte=16,dive,gte=2,lte=24"`
+}
+
+type LoginTwoFactor struct {
+	Challenge string `json:"challenge" validate:"required,lte=1024"`
+	// a TOTP code or a recovery code
+	Code        string `json:"code" validate:"required,lte=16"`
+	DeviceLabel string `json:"device_label" validate:"lte=48"`
+}
+
+type TwoFactorCode struct {
+	Code string `json:"code" validate:"required,len=6,numeric"`
+}
+
+type DisableTwoFactor struct {
+	Password string `json:"password" validate:"required,lte=72"`
+	Code     string `json:"code" validate:"required,lte=16"`
+}
+
+type Settings struct {
+	RequireAdminTwoFactor *bool `json:"require_admin_two_factor"`
+}
+
+type ShareRecording struct {
+	ExpiresInMinutes int `json:"expires_in_minutes" validate:"required,gte=1,lte=43200"`
+	// optional clip range, in seconds from the start of the recording
+	StartSeconds *int `json:"start_seconds" validate:"required_with=EndSeconds,omitempty,gte=0"`
+	EndSeconds   *int `json:"end_seconds" validate:"required_with=StartSeconds,omitempty,gtfield=StartSeconds"`
+	// null for unlimited downloads
+	MaxDownloads *int `json:"max_downloads" validate:"omitempty,gte=1,lte=1000"`
+}
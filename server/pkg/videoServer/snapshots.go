@@ -0,0 +1,136 @@
+package videoserver
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Cameras periodically upload a JPEG of what they're seeing. Only the latest one
+for each stream is kept in memory. A recording gets its thumbnail from the first
+snapshot uploaded for it, and the thumbnail is replaced with the latest snapshot
+whenever motion starts, since that is the most useful frame to show.
+*/
+
+// ------ Mutex protected ------ //
+
+type Snapshots struct {
+	// outer map key is streamer uid, inner map key is stream name
+	data  map[string]map[string]Snapshot
+	mutex sync.RWMutex
+}
+
+// ------ Channel structs ------ //
+
+type SetSnapshot struct {
+	Uid       string
+	Name      string
+	Data      []byte
+	ErrorChan chan error
+}
+
+type GetSnapshot struct {
+	// if Uid is empty the first stream found with a matching name is used
+	Uid      string
+	Name     string
+	RecvChan chan *Snapshot
+}
+
+type MotionStart struct {
+	Uid  string
+	Name string
+}
+
+// ------ General structs ------ //
+
+type Snapshot struct {
+	Data      []byte
+	CreatedAt time.Time
+}
+
+// ------ Loops ------ //
+
+func setSnapshot(vs *VideoServer, db *pgxpool.Pool) {
+	for {
+		data := <-vs.SetSnapshot
+
+		vs.Snapshots.mutex.Lock()
+
+		if _, ok := vs.Snapshots.data[data.Uid]; !ok {
+			vs.Snapshots.data[data.Uid] = make(map[string]Snapshot)
+		}
+		vs.Snapshots.data[data.Uid][data.Name] = Snapshot{
+			Data:      data.Data,
+			CreatedAt: time.Now(),
+		}
+
+		vs.Snapshots.mutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		_, err := db.Exec(ctx, `
+			UPDATE vid_meta SET thumbnail = $1 WHERE LOWER(name) = LOWER($2) AND streamer = $3 AND thumbnail IS NULL;
+		`, data.Data, data.Name, data.Uid)
+		cancel()
+
+		data.ErrorChan <- err
+	}
+}
+
+func getSnapshot(vs *VideoServer) {
+	for {
+		data := <-vs.GetSnapshot
+
+		vs.Snapshots.mutex.RLock()
+
+		data.RecvChan <- findSnapshot(vs, data.Uid, data.Name)
+
+		vs.Snapshots.mutex.RUnlock()
+	}
+}
+
+func motionStart(vs *VideoServer, db *pgxpool.Pool) {
+	for {
+		data := <-vs.MotionStart
+
+		vs.Snapshots.mutex.RLock()
+
+		snapshot := findSnapshot(vs, data.Uid, data.Name)
+
+		vs.Snapshots.mutex.RUnlock()
+
+		if snapshot == nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		if _, err := db.Exec(ctx, `
+			UPDATE vid_meta SET thumbnail = $1 WHERE LOWER(name) = LOWER($2) AND streamer = $3;
+		`, snapshot.Data, data.Name, data.Uid); err != nil {
+			log.Println("Failed to save motion start thumbnail:", err)
+		}
+		cancel()
+	}
+}
+
+// ------ Helper functions ------ //
+
+// must be called with the mutex locked
+func findSnapshot(vs *VideoServer, uid string, name string) *Snapshot {
+	for u, streams := range vs.Snapshots.data {
+		if uid != "" && u != uid {
+			continue
+		}
+		for n, snapshot := range streams {
+			if strings.EqualFold(n, name) {
+				s := snapshot
+				return &s
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package videoserver
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
+	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
+)
+
+/*
+Ingest statistics for each stream, updated as chunks arrive through HandleChunk.
+Bitrate and chunk rate are calculated over a sliding window of the last minute.
+Clients send STATS_SUBSCRIBE over the socket to receive STREAM_STATS every few seconds.
+*/
+
+// ------ Mutex protected ------ //
+
+type Stats struct {
+	// outer map key is streamer uid, inner map key is the lowercased stream name, since
+	// stream names are case insensitive
+	data  map[string]map[string]*StreamStats
+	mutex sync.RWMutex
+}
+
+type StatsSubscribers struct {
+	// key is the socket connection ID, so that each tab subscribes separately
+	data  map[string]struct{}
+	mutex sync.RWMutex
+}
+
+// ------ Channel structs ------ //
+
+type GetStats struct {
+	// if Uid is empty the first stream found with a matching name is used
+	Uid      string
+	Name     string
+	RecvChan chan *socketMessages.StreamStats
+}
+
+type StatsSubscription struct {
+	ConnID    string
+	Subscribe bool
+}
+
+// ------ General structs ------ //
+
+type StreamStats struct {
+	// as it was first received
+	name       string
+	samples    []chunkSample
+	chunks     int
+	bytes      int64
+	gaps       int
+	bytesToday int64
+	today      time.Time
+	lastSeen   time.Time
+}
+
+type chunkSample struct {
+	time  time.Time
+	bytes int
+}
+
+const statsWindow = time.Minute
+
+// ------ Loops ------ //
+
+func getStats(vs *VideoServer) {
+	for {
+		data := <-vs.GetStats
+
+		vs.Stats.mutex.RLock()
+
+		var out *socketMessages.StreamStats
+		for uid, streams := range vs.Stats.data {
+			if data.Uid != "" && uid != data.Uid {
+				continue
+			}
+			if s, ok := streams[strings.ToLower(data.Name)]; ok {
+				msg := s.toMessage(uid, time.Now())
+				out = &msg
+				break
+			}
+		}
+
+		vs.Stats.mutex.RUnlock()
+
+		data.RecvChan <- out
+	}
+}
+
+func statsSubscription(vs *VideoServer) {
+	for {
+		data := <-vs.StatsSubscription
+
+		vs.StatsSubscribers.mutex.Lock()
+
+		if data.Subscribe {
+			vs.StatsSubscribers.data[data.ConnID] = struct{}{}
+		} else {
+			delete(vs.StatsSubscribers.data, data.ConnID)
+		}
+
+		vs.StatsSubscribers.mutex.Unlock()
+	}
+}
+
+func removeStats(vs *VideoServer) {
+	for {
+		data := <-vs.RemoveStats
+
+		vs.Stats.mutex.Lock()
+
+		if streams, ok := vs.Stats.data[data.Uid]; ok {
+			delete(streams, strings.ToLower(data.Name))
+		}
+
+		vs.Stats.mutex.Unlock()
+	}
+}
+
+func pushStats(vs *VideoServer, ss *socketServer.SocketServer) {
+	interval := time.Second * 5
+	if seconds, err := strconv.Atoi(os.Getenv("STATS_PUSH_INTERVAL")); err == nil && seconds > 0 {
+		interval = time.Second * time.Duration(seconds)
+	}
+
+	for {
+		time.Sleep(interval)
+
+		vs.StatsSubscribers.mutex.RLock()
+
+		connIDs := make(map[string]struct{})
+		for connID := range vs.StatsSubscribers.data {
+			connIDs[connID] = struct{}{}
+		}
+
+		vs.StatsSubscribers.mutex.RUnlock()
+
+		if len(connIDs) == 0 {
+			continue
+		}
+
+		vs.Stats.mutex.RLock()
+
+		now := time.Now()
+		out := []socketMessages.StreamStats{}
+		for uid, streams := range vs.Stats.data {
+			for _, s := range streams {
+				out = append(out, s.toMessage(uid, now))
+			}
+		}
+
+		vs.Stats.mutex.RUnlock()
+
+		ss.SendDataToConnIDs <- socketServer.SendDataToConnIDs{
+			ConnIDs: connIDs,
+			Data: socketMessages.StreamStatsList{
+				Streams: out,
+			},
+			EventName: "STREAM_STATS",
+		}
+	}
+}
+
+// ------ Helper functions ------ //
+
+// A gap is counted whenever the time between two chunks is longer than the
+// gap threshold. Chunks normally arrive every second.
+func recordChunkStats(vs *VideoServer, uid string, name string, size int) {
+	gapThreshold := time.Second * 3
+	if seconds, err := strconv.Atoi(os.Getenv("STATS_GAP_THRESHOLD")); err == nil && seconds > 0 {
+		gapThreshold = time.Second * time.Duration(seconds)
+	}
+
+	vs.Stats.mutex.Lock()
+	defer vs.Stats.mutex.Unlock()
+
+	if _, ok := vs.Stats.data[uid]; !ok {
+		vs.Stats.data[uid] = make(map[string]*StreamStats)
+	}
+	key := strings.ToLower(name)
+	s, ok := vs.Stats.data[uid][key]
+	if !ok {
+		s = &StreamStats{name: name}
+		vs.Stats.data[uid][key] = s
+	}
+
+	now := time.Now()
+	if !s.lastSeen.IsZero() && now.Sub(s.lastSeen) > gapThreshold {
+		s.gaps++
+	}
+	if today := startOfDay(now); !today.Equal(s.today) {
+		s.today = today
+		s.bytesToday = 0
+	}
+
+	s.chunks++
+	s.bytes += int64(size)
+	s.bytesToday += int64(size)
+	s.lastSeen = now
+	s.samples = append(s.samples, chunkSample{time: now, bytes: size})
+	s.trim(now)
+}
+
+// removes samples that fall outside of the sliding window
+func (s *StreamStats) trim(now time.Time) {
+	i := 0
+	for i < len(s.samples) && now.Sub(s.samples[i].time) > statsWindow {
+		i++
+	}
+	s.samples = s.samples[i:]
+}
+
+func (s *StreamStats) toMessage(uid string, now time.Time) socketMessages.StreamStats {
+	var windowBytes int
+	var windowChunks int
+	for _, sample := range s.samples {
+		if now.Sub(sample.time) <= statsWindow {
+			windowBytes += sample.bytes
+			windowChunks++
+		}
+	}
+	var averageChunkSize float64
+	if s.chunks > 0 {
+		averageChunkSize = float64(s.bytes) / float64(s.chunks)
+	}
+	var bytesToday int64
+	if startOfDay(now).Equal(s.today) {
+		bytesToday = s.bytesToday
+	}
+	return socketMessages.StreamStats{
+		StreamerID:       uid,
+		Name:             s.name,
+		Bitrate:          float64(windowBytes*8) / statsWindow.Seconds(),
+		ChunkRate:        float64(windowChunks) / statsWindow.Minutes(),
+		AverageChunkSize: averageChunkSize,
+		GapsDetected:     s.gaps,
+		BytesStoredToday: bytesToday,
+		LastSeen:         s.lastSeen,
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
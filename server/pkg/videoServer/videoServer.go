@@ -10,14 +10,26 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/encryption"
+	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
 )
 
 type VideoServer struct {
-	Streamers Streamers
+	Streamers        Streamers
+	Stats            Stats
+	StatsSubscribers StatsSubscribers
+	Snapshots        Snapshots
 
-	HandleChunk chan HandleChunk
+	HandleChunk       chan HandleChunk
+	GetStats          chan GetStats
+	StatsSubscription chan StatsSubscription
+	RemoveStats       chan CloseStream
+	SetSnapshot       chan SetSnapshot
+	GetSnapshot       chan GetSnapshot
+	MotionStart       chan MotionStart
 }
 
 // ------ Mutex locked ------ //
@@ -45,32 +57,57 @@ type CloseStream struct {
 
 // ------ Initialization ------ //
 
-func Init(db *pgxpool.Pool) *VideoServer {
+func Init(db *pgxpool.Pool, ss *socketServer.SocketServer, vault *encryption.Vault) *VideoServer {
 	vs := &VideoServer{
 		Streamers: Streamers{
 			data: make(map[string]map[string]*sync.WaitGroup),
 		},
+		Stats: Stats{
+			data: make(map[string]map[string]*StreamStats),
+		},
+		StatsSubscribers: StatsSubscribers{
+			data: make(map[string]struct{}),
+		},
+		Snapshots: Snapshots{
+			data: make(map[string]map[string]Snapshot),
+		},
 
-		HandleChunk: make(chan HandleChunk),
+		HandleChunk:       make(chan HandleChunk),
+		GetStats:          make(chan GetStats),
+		StatsSubscription: make(chan StatsSubscription),
+		RemoveStats:       make(chan CloseStream),
+		SetSnapshot:       make(chan SetSnapshot),
+		GetSnapshot:       make(chan GetSnapshot),
+		MotionStart:       make(chan MotionStart),
 	}
-	runServer(vs, db)
+	runServer(vs, db, ss, vault)
 	return vs
 }
 
-func runServer(vs *VideoServer, db *pgxpool.Pool) {
-	go handleChunk(vs, db)
+func runServer(vs *VideoServer, db *pgxpool.Pool, ss *socketServer.SocketServer, vault *encryption.Vault) {
+	go handleChunk(vs, db, vault)
+	go getStats(vs)
+	go statsSubscription(vs)
+	go pushStats(vs, ss)
+	go removeStats(vs)
+	go setSnapshot(vs, db)
+	go getSnapshot(vs)
+	go motionStart(vs, db)
 }
 
 // ------ Loops ------ //
 
 // need to add a waitgroup to this, or a mlock when writing to db
-func handleChunk(vs *VideoServer, db *pgxpool.Pool) {
+func handleChunk(vs *VideoServer, db *pgxpool.Pool, vault *encryption.Vault) {
 	chunkSize, err := strconv.Atoi(os.Getenv("VID_CHUNK_SIZE"))
 	if err != nil {
 		log.Fatalln("Failed to parse VID_CHUNK_SIZE environment variable")
 	}
 	DBChunkSize := int64(chunkSize)
 
+	// each upload sends exactly one result on its ErrorChan, errors inside the loops over
+	// chunks continue this loop rather than the inner one
+loop:
 	for {
 		data := <-vs.HandleChunk
 
@@ -81,7 +118,9 @@ func handleChunk(vs *VideoServer, db *pgxpool.Pool) {
 		conn, err := db.Acquire(ctx)
 		errored := func(err string) {
 			cancel()
-			conn.Release()
+			if conn != nil {
+				conn.Release()
+			}
 			data.ErrorChan <- fmt.Errorf(err)
 		}
 		if err != nil {
@@ -107,24 +146,38 @@ func handleChunk(vs *VideoServer, db *pgxpool.Pool) {
 		// now update/create the metadata and scan the ID
 		var id string
 		var preSavedSize, index int
+		var dataKey []byte
+		var masterKeyID *string
 		if exists {
 			// increment seconds by 1, because chunks come in every second...
 			err = db.QueryRow(ctx, `
-				UPDATE vid_meta SET size = size + $1, seconds = seconds + 1 WHERE (name = $2 AND streamer = $3) RETURNING id,size - $1;
-			`, len(data.Data), data.Name, data.Uid).Scan(&id, &preSavedSize)
+				UPDATE vid_meta SET size = size + $1, seconds = seconds + 1 WHERE (name = $2 AND streamer = $3) RETURNING id,size - $1,data_key,master_key_id;
+			`, len(data.Data), data.Name, data.Uid).Scan(&id, &preSavedSize, &dataKey, &masterKeyID)
 			if err != nil {
 				errored("Failed in execution of handle chunk update meta statement")
 				continue
 			}
 		} else {
-			err = conn.QueryRow(ctx, `
-				INSERT INTO vid_meta (size,name,streamer) VALUES($1,$2,$3) RETURNING id;
-			`, len(data.Data), data.Name, data.Uid).Scan(&id)
+			// the ID is generated here because the data key is bound to it
+			id = uuid.New().String()
+			if dataKey, masterKeyID, err = vault.NewRecordingKey(id); err != nil {
+				errored("Failed to create recording data key")
+				continue
+			}
+			_, err = conn.Exec(ctx, `
+				INSERT INTO vid_meta (id,size,name,streamer,header_size,data_key,master_key_id) VALUES($1,$2,$3,$4,$2,$5,$6);
+			`, id, len(data.Data), data.Name, data.Uid, dataKey, masterKeyID)
 			if err != nil {
 				errored("Failed in execution of handle chunk insert meta statement")
 				continue
 			}
 		}
+		// chunks are sealed and opened through this, it does nothing for plaintext recordings
+		rec, err := vault.Recording(id, dataKey, masterKeyID)
+		if err != nil {
+			errored("Failed to unwrap recording data key")
+			continue
+		}
 		index = int(math.Floor(float64(preSavedSize) / float64(DBChunkSize)))
 
 		// first check if any chunks have been written yet
@@ -140,11 +193,16 @@ func handleChunk(vs *VideoServer, db *pgxpool.Pool) {
 			// if no chunks exist then save the received data as the first chunk(s)
 			chunks := splitIntoChunks(data.Data, int(DBChunkSize))
 			for _, b := range chunks {
+				sealed, err := rec.Seal(index, b)
+				if err != nil {
+					errored("Failed to encrypt chunk")
+					continue loop
+				}
 				if _, err := conn.Exec(ctx, `
 					INSERT INTO vid_chunks (bytes,vid_id,index) VALUES($1,$2,$3);
-				`, b, id, index); err != nil {
+				`, sealed, id, index); err != nil {
 					errored("Failed in execution of handle chunk insert chunk statement")
-					continue
+					continue loop
 				}
 				index++
 			}
@@ -160,12 +218,23 @@ func handleChunk(vs *VideoServer, db *pgxpool.Pool) {
 					continue
 				}
 			}
+			if len(currentChunkBytes) > 0 {
+				if currentChunkBytes, err = rec.Open(index, currentChunkBytes); err != nil {
+					errored("Failed to decrypt partial chunk")
+					continue
+				}
+			}
 
 			// the chunk is not full and the all the received bytes can fit into it, so save the bytes into it
 			if len(data.Data)+preSavedSize <= int(DBChunkSize) {
+				sealed, err := rec.Seal(index, append(currentChunkBytes, data.Data...))
+				if err != nil {
+					errored("Failed to encrypt chunk")
+					continue
+				}
 				_, err = conn.Exec(ctx, `
 				UPDATE vid_chunks SET bytes = $1 WHERE vid_id = $2 AND index = $3;
-			`, append(currentChunkBytes, data.Data...), id, index)
+			`, sealed, id, index)
 				if err != nil {
 					errored("Failed in execution of handle chunk update partial chunk statement")
 					continue
@@ -179,9 +248,14 @@ func handleChunk(vs *VideoServer, db *pgxpool.Pool) {
 				if dataRange > len(data.Data) {
 					dataRange = len(data.Data)
 				}
+				sealed, err := rec.Seal(index, append(currentChunkBytes, data.Data[:dataRange]...))
+				if err != nil {
+					errored("Failed to encrypt chunk")
+					continue
+				}
 				_, err = conn.Exec(ctx, `
 				UPDATE vid_chunks SET bytes = $1 WHERE vid_id = $2 AND index = $3;
-			`, append(currentChunkBytes, data.Data[:dataRange]...), id, index)
+			`, sealed, id, index)
 				if err != nil {
 					errored("Failed in execution of handle chunk update partial chunk statement")
 					continue
@@ -192,12 +266,17 @@ func handleChunk(vs *VideoServer, db *pgxpool.Pool) {
 				chunks := splitIntoChunks(data.Data[dataRange:], int(DBChunkSize))
 				for _, b := range chunks {
 					if len(b) != 0 {
+						sealed, err := rec.Seal(index, b)
+						if err != nil {
+							errored("Failed to encrypt chunk")
+							continue loop
+						}
 						_, err = conn.Exec(ctx, `
 					INSERT INTO vid_chunks (vid_id,index,bytes) VALUES($1,$2,$3);
-				`, id, index, b)
+				`, id, index, sealed)
 						if err != nil {
 							errored("Failed in execution of handle chunk insert chunk statement")
-							continue
+							continue loop
 						}
 					}
 					index++
@@ -207,6 +286,7 @@ func handleChunk(vs *VideoServer, db *pgxpool.Pool) {
 
 		conn.Release()
 		ctx.Done()
+		recordChunkStats(vs, data.Uid, data.Name, len(data.Data))
 		data.ErrorChan <- nil
 	}
 }
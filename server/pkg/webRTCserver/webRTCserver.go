@@ -4,9 +4,12 @@ import (
 	"log"
 	"sync"
 
+	armServer "github.com/web-stuff-98/go-react-vid-streams/pkg/armServer"
+	"github.com/web-stuff-98/go-react-vid-streams/pkg/notifier"
 	socketMessages "github.com/web-stuff-98/go-react-vid-streams/pkg/socketMessages"
 	socketServer "github.com/web-stuff-98/go-react-vid-streams/pkg/socketServer"
 	socketValidation "github.com/web-stuff-98/go-react-vid-streams/pkg/socketValidation"
+	videoServer "github.com/web-stuff-98/go-react-vid-streams/pkg/videoServer"
 )
 
 type WebRTCServer struct {
@@ -22,7 +25,10 @@ type WebRTCServer struct {
 
 // ------ Mutex protected ------ //
 
+// Peers are socket connections rather than users, so that a user can publish from
+// several devices, or watch in several tabs, at once.
 type Connections struct {
+	// key is the socket connection ID
 	data  map[string]Connection
 	mutex sync.RWMutex
 }
@@ -30,31 +36,43 @@ type Connections struct {
 // ------ Channels ------ //
 
 type JoinWebRTC struct {
+	ConnID      string
 	Uid         string
 	StreamsInfo []socketValidation.StreamInfo
 }
 
 type LeaveWebRTC struct {
-	Uid string
+	// when empty every connection belonging to Uid leaves
+	ConnID string
+	Uid    string
+	// set when the streamer logged out, so that everyone is told their streams went
+	// offline rather than only the other WebRTC users
+	LoggedOut bool
 }
 
+// The signal goes to ToConnID, or to all of ToUids connections if it is empty, which
+// is what clients from before connection IDs existed send.
 type SignalWebRTC struct {
 	Signal      string
+	ToConnID    string
 	ToUid       string
+	ConnID      string
 	Uid         string
 	StreamsInfo []socketValidation.StreamInfo
 }
 
 type ReturnSignalWebRTC struct {
-	Signal      string
-	CallerID    string
-	Uid         string
-	StreamsInfo []socketValidation.StreamInfo
+	Signal       string
+	CallerConnID string
+	CallerID     string
+	ConnID       string
+	Uid          string
+	StreamsInfo  []socketValidation.StreamInfo
 }
 
 type MotionUpdate struct {
 	MediaStreamId string
-	Uid           string
+	ConnID        string
 	Motion        bool
 }
 
@@ -70,10 +88,11 @@ type GetActiveStreams struct {
 // ------ General structs ------ //
 
 type Connection struct {
+	Uid         string
 	StreamsInfo []socketValidation.StreamInfo
 }
 
-func Init(ss *socketServer.SocketServer, rtcDC chan string) *WebRTCServer {
+func Init(ss *socketServer.SocketServer, vs *videoServer.VideoServer, as *armServer.ArmServer, n *notifier.Notifier, rtcDC chan string) *WebRTCServer {
 	rtc := &WebRTCServer{
 		Connections: Connections{
 			data: make(map[string]Connection),
@@ -86,26 +105,27 @@ func Init(ss *socketServer.SocketServer, rtcDC chan string) *WebRTCServer {
 		GetActiveStreams:   make(chan GetActiveStreams),
 		DeleteStream:       make(chan DeleteStream),
 	}
-	runServer(rtc, ss, rtcDC)
+	runServer(rtc, ss, vs, as, n, rtcDC)
 	return rtc
 }
 
-func runServer(rtc *WebRTCServer, ss *socketServer.SocketServer, rtcDC chan string) {
+func runServer(rtc *WebRTCServer, ss *socketServer.SocketServer, vs *videoServer.VideoServer, as *armServer.ArmServer, n *notifier.Notifier, rtcDC chan string) {
 	go joinWebRTC(rtc, ss)
 	go leaveWebRTC(rtc, ss)
 	go sendWebRTCSignals(rtc, ss)
 	go returningWebRTCSignals(rtc, ss)
 	go watchForSocketDisconnect(rtc, rtcDC)
-	go motionUpdate(rtc, ss)
+	go motionUpdate(rtc, ss, vs, as, n)
 	go getActiveStreams(rtc)
 	go deleteStream(rtc, ss)
 }
 
+// rtcDC receives the ID of every socket connection that closes
 func watchForSocketDisconnect(rtc *WebRTCServer, rtcDC chan string) {
 	for {
-		uid := <-rtcDC
+		connID := <-rtcDC
 		rtc.LeaveWebRTC <- LeaveWebRTC{
-			Uid: uid,
+			ConnID: connID,
 		}
 	}
 }
@@ -116,31 +136,31 @@ func joinWebRTC(rtc *WebRTCServer, ss *socketServer.SocketServer) {
 
 		rtc.Connections.mutex.Lock()
 
+		// other connections of the same user are peers like any other
 		users := []socketMessages.WebRTCOutUser{}
-		for uid, connectionInfo := range rtc.Connections.data {
-			if uid != data.Uid {
+		connIDs := make(map[string]struct{})
+		for connID, connectionInfo := range rtc.Connections.data {
+			if connID != data.ConnID {
 				users = append(users, socketMessages.WebRTCOutUser{
-					Uid:         uid,
+					Uid:         connectionInfo.Uid,
+					ConnID:      connID,
 					StreamsInfo: connectionInfo.StreamsInfo,
 				})
+				connIDs[connID] = struct{}{}
 			}
 		}
 
-		uidsMap := make(map[string]struct{})
-		for _, wru := range users {
-			uidsMap[wru.Uid] = struct{}{}
-		}
-
-		ss.SendDataToUids <- socketServer.SendDataToUids{
-			Uids: uidsMap,
+		ss.SendDataToConnIDs <- socketServer.SendDataToConnIDs{
+			ConnIDs: connIDs,
 			Data: socketMessages.WebRTCUserJoinedLeft{
-				Uid: data.Uid,
+				Uid:    data.Uid,
+				ConnID: data.ConnID,
 			},
 			EventName: "WEBRTC_USER_JOINED",
 		}
 
-		ss.SendDataToUid <- socketServer.SendDataToUid{
-			Uid: data.Uid,
+		ss.SendDataToConnID <- socketServer.SendDataToConnID{
+			ConnID: data.ConnID,
 			Data: socketMessages.WebRTCAllUsers{
 				Users: users,
 			},
@@ -149,7 +169,8 @@ func joinWebRTC(rtc *WebRTCServer, ss *socketServer.SocketServer) {
 
 		log.Printf("User joined - all users: %v", users)
 
-		rtc.Connections.data[data.Uid] = Connection{
+		rtc.Connections.data[data.ConnID] = Connection{
+			Uid:         data.Uid,
 			StreamsInfo: data.StreamsInfo,
 		}
 
@@ -163,22 +184,46 @@ func leaveWebRTC(rtc *WebRTCServer, ss *socketServer.SocketServer) {
 
 		rtc.Connections.mutex.Lock()
 
-		uids := make(map[string]struct{})
-		for uid := range rtc.Connections.data {
-			if uid != data.Uid {
-				uids[uid] = struct{}{}
+		leaving := make(map[string]Connection)
+		for connID, connData := range rtc.Connections.data {
+			if connID == data.ConnID || (data.ConnID == "" && connData.Uid == data.Uid) {
+				leaving[connID] = connData
 			}
 		}
 
-		ss.SendDataToUids <- socketServer.SendDataToUids{
-			Uids: uids,
-			Data: socketMessages.WebRTCUserJoinedLeft{
-				Uid: data.Uid,
-			},
-			EventName: "WEBRTC_USER_LEFT",
+		for connID := range leaving {
+			delete(rtc.Connections.data, connID)
 		}
 
-		delete(rtc.Connections.data, data.Uid)
+		remaining := make(map[string]struct{})
+		for connID := range rtc.Connections.data {
+			remaining[connID] = struct{}{}
+		}
+
+		for connID, connData := range leaving {
+			ss.SendDataToConnIDs <- socketServer.SendDataToConnIDs{
+				ConnIDs: remaining,
+				Data: socketMessages.WebRTCUserJoinedLeft{
+					Uid:    connData.Uid,
+					ConnID: connID,
+				},
+				EventName: "WEBRTC_USER_LEFT",
+			}
+
+			if data.LoggedOut {
+				names := []string{}
+				for _, si := range connData.StreamsInfo {
+					names = append(names, si.StreamName)
+				}
+				ss.SendDataToAll <- socketServer.SendDataToAll{
+					Data: socketMessages.StreamsOffline{
+						StreamerID: connData.Uid,
+						Names:      names,
+					},
+					EventName: "STREAMS_OFFLINE",
+				}
+			}
+		}
 
 		rtc.Connections.mutex.Unlock()
 	}
@@ -188,13 +233,14 @@ func sendWebRTCSignals(rtc *WebRTCServer, ss *socketServer.SocketServer) {
 	for {
 		data := <-rtc.SignalWebRTC
 
-		ss.SendDataToUid <- socketServer.SendDataToUid{
-			Uid:       data.ToUid,
+		ss.SendDataToConnIDs <- socketServer.SendDataToConnIDs{
+			ConnIDs:   targetConns(rtc, data.ToConnID, data.ToUid),
 			EventName: "WEBRTC_JOINED_SIGNAL",
 			Data: socketMessages.WebRTCUserJoined{
-				CallerID:    data.Uid,
-				Signal:      data.Signal,
-				StreamsInfo: data.StreamsInfo,
+				CallerID:     data.Uid,
+				CallerConnID: data.ConnID,
+				Signal:       data.Signal,
+				StreamsInfo:  data.StreamsInfo,
 			},
 		}
 	}
@@ -204,50 +250,98 @@ func returningWebRTCSignals(rtc *WebRTCServer, ss *socketServer.SocketServer) {
 	for {
 		data := <-rtc.ReturnSignalWebRTC
 
-		ss.SendDataToUid <- socketServer.SendDataToUid{
-			Uid:       data.CallerID,
+		ss.SendDataToConnIDs <- socketServer.SendDataToConnIDs{
+			ConnIDs:   targetConns(rtc, data.CallerConnID, data.CallerID),
 			EventName: "WEBRTC_RETURN_SIGNAL_OUT",
 			Data: socketMessages.WebRTCReturnSignal{
 				Signal:      data.Signal,
 				Uid:         data.Uid,
+				ConnID:      data.ConnID,
 				StreamsInfo: data.StreamsInfo,
 			},
 		}
 	}
 }
 
-func motionUpdate(rtc *WebRTCServer, ss *socketServer.SocketServer) {
+func motionUpdate(rtc *WebRTCServer, ss *socketServer.SocketServer, vs *videoServer.VideoServer, as *armServer.ArmServer, n *notifier.Notifier) {
 	for {
 		data := <-rtc.MotionUpdate
 
 		rtc.Connections.mutex.Lock()
 
-		if info, ok := rtc.Connections.data[data.Uid]; ok {
+		var uid, streamName string
+		if info, ok := rtc.Connections.data[data.ConnID]; ok {
+			uid = info.Uid
+			for _, si := range info.StreamsInfo {
+				if si.MediaStreamID == data.MediaStreamId {
+					streamName = si.StreamName
+					break
+				}
+			}
+		}
+
+		// motion events from disarmed streams are suppressed, but the motion state is still
+		// kept track of, so that motion starting after the stream is armed again is noticed
+		armedChan := make(chan bool, 1)
+		as.GetArmed <- armServer.GetArmed{
+			Uid:      uid,
+			Name:     streamName,
+			RecvChan: armedChan,
+		}
+		armed := <-armedChan
+		close(armedChan)
+
+		motionStarted := false
+		if info, ok := rtc.Connections.data[data.ConnID]; ok {
 			newStreamsInfo := info.StreamsInfo
 
 			for i, si := range newStreamsInfo {
 				if si.MediaStreamID == data.MediaStreamId {
+					motionStarted = armed && !si.Motion && data.Motion
 					newStreamsInfo[i].Motion = data.Motion
 					break
 				}
 			}
 
-			rtc.Connections.data[data.Uid] = Connection{
+			rtc.Connections.data[data.ConnID] = Connection{
+				Uid:         uid,
 				StreamsInfo: newStreamsInfo,
 			}
 		}
 
+		if !armed {
+			rtc.Connections.mutex.Unlock()
+			continue
+		}
+
+		if motionStarted {
+			vs.MotionStart <- videoServer.MotionStart{
+				Uid:  uid,
+				Name: streamName,
+			}
+		}
+
 		ss.SendDataToAllExcept <- socketServer.SendDataToAllExcept{
-			Exclude: data.Uid,
+			ExcludeConnID: data.ConnID,
 			Data: socketMessages.WebRTCMotionUpdate{
 				Motion:        true,
 				MediaStreamID: data.MediaStreamId,
-				StreamerID:    data.Uid,
+				StreamerID:    uid,
+				ConnID:        data.ConnID,
 			},
 			EventName: "WEBRTC_MOTION_UPDATE",
 		}
 
 		rtc.Connections.mutex.Unlock()
+
+		// after unlocking, delivering notifications involves the database
+		if motionStarted {
+			n.Notify <- notifier.Notification{
+				Event:      notifier.EventMotionStart,
+				StreamerID: uid,
+				StreamName: streamName,
+			}
+		}
 	}
 }
 
@@ -275,20 +369,19 @@ func deleteStream(rtc *WebRTCServer, ss *socketServer.SocketServer) {
 
 		rtc.Connections.mutex.Lock()
 
-		if connData, ok := rtc.Connections.data[data.Uid]; ok {
-			var index int
-			for i, si := range connData.StreamsInfo {
-				if si.StreamName == data.StreamName {
-					index = i
-					break
+		// the stream could be published from any of the streamers connections
+		for connID, connData := range rtc.Connections.data {
+			if connData.Uid != data.Uid {
+				continue
+			}
+			newStreamsInfo := []socketValidation.StreamInfo{}
+			for _, si := range connData.StreamsInfo {
+				if si.StreamName != data.StreamName {
+					newStreamsInfo = append(newStreamsInfo, si)
 				}
 			}
-			newStreamsInfo := connData.StreamsInfo
-			// Theres no array splice method in golang???
-			// Remove the element at index i from a.
-			newStreamsInfo[index] = newStreamsInfo[len(newStreamsInfo)-1] // Copy last element to index i.
-			newStreamsInfo = newStreamsInfo[:len(newStreamsInfo)-1]       // Truncate slice.
-			rtc.Connections.data[data.Uid] = Connection{
+			rtc.Connections.data[connID] = Connection{
+				Uid:         connData.Uid,
 				StreamsInfo: newStreamsInfo,
 			}
 		}
@@ -308,3 +401,25 @@ func deleteStream(rtc *WebRTCServer, ss *socketServer.SocketServer) {
 		rtc.Connections.mutex.Unlock()
 	}
 }
+
+// ------ Helper functions ------ //
+
+// The connection if given, otherwise every connection of the uid that is in WebRTC.
+// Must be called from a loop, it locks the connections itself.
+func targetConns(rtc *WebRTCServer, connID string, uid string) map[string]struct{} {
+	connIDs := make(map[string]struct{})
+	if connID != "" {
+		connIDs[connID] = struct{}{}
+		return connIDs
+	}
+
+	rtc.Connections.mutex.RLock()
+	for id, c := range rtc.Connections.data {
+		if c.Uid == uid {
+			connIDs[id] = struct{}{}
+		}
+	}
+	rtc.Connections.mutex.RUnlock()
+
+	return connIDs
+}